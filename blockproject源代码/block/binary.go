@@ -0,0 +1,241 @@
+package block
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"math/big"
+)
+
+var errShortBuffer = errors.New("binary data too short")
+
+// 紧凑二进制编码的写入器，整数用 varint，变长数据带长度前缀
+type binWriter struct {
+	buf []byte
+}
+
+func (w *binWriter) uvarint(v uint64) {
+	w.buf = binary.AppendUvarint(w.buf, v)
+}
+
+func (w *binWriter) varint(v int64) {
+	w.buf = binary.AppendVarint(w.buf, v)
+}
+
+func (w *binWriter) fixed(p []byte) {
+	w.buf = append(w.buf, p...)
+}
+
+func (w *binWriter) bytes(p []byte) {
+	w.uvarint(uint64(len(p)))
+	w.buf = append(w.buf, p...)
+}
+
+func (w *binWriter) string(s string) {
+	w.bytes([]byte(s))
+}
+
+// 符号字节 + 带长度前缀的绝对值，nil 按 0 编码
+func (w *binWriter) bigInt(v *big.Int) {
+	if v == nil {
+		v = new(big.Int)
+	}
+	if v.Sign() < 0 {
+		w.buf = append(w.buf, 1)
+	} else {
+		w.buf = append(w.buf, 0)
+	}
+	w.bytes(v.Bytes())
+}
+
+// 与 binWriter 对应的读取器，第一次出错后后续读取都返回零值，最后统一检查 err
+type binReader struct {
+	data []byte
+	off  int
+	err  error
+}
+
+func (r *binReader) fail(err error) {
+	if r.err == nil {
+		r.err = fmt.Errorf("偏移 %d：%w", r.off, err)
+	}
+}
+
+func (r *binReader) uvarint() uint64 {
+	if r.err != nil {
+		return 0
+	}
+	v, n := binary.Uvarint(r.data[r.off:])
+	if n <= 0 {
+		r.fail(errShortBuffer)
+		return 0
+	}
+	r.off += n
+	return v
+}
+
+func (r *binReader) varint() int64 {
+	if r.err != nil {
+		return 0
+	}
+	v, n := binary.Varint(r.data[r.off:])
+	if n <= 0 {
+		r.fail(errShortBuffer)
+		return 0
+	}
+	r.off += n
+	return v
+}
+
+func (r *binReader) fixed(p []byte) {
+	if r.err != nil {
+		return
+	}
+	if len(r.data)-r.off < len(p) {
+		r.fail(errShortBuffer)
+		return
+	}
+	copy(p, r.data[r.off:])
+	r.off += len(p)
+}
+
+func (r *binReader) bytes() []byte {
+	n := r.uvarint()
+	if r.err != nil {
+		return nil
+	}
+	if uint64(len(r.data)-r.off) < n {
+		r.fail(errShortBuffer)
+		return nil
+	}
+	p := make([]byte, n)
+	copy(p, r.data[r.off:])
+	r.off += int(n)
+	return p
+}
+
+func (r *binReader) string() string {
+	return string(r.bytes())
+}
+
+func (r *binReader) bigInt() *big.Int {
+	var sign [1]byte
+	r.fixed(sign[:])
+	v := new(big.Int).SetBytes(r.bytes())
+	if sign[0] == 1 {
+		v.Neg(v)
+	} else if sign[0] != 0 {
+		r.fail(fmt.Errorf("非法的符号字节 %d", sign[0]))
+	}
+	return v
+}
+
+// 读完后不能有多余的字节
+func (r *binReader) finish() error {
+	if r.err == nil && r.off != len(r.data) {
+		r.fail(fmt.Errorf("多出 %d 字节", len(r.data)-r.off))
+	}
+	return r.err
+}
+
+// 区块的紧凑二进制编码，用于导出导入链数据。
+// Merkle 根可以由交易算出，不写入编码，解码时重新计算
+func (b *Block) MarshalBinary() ([]byte, error) {
+	w := new(binWriter)
+	w.varint(b.timestamp)
+	w.bigInt(b.nonce)
+	w.fixed(b.previousHash[:])
+	w.fixed(b.hash[:])
+	w.bigInt(b.number)
+	w.bigInt(b.difficulty)
+	w.uvarint(uint64(b.txSize))
+	// 交易列表为 nil 时写 0，否则写数量 + 1，导入后的区块与导出前一样区分 nil 和空列表，再次导出的数据不变
+	if b.transactions == nil {
+		w.uvarint(0)
+	} else {
+		w.uvarint(uint64(len(b.transactions)) + 1)
+	}
+	for _, t := range b.transactions {
+		t.marshalBinary(w)
+	}
+	w.bytes(b.seal)
+	return w.buf, nil
+}
+
+func (b *Block) UnmarshalBinary(data []byte) error {
+	r := &binReader{data: data}
+	b.timestamp = r.varint()
+	b.nonce = r.bigInt()
+	r.fixed(b.previousHash[:])
+	r.fixed(b.hash[:])
+	b.number = r.bigInt()
+	b.difficulty = r.bigInt()
+	txSize := r.uvarint()
+	if txSize > 0xffff {
+		r.fail(fmt.Errorf("txSize %d 超出范围", txSize))
+	}
+	b.txSize = uint16(txSize)
+	count := r.uvarint()
+	if r.err == nil && count > uint64(len(data)) {
+		r.fail(fmt.Errorf("交易数量 %d 超出数据长度", count))
+	}
+	b.transactions = nil
+	if count > 0 {
+		count--
+		b.transactions = make([]*Transaction, 0, count)
+	}
+	for i := uint64(0); i < count && r.err == nil; i++ {
+		t := new(Transaction)
+		t.unmarshalBinary(r)
+		b.transactions = append(b.transactions, t)
+	}
+	b.seal = r.bytes()
+	if len(b.seal) == 0 {
+		b.seal = nil
+	}
+	b.merkleRoot = MerkleRoot(b.transactions)
+	return r.finish()
+}
+
+// 公钥和签名为空时写长度 0
+func (t *Transaction) marshalBinary(w *binWriter) {
+	w.string(t.senderAddress)
+	w.string(t.receiveAddress)
+	w.bigInt(t.value)
+	w.bigInt(t.fee)
+	w.uvarint(t.chainID)
+	w.uvarint(t.nonce)
+	w.fixed(t.hash[:])
+	w.bytes(publicKeyBytes(t.senderPublicKey))
+	w.bytes(signatureBytes(t.signature))
+}
+
+func (t *Transaction) unmarshalBinary(r *binReader) {
+	t.senderAddress = r.string()
+	t.receiveAddress = r.string()
+	t.value = r.bigInt()
+	t.fee = r.bigInt()
+	t.chainID = r.uvarint()
+	t.nonce = r.uvarint()
+	r.fixed(t.hash[:])
+	var err error
+	if t.senderPublicKey, err = parsePublicKey(r.bytes()); err != nil {
+		r.fail(err)
+	}
+	if t.signature, err = parseSignature(r.bytes()); err != nil {
+		r.fail(err)
+	}
+}
+
+// 交易的二进制编码长度（字节），打包区块时按交易费 / 长度排序
+func (t *Transaction) Size() int {
+	w := new(binWriter)
+	t.marshalBinary(w)
+	return len(w.buf)
+}
+
+// 区块的二进制编码长度（字节），用于检查 MAX_BLOCK_SIZE
+func (b *Block) Size() int {
+	data, _ := b.MarshalBinary()
+	return len(data)
+}
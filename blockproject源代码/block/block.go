@@ -6,12 +6,12 @@ import (
 	"crypto/sha256"
 	"encoding/hex"
 	"encoding/json"
+	"errors"
 	"fmt"
 	"jhblockchain/utils"
 	"log"
 	"math/big"
 	"net/http"
-	"os"
 	"strings"
 	"sync"
 	"time"
@@ -19,11 +19,16 @@ import (
 	"github.com/fatih/color"
 )
 
+// 创世纪块的难度，之后每个区块的难度由 NextDifficulty 根据链上历史计算。
+// 这里的链参数是默认值，可以由链配置修改，见 ChainSpec.Apply
 var MINING_DIFFICULT = 0x80000
 
 const MINING_ACCOUNT_ADDRESS = "XYJ BLOCKCHAIN"
-const MINING_REWARD = 5000
-const MINING_TIMER_SEC = 10
+
+// 初始的挖矿奖励，之后按 BlockReward 的计划减半
+var MINING_REWARD int64 = 5000
+var MINING_TIMER_SEC int64 = 10
+
 const (
 	//以下参数可以添加到启动参数
 	BLOCKCHAIN_PORT_RANGE_START      = 5000
@@ -39,18 +44,22 @@ type Block struct {
 	previousHash [32]byte
 	timestamp    int64
 	transactions []*Transaction
+	merkleRoot   [32]byte
 	number       *big.Int
 	difficulty   *big.Int
 	hash         [32]byte
 	txSize       uint16
+	// 权威证明的出块签名，不参与哈希计算，工作量证明的区块为空
+	seal []byte
 }
 
 func NewBlock(number *big.Int, nonce *big.Int, previousHash [32]byte, txs []*Transaction) *Block {
 	b := new(Block)
-	b.timestamp = time.Now().UnixNano()
+	b.timestamp = clock().UnixNano()
 	b.nonce = nonce
 	b.previousHash = previousHash
 	b.transactions = txs
+	b.merkleRoot = MerkleRoot(txs)
 	b.number = number
 	b.txSize = uint16(len(txs))
 	b.difficulty = big.NewInt(int64(MINING_DIFFICULT))
@@ -85,7 +94,14 @@ func (b *Block) Print() {
 
 type Blockchain struct {
 	transactionPool   []*Transaction
-	chain             []*Block
+	muxPool           sync.Mutex
+	store             BlockStore
+	state             *StateDB
+	work              *workIndex
+	tip               *tipSignal
+	muxMining         sync.Mutex
+	templates         *templateCache
+	engine            ConsensusEngine
 	blockchainAddress string
 	port              uint16
 	mux               sync.Mutex
@@ -98,65 +114,139 @@ type Blockchain struct {
 // 函数定义了一个创建区块链的方法，它接收一个字符串类型的参数 blockchainAddress，
 // 它返回一个区块链类型的指针。在函数内部，它创建一个区块链对象并为其设置地址，
 // 然后创建一个创世块并将其添加到区块链中，最后返回区块链对象。
+// 区块保存在当前目录的 blocks.log 中，需要指定存储时使用 NewBlockchainWithStore
 func NewBlockchain(blockchainAddress string, port uint16) *Blockchain {
-	bc := new(Blockchain)
-	blocks, _ := ReadBlock()
-	bc.chain = blocks
-	bc.Print()
-	if len(bc.chain) == 0 {
-		b := &Block{}
-		bc.CreateBlock(big.NewInt(0), big.NewInt(0), b.Hash()) //创世纪块
-		bc.blockchainAddress = blockchainAddress
-		bc.AddTransaction(MINING_ACCOUNT_ADDRESS, bc.blockchainAddress, big.NewInt(0), nil, nil)
+	store, err := NewFileStore(".", SYNC_ALWAYS)
+	if err != nil {
+		log.Fatal("打开区块存储失败 ", err)
+	}
+	bc, err := NewBlockchainWithStore(blockchainAddress, port, store)
+	if err != nil {
+		log.Fatal("加载区块失败 ", err)
 	}
-	bc.blockchainAddress = blockchainAddress
-	bc.port = port
 	return bc
 }
 
-// 将区块链信息写入txt文件
-func (b *Block) WriteBlock() error {
-	m, _ := b.MarshalJSON()
-	// 打开文件，使用追加模式
-	file, err := os.OpenFile("blockchain.txt", os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0644)
-	if err != nil {
-		fmt.Println("无法打开文件：", err)
-	}
-	defer file.Close()
+// 使用给定的区块存储创建区块链，存储为空时按默认链配置创建创世纪块
+func NewBlockchainWithStore(blockchainAddress string, port uint16, store BlockStore) (*Blockchain, error) {
+	return NewBlockchainWithSpec(blockchainAddress, port, store, nil)
+}
 
-	// 写入字符串到文件
-	_, err = file.WriteString(string(m[:]) + "\n")
-	if err != nil {
-		fmt.Println("无法写入文件：", err)
-	}
-	return err
+// 使用给定的区块存储和链配置创建区块链：存储为空时写入 spec 的创世纪块，
+// 否则存储中的创世纪块必须与 spec 一致，不一致时返回错误。spec 为 nil 时使用默认链配置。
+// spec 中的共识参数需要调用方先通过 ChainSpec.Apply 设置。使用工作量证明校验存储中的区块
+func NewBlockchainWithSpec(blockchainAddress string, port uint16, store BlockStore, spec *ChainSpec) (*Blockchain, error) {
+	return NewBlockchainWithEngine(blockchainAddress, port, store, spec, NewPoWEngine(0))
 }
 
-// 从txt文件中读取区块信息
-func ReadBlock() ([]*Block, error) {
-	file, err := os.Open("blockchain.txt")
-	if err != nil {
+// 与 NewBlockchainWithSpec 相同，但使用共识引擎 engine。启动时重放的区块都按 engine 完整校验，
+// 存储中有不合法的区块时返回错误，不会在不合法的链上继续出块
+func NewBlockchainWithEngine(blockchainAddress string, port uint16, store BlockStore, spec *ChainSpec, engine ConsensusEngine) (*Blockchain, error) {
+	if spec == nil {
+		spec = DefaultChainSpec()
+	}
+	if err := InitGenesis(store, spec); err != nil {
 		return nil, err
 	}
-	defer file.Close()
-	blocks := make([]*Block, 0)
-
-	dec := json.NewDecoder(file)
+	bc := new(Blockchain)
+	bc.store = store
+	// 启动时先从快照恢复账户状态，再按顺序重放之后的区块，区块读完即丢弃，不常驻内存
+	bc.state = NewStateDB()
+	bc.work = newWorkIndex()
+	bc.tip = newTipSignal()
+	bc.templates = newTemplateCache()
+	bc.engine = engine
+	head, replayed, err := bc.replayBlocks(bc.restoreSnapshot() + 1)
+	if err != nil {
+		return nil, fmt.Errorf("重建账户状态失败：%w", err)
+	}
+	if replayed >= STATE_SNAPSHOT_INTERVAL {
+		bc.saveSnapshot(head)
+	}
+	color.Green("%s BLOCK %d %s\n", strings.Repeat("=", 25), head.number, strings.Repeat("=", 25))
+	head.Print()
+	bc.blockchainAddress = blockchainAddress
+	bc.port = port
+	return bc, nil
+}
 
-	for dec.More() {
-		var block *Block
-		if err := dec.Decode(&block); err != nil {
-			color.Red("无法加载区块")
-			return nil, err
+// 从区块号 from 开始把存储中的区块依次校验并应用到账户状态，返回最后一个区块和重放的区块数。
+// from 为 0 时按顺序遍历整个存储，否则逐个按区块号读取快照之后的区块。
+// 快照只在区块追加到链上之后保存，快照之前的区块都已经校验过
+func (bc *Blockchain) replayBlocks(from int64) (*Block, uint64, error) {
+	var head *Block
+	replayed := uint64(0)
+	apply := func(b *Block) error {
+		if err := VerifyBlock(bc.engine, head, b, bc.store.GetByNumber); err != nil {
+			return fmt.Errorf("存储中的区块不合法：%w", err)
+		}
+		if err := VerifyBalances(b, bc.state); err != nil {
+			return fmt.Errorf("存储中的区块不合法：%w", err)
 		}
-		blocks = append(blocks, block)
+		if err := bc.state.ApplyBlock(b); err != nil {
+			return err
+		}
+		bc.work.push(b)
+		head = b
+		replayed++
+		return nil
 	}
+	if from == 0 {
+		var applyErr error
+		err := bc.store.Iterate(func(b *Block) bool {
+			applyErr = apply(b)
+			return applyErr == nil
+		})
+		if err == nil {
+			err = applyErr
+		}
+		if err != nil {
+			return nil, replayed, err
+		}
+	} else {
+		var err error
+		if head, err = bc.store.GetByNumber(uint64(from - 1)); err != nil {
+			return nil, replayed, err
+		}
+		for n := uint64(from); ; n++ {
+			b, err := bc.store.GetByNumber(n)
+			if errors.Is(err, ErrBlockNotFound) {
+				break
+			}
+			if err != nil {
+				return nil, replayed, err
+			}
+			if err := apply(b); err != nil {
+				return nil, replayed, err
+			}
+		}
+	}
+	if head == nil {
+		return nil, replayed, ErrBlockNotFound
+	}
+	return head, replayed, nil
+}
 
+// 从存储中按顺序读出全部区块
+func loadChain(store BlockStore) ([]*Block, error) {
+	blocks := make([]*Block, 0)
+	err := store.Iterate(func(b *Block) bool {
+		blocks = append(blocks, b)
+		return true
+	})
+	if err != nil {
+		return nil, err
+	}
 	return blocks, nil
 }
 
+// 返回整条链，会把所有区块读入内存，只在需要完整链时使用
 func (bc *Blockchain) Chain() []*Block {
-	return bc.chain
+	blocks, err := loadChain(bc.store)
+	if err != nil {
+		color.Red("无法加载区块 %v", err)
+	}
+	return blocks
 }
 
 func (bc *Blockchain) Run() {
@@ -187,99 +277,104 @@ func (bc *Blockchain) StartSyncNeighbors() {
 }
 
 func (bc *Blockchain) TransactionPool() []*Transaction {
-	return bc.transactionPool
+	bc.muxPool.Lock()
+	defer bc.muxPool.Unlock()
+	pool := make([]*Transaction, len(bc.transactionPool))
+	copy(pool, bc.transactionPool)
+	return pool
 }
 
 func (bc *Blockchain) ClearTransactionPool() {
+	bc.muxPool.Lock()
+	defer bc.muxPool.Unlock()
 	bc.transactionPool = bc.transactionPool[:0]
 	color.Magenta("%x", len(bc.transactionPool))
-	blocks, _ := ReadBlock()
-	bc.chain = blocks
 }
 
+// total_work 仅供参考，接收方需要根据区块自行计算累计工作量
 func (bc *Blockchain) MarshalJSON() ([]byte, error) {
+	chain := bc.Chain()
 	return json.Marshal(struct {
-		Blocks []*Block `json:"chain"`
+		Blocks    []*Block `json:"chain"`
+		TotalWork *big.Int `json:"total_work"`
 	}{
-		Blocks: bc.chain,
+		Blocks:    chain,
+		TotalWork: ChainWork(chain),
 	})
 }
 
+// 解码得到的链保存在内存存储中
 func (bc *Blockchain) UnmarshalJSON(data []byte) error {
+	var blocks []*Block
 	v := &struct {
 		Blocks *[]*Block `json:"chain"`
 	}{
-		Blocks: &bc.chain,
+		Blocks: &blocks,
 	}
 	if err := json.Unmarshal(data, &v); err != nil {
 		return err
 	}
+	store := NewMemoryStore()
+	if err := store.ReplaceFrom(0, blocks); err != nil {
+		return err
+	}
+	bc.store = store
 	return nil
 }
 
-// (bc *Blockchain) CreateBlock(nonce int, previousHash [32]byte) *Block
-//  函数是在区块链上创建新的区块，它接收两个参数：一个int类型的nonce和一个字节数组类型的 previousHash，
-//  返回一个区块类型的指针。在函数内部，它使用传入的参数来创建一个新的区块，
-//  然后将该区块添加到区块链的链上，并清空交易池。
-
-func (bc *Blockchain) CreateBlock(number *big.Int, nonce *big.Int, previousHash [32]byte) *Block {
-	b := NewBlock(number, nonce, previousHash, bc.transactionPool)
-
-	bc.chain = append(bc.chain, b)
-	bc.transactionPool = []*Transaction{}
-
-	err := b.WriteBlock()
+// 把区块写入存储、更新账户状态，并从交易池中移除区块打包的交易
+func (bc *Blockchain) appendBlock(b *Block) {
+	err := bc.store.Append(b)
 	if err != nil {
 		log.Fatal("写入区块失败", err)
 	}
-
-	// 删除其他节点的交易
-	for _, n := range bc.neighbors {
-		endpoint := fmt.Sprintf("http://%s/transactions", n)
-		client := &http.Client{}
-		req, _ := http.NewRequest("DELETE", endpoint, nil)
-		resp, _ := client.Do(req)
-		log.Printf("%v", resp)
+	if err := bc.state.ApplyBlock(b); err != nil {
+		log.Fatal("更新账户状态失败", err)
 	}
-
-	return b
+	bc.removeFromPool(b.transactions)
+	bc.work.push(b)
+	if STATE_SNAPSHOT_INTERVAL > 0 && b.number.Uint64()%STATE_SNAPSHOT_INTERVAL == 0 {
+		bc.saveSnapshot(b)
+	}
+	bc.tip.notify()
 }
 
 // 根据区块号查询区块
 func (bc *Blockchain) GetBlockByNumber(blockid uint64) (*Block, error) {
-	for i, block := range bc.chain {
-		if uint64(i) == blockid {
-			color.Green("%s BLOCK %d %s\n", strings.Repeat("=", 25), blockid, strings.Repeat("=", 25))
-			block.Print()
-			return block, nil
-		}
+	block, err := bc.store.GetByNumber(blockid)
+	if err != nil {
+		return nil, err
 	}
-	return nil, nil
+	color.Green("%s BLOCK %d %s\n", strings.Repeat("=", 25), blockid, strings.Repeat("=", 25))
+	block.Print()
+	return block, nil
 }
 
 // 根据哈希查询区块
 func (bc *Blockchain) GetBlockByHash(hash [32]byte) (*Block, error) {
-	for _, block := range bc.chain {
-		if block.hash == hash {
-			color.Green("%s BLOCK %d %s\n", strings.Repeat("=", 25), block.number, strings.Repeat("=", 25))
-			block.Print()
-			return block, nil
-		}
+	block, err := bc.store.GetByHash(hash)
+	if err != nil {
+		return nil, err
 	}
-	return nil, nil
+	color.Green("%s BLOCK %d %s\n", strings.Repeat("=", 25), block.number, strings.Repeat("=", 25))
+	block.Print()
+	return block, nil
 }
 
 func (bc *Blockchain) Print() {
-	for i, block := range bc.chain {
+	i := 0
+	bc.store.Iterate(func(block *Block) bool {
 		color.Green("%s BLOCK %d %s\n", strings.Repeat("=", 25), i, strings.Repeat("=", 25))
 		block.Print()
-	}
+		i++
+		return true
+	})
 	color.Yellow("%s\n\n\n", strings.Repeat("*", 50))
 }
 
+// 区块哈希是区块头规范编码的 SHA-256，见 EncodeHeader
 func (b *Block) Hash() [32]byte {
-	m, _ := json.Marshal(b)
-	return sha256.Sum256([]byte(m))
+	return sha256.Sum256(b.EncodeHeader())
 }
 
 func (b *Block) MarshalJSON() ([]byte, error) {
@@ -289,46 +384,56 @@ func (b *Block) MarshalJSON() ([]byte, error) {
 		Nonce        *big.Int       `json:"nonce"`
 		PreviousHash string         `json:"previous_hash"`
 		Transactions []*Transaction `json:"transactions"`
+		MerkleRoot   string         `json:"merkle_root"`
 		Hash         string         `json:"hash"`
 		Number       *big.Int       `json:"number"`
 		Difficulty   *big.Int       `json:"difficulty"`
 		TxSize       uint16         `json:"txSize"`
+		Seal         string         `json:"seal,omitempty"`
 	}{
 		Timestamp:    b.timestamp,
 		Nonce:        b.nonce,
 		PreviousHash: fmt.Sprintf("%x", b.previousHash),
 		Transactions: b.transactions,
+		MerkleRoot:   fmt.Sprintf("%x", b.merkleRoot),
 		Hash:         fmt.Sprintf("%x", b.hash),
 		Number:       b.number,
 		Difficulty:   b.difficulty,
 		TxSize:       b.txSize,
+		Seal:         hex.EncodeToString(b.seal),
 	})
 }
 
 func (b *Block) UnmarshalJSON(data []byte) error {
 	var previousHash string
 	var hash string
+	var merkleRoot string
 	var nonce int64
 	var number int64
 	var difficulty int64
+	var seal string
 	v := &struct {
 		Timestamp    *int64          `json:"timestamp"`
 		Nonce        *int64          `json:"nonce"`
 		PreviousHash *string         `json:"previous_hash"`
 		Transactions *[]*Transaction `json:"transactions"`
+		MerkleRoot   *string         `json:"merkle_root"`
 		Hash         *string         `json:"hash"`
 		Number       *int64          `json:"number"`
 		Difficulty   *int64          `json:"difficulty"`
 		TxSize       *uint16         `json:"txSize"`
+		Seal         *string         `json:"seal"`
 	}{
 		Timestamp:    &b.timestamp,
 		Nonce:        &nonce,
 		PreviousHash: &previousHash,
 		Transactions: &b.transactions,
+		MerkleRoot:   &merkleRoot,
 		Hash:         &hash,
 		Number:       &number,
 		Difficulty:   &difficulty,
 		TxSize:       &b.txSize,
+		Seal:         &seal,
 	}
 	if err := json.Unmarshal(data, &v); err != nil {
 		return err
@@ -337,66 +442,108 @@ func (b *Block) UnmarshalJSON(data []byte) error {
 	b.difficulty = big.NewInt(difficulty)
 	b.number = big.NewInt(number)
 
-	ph, _ := hex.DecodeString(*v.PreviousHash)
-	copy(b.previousHash[:], ph[:32])
+	// 数据可能来自邻居，长度不对时返回错误，不能直接按 32 字节截取
+	ph, err := decodeHexField(*v.PreviousHash, 32, "previous_hash")
+	if err != nil {
+		return err
+	}
+	copy(b.previousHash[:], ph)
+
+	h, err := decodeHexField(*v.Hash, 32, "区块哈希")
+	if err != nil {
+		return err
+	}
+	copy(b.hash[:], h)
 
-	h, _ := hex.DecodeString(*v.Hash)
-	copy(b.hash[:], h[:32])
+	// 旧数据没有 merkle_root，根据交易计算
+	if merkleRoot == "" {
+		b.merkleRoot = MerkleRoot(b.transactions)
+	} else {
+		mr, err := hex.DecodeString(merkleRoot)
+		if err != nil || len(mr) != 32 {
+			return fmt.Errorf("非法的 merkle_root %q", merkleRoot)
+		}
+		copy(b.merkleRoot[:], mr)
+	}
+	b.seal = nil
+	if seal != "" {
+		sb, err := hex.DecodeString(seal)
+		if err != nil {
+			return fmt.Errorf("非法的 seal %q", seal)
+		}
+		b.seal = sb
+	}
 	return nil
 }
 
 func (bc *Blockchain) LastBlock() *Block {
-	return bc.chain[len(bc.chain)-1]
+	b, err := bc.store.Head()
+	if err != nil {
+		log.Fatal("读取最新区块失败 ", err)
+	}
+	return b
 }
 
 func (bc *Blockchain) AddTransaction(
 	sender string,
 	recipient string,
 	value *big.Int,
+	fee *big.Int,
+	nonce uint64,
 	senderPublicKey *ecdsa.PublicKey,
 	s *utils.Signature) bool {
-	t := NewTransaction(sender, recipient, value)
+	t := NewSignedTransaction(sender, recipient, value, fee, nonce, senderPublicKey, s)
 
-	//如果是挖矿得到的奖励交易，不验证
+	//奖励交易由矿工打包时自己添加，不经过交易池
 	if sender == MINING_ACCOUNT_ADDRESS {
-		bc.transactionPool = append(bc.transactionPool, t)
-		return true
+		color.Red("ERROR: 不能以挖矿账户的名义发起交易")
+		return false
 	}
 
-	// 判断有没有足够的余额
-	log.Printf("transaction.go sender:%s  account=%d", sender, bc.CalculateTotalAmount(sender))
-	if bc.CalculateTotalAmount(sender).Cmp(value) < 0 {
-		color.Red("ERROR: %s ，你的钱包里没有足够的钱", sender)
+	if err := verifyTransaction(t); err != nil {
+		color.Red("ERROR: 验证交易 %v", err)
 		return false
 	}
 
-	if bc.VerifyTransactionSignature(senderPublicKey, s, t) {
+	// 检查交易序号、余额和加入交易池在同一个 bc.mux 临界区内完成，
+	// 同时提交的同一笔交易只有一笔能通过检查，出块更新状态和交易池时也不会穿插进来
+	bc.mux.Lock()
+	defer bc.mux.Unlock()
 
-		bc.transactionPool = append(bc.transactionPool, t)
-		return true
-	} else {
-		log.Println("ERROR: 验证交易")
+	// 交易序号必须紧接在该地址已上链和交易池中的交易之后，已提交过的签名交易再次提交时序号已被使用
+	if expected := bc.PendingNonce(sender); nonce != expected {
+		color.Red("ERROR: %s 的交易序号 %d 不是期望的 %d", sender, nonce, expected)
+		return false
+	}
+
+	// 判断有没有足够的余额支付金额和交易费，交易池中该地址尚未上链的转出也要扣除
+	available := new(big.Int).Sub(bc.state.Spendable(sender), bc.pendingSpend(sender))
+	log.Printf("transaction.go sender:%s  account=%d", sender, available)
+	if available.Cmp(t.cost()) < 0 {
+		color.Red("ERROR: %s ，你的钱包里没有足够的钱", sender)
+		return false
 	}
-	return false
 
+	bc.addToPool(t)
+	return true
 }
 
-func (bc *Blockchain) CreateTransaction(sender string, recipient string, value *big.Int,
+func (bc *Blockchain) CreateTransaction(sender string, recipient string, value *big.Int, fee *big.Int, nonce uint64,
 	senderPublicKey *ecdsa.PublicKey, s *utils.Signature) bool {
-	isTransacted := bc.AddTransaction(sender, recipient, value, senderPublicKey, s)
+	isTransacted := bc.AddTransaction(sender, recipient, value, fee, nonce, senderPublicKey, s)
 
 	if isTransacted {
 		for _, n := range bc.neighbors {
-			publicKeyStr := fmt.Sprintf("%064x%064x", senderPublicKey.X.Bytes(),
-				senderPublicKey.Y.Bytes())
+			publicKeyStr := fmt.Sprintf("%064x%064x", senderPublicKey.X, senderPublicKey.Y)
 			signatureStr := s.String()
+			chainID := CHAIN_ID
 			bt := &TransactionRequest{
-				&sender, &recipient, &publicKeyStr, value, &signatureStr}
+				&sender, &recipient, &publicKeyStr, value, fee, &chainID, &nonce, &signatureStr}
 			m, _ := json.Marshal(bt)
 			buf := bytes.NewBuffer(m)
 			endpoint := fmt.Sprintf("http://%s/transactions", n)
 			client := &http.Client{}
-			req, _ := http.NewRequest("PUT", endpoint, buf)
+			req, _ := newPeerRequest("PUT", endpoint, buf)
 			resp, _ := client.Do(req)
 			log.Printf("   **  **  **  CreateTransaction : %v", resp)
 		}
@@ -405,133 +552,243 @@ func (bc *Blockchain) CreateTransaction(sender string, recipient string, value *
 	return isTransacted
 }
 
+func (bc *Blockchain) addToPool(t *Transaction) {
+	bc.muxPool.Lock()
+	defer bc.muxPool.Unlock()
+	bc.transactionPool = append(bc.transactionPool, t)
+}
+
+// 从交易池中移除已上链的交易，以及序号已被链上交易使用的交易，其余交易保持原有顺序。
+// 需要在账户状态更新之后调用
+func (bc *Blockchain) removeFromPool(txs []*Transaction) {
+	included := make(map[[32]byte]bool, len(txs))
+	for _, t := range txs {
+		included[t.hash] = true
+	}
+	bc.muxPool.Lock()
+	defer bc.muxPool.Unlock()
+	pool := make([]*Transaction, 0, len(bc.transactionPool))
+	for _, t := range bc.transactionPool {
+		if included[t.hash] || (!t.IsCoinbase() && t.nonce < bc.state.Nonce(t.senderAddress)) {
+			continue
+		}
+		pool = append(pool, t)
+	}
+	bc.transactionPool = pool
+}
+
 func (bc *Blockchain) CopyTransactionPool() []*Transaction {
+	bc.muxPool.Lock()
+	defer bc.muxPool.Unlock()
 	transactions := make([]*Transaction, 0)
 	for _, t := range bc.transactionPool {
-		transactions = append(transactions,
-			NewTransaction(t.senderAddress,
-				t.receiveAddress,
-				t.value))
+		c := *t
+		transactions = append(transactions, &c)
 	}
 	return transactions
 }
 
+// 地址下一笔交易应使用的序号：从已上链的交易数开始，跳过交易池中该地址连续的交易序号
+func (bc *Blockchain) PendingNonce(address string) uint64 {
+	nonce := bc.state.Nonce(address)
+	bc.muxPool.Lock()
+	defer bc.muxPool.Unlock()
+	pending := make(map[uint64]bool)
+	for _, t := range bc.transactionPool {
+		if t.senderAddress == address && !t.IsCoinbase() {
+			pending[t.nonce] = true
+		}
+	}
+	for pending[nonce] {
+		nonce++
+	}
+	return nonce
+}
+
+// 地址的交易序号：Nonce 为已上链的交易数，PendingNonce 为钱包签名下一笔交易时应使用的序号
+type AccountNonce struct {
+	Address      string `json:"address"`
+	Nonce        uint64 `json:"nonce"`
+	PendingNonce uint64 `json:"pending_nonce"`
+}
+
+func (bc *Blockchain) AccountNonce(address string) *AccountNonce {
+	return &AccountNonce{
+		Address:      address,
+		Nonce:        bc.state.Nonce(address),
+		PendingNonce: bc.PendingNonce(address),
+	}
+}
+
+// 交易池中某个地址尚未上链的转出金额和交易费合计
+func (bc *Blockchain) pendingSpend(address string) *big.Int {
+	bc.muxPool.Lock()
+	defer bc.muxPool.Unlock()
+	total := new(big.Int)
+	for _, t := range bc.transactionPool {
+		if t.senderAddress == address {
+			total.Add(total, t.cost())
+		}
+	}
+	return total
+}
+
 func bytesToBigInt(b [32]byte) *big.Int {
 	bytes := b[:]
 	result := new(big.Int).SetBytes(bytes)
 	return result
 }
 
-func (bc *Blockchain) ValidProof(nonce *big.Int,
-	previousHash [32]byte,
-	transactions []*Transaction,
-	difficulty *big.Int,
-) bool {
-	bigi_2 := big.NewInt(2)
-	bigi_256 := big.NewInt(256)
-	bigi_diff := difficulty
-	target := new(big.Int).Exp(bigi_2, bigi_256, nil)
-	target = new(big.Int).Div(target, bigi_diff)
-	tmpBlock := Block{nonce: nonce, previousHash: previousHash, transactions: transactions, timestamp: 0}
-	result := bytesToBigInt(tmpBlock.Hash())
-	return target.Cmp(result) > 0
+// 区块哈希小于 2^256/difficulty 时工作量证明有效
+func (bc *Blockchain) ValidProof(b *Block, difficulty *big.Int) bool {
+	return validProof(b, difficulty)
 }
 
-func (bc *Blockchain) getBlockSendTime(bum int) int {
-	if bum == 0 {
-		return 0
+func validProof(b *Block, difficulty *big.Int) bool {
+	target := proofTarget(difficulty)
+	if target == nil {
+		return false
 	}
-	return int(bc.chain[bum].timestamp - bc.chain[bum-1].timestamp)
+	result := bytesToBigInt(b.Hash())
+	return target.Cmp(result) > 0
 }
 
-func (bc *Blockchain) ProofOfWork() *big.Int {
-	transactions := bc.CopyTransactionPool() //选择交易？控制交易数量？
-	previousHash := bc.LastBlock().Hash()
-	nonce := big.NewInt(0)
-	begin := time.Now()
-	if bc.getBlockSendTime(len(bc.chain)-1) < 3e+9 {
-		MINING_DIFFICULT += 32
-
-	} else {
-		if MINING_DIFFICULT >= 13000 {
-			MINING_DIFFICULT -= 32
-		}
+func proofTarget(difficulty *big.Int) *big.Int {
+	if difficulty == nil || difficulty.Sign() <= 0 {
+		return nil
 	}
-	for !bc.ValidProof(nonce, previousHash, transactions, big.NewInt(int64(MINING_DIFFICULT))) {
-		one := big.NewInt(1)
-		nonce.Add(nonce, one)
-	}
-	end := time.Now()
-
-	log.Printf("POW spend Time:%f Second", end.Sub(begin).Seconds())
-	log.Printf("POW spend Time:%s", end.Sub(begin))
-
-	return nonce
+	bigi_2 := big.NewInt(2)
+	bigi_256 := big.NewInt(256)
+	bigi_diff := difficulty
+	target := new(big.Int).Exp(bigi_2, bigi_256, nil)
+	return target.Div(target, bigi_diff)
 }
 
-// 将交易池的交易打包
+// 将交易池的交易打包。
+// 区块由共识引擎封装（工作量证明或出块签名），没有轮到本节点出块时返回 false。
+// 只在选取交易和写入区块时持有 bc.mux，封装区块期间可以继续提交交易；
+// 挖矿期间链尾发生变化（收到邻居的区块）时放弃本轮，返回 false。
+// 同一时间只进行一轮挖矿，上一轮还没结束时直接返回 false
 func (bc *Blockchain) Mining() bool {
+	if !bc.muxMining.TryLock() {
+		return false
+	}
+	defer bc.muxMining.Unlock()
 	bc.mux.Lock()
 
-	defer bc.mux.Unlock()
+	txs := bc.selectTransactions()
+	lastBlock := bc.LastBlock()
+	number := new(big.Int).Add(lastBlock.number, big.NewInt(1))
+	// 矿工领取挖矿奖励和打包交易的交易费，发行量达到上限且没有交易费时不添加奖励交易。
+	// 交易池为空时只要还有挖矿奖励就出只含奖励交易的区块，否则新链上的奖励永远等不到成熟
+	reward := minerReward(number.Uint64(), txs)
+	if len(txs) == 0 && reward.Sign() == 0 {
+		bc.mux.Unlock()
+		return false
+	}
+	if reward.Sign() > 0 {
+		txs = append(txs, NewCoinbaseTransaction(number.Uint64(), bc.blockchainAddress, reward))
+	}
+	b := NewBlock(number, big.NewInt(0), lastBlock.hash, txs)
+	// NewBlock 使用创世纪块的难度，由共识引擎换成应使用的难度，哈希在封装时重新计算
+	if err := bc.prepare(b); err != nil {
+		color.Red("准备区块失败 %v", err)
+		bc.mux.Unlock()
+		return false
+	}
+	abort := bc.tip.changed()
+	bc.mux.Unlock()
 
-	// 此处判断交易池是否有交易，你可以不判断，打包无交易区块
-	if len(bc.transactionPool) == 0 {
-		// color.Magenta("打包失败")
+	if err := bc.engine.Seal(b, abort); err != nil {
+		if !errors.Is(err, ErrNotInTurn) {
+			color.Yellow("封装区块 %v 失败 %v", number, err)
+		}
 		return false
 	}
 
-	mining_reward, _ := big.NewFloat(MINING_REWARD).Int(nil)
-	bc.AddTransaction(MINING_ACCOUNT_ADDRESS, bc.blockchainAddress, mining_reward, nil, nil)
-	nonce := bc.ProofOfWork()
-	previousHash := bc.LastBlock().hash
-	number := len(bc.chain)
-	bc.CreateBlock(big.NewInt(int64(number)), nonce, previousHash)
+	bc.mux.Lock()
+	if bc.LastBlock().hash != lastBlock.hash {
+		bc.mux.Unlock()
+		color.Yellow("链尾已变化，丢弃区块 %v", number)
+		return false
+	}
+	bc.appendBlock(b)
 	log.Println("action=mining, status=success")
+	// 通知邻居前释放锁，邻居处理共识时会反过来请求本节点，两个节点同时出块时不会互相等待
+	bc.mux.Unlock()
+
+	bc.announceBlock()
+	color.Magenta("打包成功")
+	return true
+}
 
+// 出块后通知邻居进行共识，调用时不能持有 bc.mux
+func (bc *Blockchain) announceBlock() {
 	for _, n := range bc.neighbors {
 		endpoint := fmt.Sprintf("http://%s/consensus", n)
 		client := &http.Client{}
-		req, _ := http.NewRequest("PUT", endpoint, nil)
+		req, _ := newPeerRequest("PUT", endpoint, nil)
 		resp, _ := client.Do(req)
 		log.Printf("%v", resp)
 	}
-
-	color.Magenta("打包成功")
-	return true
 }
 
+// 余额直接从账户状态表读取，不再遍历交易
 func (bc *Blockchain) CalculateTotalAmount(accountAddress string) *big.Int {
-	var totalAmount *big.Int = big.NewInt(0)
-	for _, _chain := range bc.chain {
-		for _, _tx := range _chain.transactions {
-			if accountAddress == _tx.receiveAddress {
-				totalAmount.Add(totalAmount, _tx.value)
-			}
-			if accountAddress == _tx.senderAddress {
-				totalAmount.Sub(totalAmount, _tx.value)
-			}
-		}
+	return bc.state.Balance(accountAddress)
+}
+
+// 查询地址在指定区块高度时的余额
+func (bc *Blockchain) CalculateTotalAmountAt(accountAddress string, height int64) (*big.Int, error) {
+	st, err := bc.StateAt(height)
+	if err != nil {
+		return nil, err
 	}
-	return totalAmount
+	return st.Balance(accountAddress), nil
+}
+
+// 查询地址尚未成熟、暂时不能花费的挖矿奖励
+func (bc *Blockchain) CalculateImmatureAmount(accountAddress string) *big.Int {
+	return bc.state.Immature(accountAddress)
+}
+
+// 查询地址在指定区块高度时尚未成熟的挖矿奖励
+func (bc *Blockchain) CalculateImmatureAmountAt(accountAddress string, height int64) (*big.Int, error) {
+	st, err := bc.StateAt(height)
+	if err != nil {
+		return nil, err
+	}
+	return st.Immature(accountAddress), nil
+}
+
+// 返回指定区块高度的账户状态快照
+func (bc *Blockchain) StateAt(height int64) (*AccountState, error) {
+	return bc.state.StateAt(height)
 }
 
 func (bc *Blockchain) StartMining() {
 	bc.Mining()
 	// 使用time.AfterFunc函数创建了一个定时器，它在指定的时间间隔后执行bc.StartMining函数（自己调用自己）。
-	_ = time.AfterFunc(time.Second*MINING_TIMER_SEC, bc.StartMining)
+	_ = time.AfterFunc(time.Duration(MINING_TIMER_SEC)*time.Second, bc.StartMining)
 	color.Yellow("minetime: %v\n", time.Now())
 }
 
+// 余额查询结果，Amount 为总余额，其中 Spendable 可以花费，Immature 是尚未成熟的挖矿奖励
 type AmountResponse struct {
-	Amount *big.Int `json:"amount"`
+	Amount    *big.Int `json:"amount"`
+	Spendable *big.Int `json:"spendable"`
+	Immature  *big.Int `json:"immature"`
 }
 
 func (ar *AmountResponse) MarshalJSON() ([]byte, error) {
 	return json.Marshal(struct {
-		Amount *big.Int `json:"amount"`
+		Amount    *big.Int `json:"amount"`
+		Spendable *big.Int `json:"spendable"`
+		Immature  *big.Int `json:"immature"`
 	}{
-		Amount: ar.Amount,
+		Amount:    ar.Amount,
+		Spendable: ar.Spendable,
+		Immature:  ar.Immature,
 	})
 }
 
@@ -539,21 +796,71 @@ type Transaction struct {
 	senderAddress  string
 	receiveAddress string
 	value          *big.Int
-	hash           [32]byte
+	// 交易费，由发送方支付给打包交易的矿工，与金额一起签名
+	fee *big.Int
+	// 交易所属链的链 ID，参与签名，见 CHAIN_ID
+	chainID uint64
+	// 发送方的交易序号，从 0 开始，每上链一笔加 1，参与签名，同一笔签名交易不能被重复提交。
+	// 挖矿奖励交易为所在的区块号，不同区块中金额和接收方相同的奖励交易哈希也不同
+	nonce uint64
+	hash  [32]byte
+	// 发送方公钥和对交易哈希的签名，挖矿奖励交易没有
+	senderPublicKey *ecdsa.PublicKey
+	signature       *utils.Signature
 }
 
 func NewTransaction(sender string, receive string, value *big.Int) *Transaction {
+	return NewTransactionWithFee(sender, receive, value, big.NewInt(0))
+}
+
+// 创建本链上带交易费的交易，fee 为 nil 时按 0 处理
+func NewTransactionWithFee(sender string, receive string, value *big.Int, fee *big.Int) *Transaction {
+	return NewChainTransaction(CHAIN_ID, 0, sender, receive, value, fee)
+}
+
+// 创建链 ID 为 chainID、发送方交易序号为 nonce 的交易，钱包为其他节点所在的链签名时使用
+func NewChainTransaction(chainID uint64, nonce uint64, sender string, receive string, value *big.Int, fee *big.Int) *Transaction {
+	if fee == nil {
+		fee = big.NewInt(0)
+	}
 	t := new(Transaction)
 	t.senderAddress = sender
 	t.receiveAddress = receive
 	t.value = value
+	t.fee = fee
+	t.chainID = chainID
+	t.nonce = nonce
 	t.hash = t.Hash()
 	return t
 }
 
+// 交易哈希是交易规范编码的 SHA-256，见 Encode，钱包对同一个哈希签名
 func (t *Transaction) Hash() [32]byte {
-	m, _ := json.Marshal(t)
-	return sha256.Sum256([]byte(m))
+	return sha256.Sum256(t.Encode())
+}
+
+func (t *Transaction) Fee() *big.Int {
+	return t.fee
+}
+
+func (t *Transaction) ChainID() uint64 {
+	return t.chainID
+}
+
+func (t *Transaction) Nonce() uint64 {
+	return t.nonce
+}
+
+// 发送方为这笔交易支付的总额：金额加交易费
+func (t *Transaction) cost() *big.Int {
+	total := new(big.Int)
+	if t.value != nil {
+		total.Add(total, t.value)
+	}
+	if t.fee != nil {
+		total.Add(total, t.fee)
+	}
+	return total
 }
 
 func (bc *Blockchain) VerifyTransactionSignature(
@@ -563,132 +870,152 @@ func (bc *Blockchain) VerifyTransactionSignature(
 }
 
 func (bc *Blockchain) GetTransactionByHash(hash [32]byte) *Transaction {
-	for _, block := range bc.chain {
-		for _, transaction := range block.transactions {
-			if transaction.hash == hash {
-				return transaction
-			}
-		}
+	loc, err := bc.store.GetTxLocation(hash)
+	if err != nil {
+		return nil
 	}
-	return nil
+	return bc.getTransaction(loc)
+}
+
+// 根据交易位置读取交易
+func (bc *Blockchain) getTransaction(loc TxLocation) *Transaction {
+	block, err := bc.store.GetByNumber(loc.Number)
+	if err != nil || loc.Index >= len(block.transactions) {
+		return nil
+	}
+	return block.transactions[loc.Index]
 }
 
 func (bc *Blockchain) GetTransactions() []*Transaction {
 	var transactions []*Transaction
-	for _, block := range bc.chain {
+	bc.store.Iterate(func(block *Block) bool {
 		transactions = append(transactions, block.transactions...)
-	}
+		return true
+	})
 	return transactions
 }
 
+// 交易涉及的地址，发送方和接收方相同时只返回一个
+func (t *Transaction) addresses() []string {
+	addrs := make([]string, 0, 2)
+	if t.senderAddress != "" {
+		addrs = append(addrs, t.senderAddress)
+	}
+	if t.receiveAddress != "" && t.receiveAddress != t.senderAddress {
+		addrs = append(addrs, t.receiveAddress)
+	}
+	return addrs
+}
+
+// 交易对地址余额的影响：作为接收方增加金额，作为发送方减少金额和交易费
+func (t *Transaction) balanceDelta(address string) *big.Int {
+	delta := new(big.Int)
+	if t.value == nil {
+		return delta
+	}
+	if t.receiveAddress == address {
+		delta.Add(delta, t.value)
+	}
+	if t.senderAddress == address {
+		delta.Sub(delta, t.cost())
+	}
+	return delta
+}
+
 func (t *Transaction) Print() {
 	color.Red("%s\n", strings.Repeat("~", 30))
 	color.Cyan("发送地址             %s\n", t.senderAddress)
 	color.Cyan("接受地址             %s\n", t.receiveAddress)
 	color.Cyan("金额                 %d\n", t.value)
+	color.Cyan("交易费               %d\n", t.fee)
+	color.Cyan("交易序号             %d\n", t.nonce)
 
 }
 
 func (t *Transaction) MarshalJSON() ([]byte, error) {
+	var publicKey, signature string
+	if t.senderPublicKey != nil {
+		publicKey = fmt.Sprintf("%x", publicKeyBytes(t.senderPublicKey))
+	}
+	if t.signature != nil {
+		signature = fmt.Sprintf("%x", signatureBytes(t.signature))
+	}
 	return json.Marshal(struct {
 		Sender    string   `json:"sender_blockchain_address"`
 		Recipient string   `json:"recipient_blockchain_address"`
 		Value     *big.Int `json:"value"`
+		Fee       *big.Int `json:"fee"`
+		ChainID   uint64   `json:"chain_id"`
+		Nonce     uint64   `json:"nonce"`
 		Hash      string   `json:"hash"`
+		PublicKey string   `json:"sender_public_key,omitempty"`
+		Signature string   `json:"signature,omitempty"`
 	}{
 		Sender:    t.senderAddress,
 		Recipient: t.receiveAddress,
 		Value:     t.value,
+		Fee:       t.fee,
+		ChainID:   t.chainID,
+		Nonce:     t.nonce,
 		Hash:      fmt.Sprintf("%x", t.hash),
+		PublicKey: publicKey,
+		Signature: signature,
 	})
 }
 
 func (t *Transaction) UnmarshalJSON(data []byte) error {
 	var hash string
 	var value int64
+	var fee int64
+	chainID := CHAIN_ID
+	var publicKey, signature string
 	v := &struct {
 		Sender    *string `json:"sender_blockchain_address"`
 		Recipient *string `json:"recipient_blockchain_address"`
 		Value     *int64  `json:"value"`
+		Fee       *int64  `json:"fee"`
+		ChainID   *uint64 `json:"chain_id"`
+		Nonce     *uint64 `json:"nonce"`
 		Hash      *string `json:"hash"`
+		PublicKey *string `json:"sender_public_key"`
+		Signature *string `json:"signature"`
 	}{
 		Sender:    &t.senderAddress,
 		Recipient: &t.receiveAddress,
 		Value:     &value,
+		Fee:       &fee,
+		ChainID:   &chainID,
+		Nonce:     &t.nonce,
 		Hash:      &hash,
+		PublicKey: &publicKey,
+		Signature: &signature,
 	}
 	if err := json.Unmarshal(data, &v); err != nil {
 		return err
 	}
-	h, _ := hex.DecodeString(*v.Hash)
-	copy(t.hash[:], h[:32])
+	h, err := decodeHexField(hash, 32, "交易哈希")
+	if err != nil {
+		return err
+	}
+	copy(t.hash[:], h)
 
 	t.value = big.NewInt(value)
-	return nil
-}
-
-func (bc *Blockchain) ValidChain(chain []*Block) bool {
-	preBlock := chain[0]
-	currentIndex := 1
-	for currentIndex < len(chain) {
-		b := chain[currentIndex]
-		if b.previousHash != preBlock.Hash() {
-			return false
-		}
+	// 旧数据没有 fee、nonce，按 0 处理；没有 chain_id，按本链处理
+	t.fee = big.NewInt(fee)
+	t.chainID = chainID
 
-		if !bc.ValidProof(b.Nonce(), b.PreviousHash(), b.Transactions(), big.NewInt(int64(MINING_DIFFICULT))) {
-			return false
-		}
-
-		preBlock = b
-		currentIndex += 1
+	p, err := decodeHexField(publicKey, publicKeySize, "公钥")
+	if err != nil {
+		return err
 	}
-	return true
-}
-
-func (bc *Blockchain) ResolveConflicts() bool {
-	var longestChain []*Block = nil
-	maxLength := len(bc.chain)
-
-	for _, n := range bc.neighbors {
-		endpoint := fmt.Sprintf("http://%s/chain", n)
-		resp, err := http.Get(endpoint)
-		if err != nil {
-			color.Red("                 错误 ：ResolveConflicts GET请求")
-			return false
-		} else {
-			color.Green("                正确 ：ResolveConflicts  GET请求")
-		}
-		if resp.StatusCode == 200 {
-			var bcResp Blockchain
-			decoder := json.NewDecoder(resp.Body)
-			err1 := decoder.Decode(&bcResp)
-
-			if err1 != nil {
-				color.Red("                 错误 ：ResolveConflicts Decode")
-				return false
-			} else {
-				color.Green("                正确 ：ResolveConflicts  Decode")
-			}
-
-			chain := bcResp.Chain()
-			color.Cyan("   ResolveConflicts   chain len:%d ", len(chain))
-			if len(chain) > maxLength && bc.ValidChain(chain) {
-				maxLength = len(chain)
-				longestChain = chain
-			}
-		}
+	if t.senderPublicKey, err = parsePublicKey(p); err != nil {
+		return err
 	}
-
-	color.Cyan("   ResolveConflicts   longestChain len:%d ", len(longestChain))
-
-	if longestChain != nil {
-		bc.chain = longestChain
-		log.Printf("Resovle confilicts replaced")
-		return true
+	if p, err = decodeHexField(signature, signatureSize, "签名"); err != nil {
+		return err
 	}
-	log.Printf("Resovle conflicts not replaced")
-	return false
+	t.signature, err = parseSignature(p)
+	return err
 }
 
 type TransactionRequest struct {
@@ -696,6 +1023,9 @@ type TransactionRequest struct {
 	RecipientBlockchainAddress *string  `json:"recipient_blockchain_address"`
 	SenderPublicKey            *string  `json:"sender_public_key"`
 	Value                      *big.Int `json:"value"`
+	Fee                        *big.Int `json:"fee"`
+	ChainID                    *uint64  `json:"chain_id"`
+	Nonce                      *uint64  `json:"nonce"`
 	Signature                  *string  `json:"signature"`
 }
 
@@ -704,8 +1034,14 @@ func (tr *TransactionRequest) Validate() bool {
 		tr.RecipientBlockchainAddress == nil ||
 		tr.SenderPublicKey == nil ||
 		tr.Value == nil ||
+		tr.Nonce == nil ||
 		tr.Signature == nil {
 		return false
 	}
 	return true
 }
+
+// 请求中的链 ID 与本节点一致，没有填写时视为一致（签名校验仍会使用本链的链 ID）
+func (tr *TransactionRequest) MatchesChain() bool {
+	return tr.ChainID == nil || *tr.ChainID == CHAIN_ID
+}
@@ -0,0 +1,285 @@
+package block
+
+import (
+	"bufio"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"hash/crc32"
+	"io"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+)
+
+// 区块日志的刷盘策略
+type SyncPolicy int
+
+const (
+	// 每写一条记录都 fsync，进程或机器崩溃都不会丢已写入的区块
+	SYNC_ALWAYS SyncPolicy = iota
+	// 距上次 fsync 超过 LOG_SYNC_INTERVAL 才 fsync，机器崩溃时可能丢最后一段区块
+	SYNC_INTERVAL
+	// 从不主动 fsync，交给操作系统
+	SYNC_NEVER
+)
+
+const LOG_SYNC_INTERVAL = time.Second
+
+const (
+	// 文件头：魔数 + 格式版本
+	blockLogMagic      = "JHBLOCK"
+	blockLogVersion    = 1
+	blockLogHeaderSize = len(blockLogMagic) + 1
+	// 记录头：4 字节负载长度 + 4 字节 CRC32 校验和
+	recordHeaderSize = 8
+	// 单条记录的最大长度，超过视为损坏
+	maxRecordSize = 64 << 20
+)
+
+var crcTable = crc32.MakeTable(crc32.Castagnoli)
+
+var ErrLogCorrupted = errors.New("block log corrupted")
+
+func ParseSyncPolicy(s string) (SyncPolicy, error) {
+	switch s {
+	case "always":
+		return SYNC_ALWAYS, nil
+	case "interval":
+		return SYNC_INTERVAL, nil
+	case "never":
+		return SYNC_NEVER, nil
+	default:
+		return SYNC_ALWAYS, fmt.Errorf("unknown fsync policy %q", s)
+	}
+}
+
+func (p SyncPolicy) String() string {
+	switch p {
+	case SYNC_ALWAYS:
+		return "always"
+	case SYNC_INTERVAL:
+		return "interval"
+	case SYNC_NEVER:
+		return "never"
+	default:
+		return fmt.Sprintf("SyncPolicy(%d)", int(p))
+	}
+}
+
+// 打开日志时的恢复结果
+type LogRecovery struct {
+	// 读出的完整记录数
+	Records int
+	// 截断掉的尾部字节数，为 0 表示文件完好
+	TruncatedBytes int64
+	// 截断原因
+	Reason string
+}
+
+func (r LogRecovery) String() string {
+	if r.TruncatedBytes == 0 {
+		return fmt.Sprintf("读取 %d 条记录，日志完好", r.Records)
+	}
+	return fmt.Sprintf("读取 %d 条记录，截断尾部 %d 字节（%s）", r.Records, r.TruncatedBytes, r.Reason)
+}
+
+// 只追加的区块日志，每条记录带长度和校验和
+// 文件格式：文件头 | 记录 | 记录 | ...
+// 记录格式：长度(uint32 大端) | CRC32-C(uint32 大端) | 负载
+type BlockLog struct {
+	mux      sync.Mutex
+	file     *os.File
+	path     string
+	policy   SyncPolicy
+	size     int64
+	lastSync time.Time
+}
+
+// 打开（或创建）区块日志，按顺序把每条记录的负载交给 fn。
+// 尾部写了一半的记录（进程在写入时退出）会被截断；
+// 中间的记录校验失败说明文件损坏，返回 ErrLogCorrupted 而不是丢弃后面的数据
+func OpenBlockLog(path string, policy SyncPolicy, fn func(payload []byte) error) (*BlockLog, LogRecovery, error) {
+	var recovery LogRecovery
+	file, err := os.OpenFile(path, os.O_RDWR|os.O_CREATE, 0644)
+	if err != nil {
+		return nil, recovery, err
+	}
+	l := &BlockLog{file: file, path: path, policy: policy, lastSync: time.Now()}
+
+	recovery, err = l.recover(fn)
+	if err != nil {
+		file.Close()
+		return nil, recovery, err
+	}
+	return l, recovery, nil
+}
+
+func (l *BlockLog) recover(fn func(payload []byte) error) (LogRecovery, error) {
+	var recovery LogRecovery
+	info, err := l.file.Stat()
+	if err != nil {
+		return recovery, err
+	}
+	fileSize := info.Size()
+
+	// 新文件或者文件头都没写完整，重新写文件头
+	if fileSize < int64(blockLogHeaderSize) {
+		if fileSize > 0 {
+			recovery.TruncatedBytes = fileSize
+			recovery.Reason = "文件头不完整"
+		}
+		return recovery, l.writeHeader()
+	}
+
+	r := bufio.NewReader(io.NewSectionReader(l.file, 0, fileSize))
+	header := make([]byte, blockLogHeaderSize)
+	if _, err := io.ReadFull(r, header); err != nil {
+		return recovery, err
+	}
+	if string(header[:len(blockLogMagic)]) != blockLogMagic {
+		return recovery, fmt.Errorf("%w: %s 不是区块日志文件", ErrLogCorrupted, l.path)
+	}
+	if header[len(blockLogMagic)] != blockLogVersion {
+		return recovery, fmt.Errorf("不支持的区块日志版本 %d", header[len(blockLogMagic)])
+	}
+
+	offset := int64(blockLogHeaderSize)
+	recHeader := make([]byte, recordHeaderSize)
+	for offset < fileSize {
+		if fileSize-offset < recordHeaderSize {
+			recovery.Reason = "记录头不完整"
+			break
+		}
+		if _, err := io.ReadFull(r, recHeader); err != nil {
+			return recovery, err
+		}
+		length := int64(binary.BigEndian.Uint32(recHeader))
+		checksum := binary.BigEndian.Uint32(recHeader[4:])
+		end := offset + recordHeaderSize + length
+		if length > maxRecordSize || end > fileSize {
+			recovery.Reason = "记录不完整"
+			break
+		}
+		payload := make([]byte, length)
+		if _, err := io.ReadFull(r, payload); err != nil {
+			return recovery, err
+		}
+		if crc32.Checksum(payload, crcTable) != checksum {
+			if end < fileSize {
+				return recovery, fmt.Errorf("%w: 偏移 %d 处第 %d 条记录校验失败", ErrLogCorrupted, offset, recovery.Records)
+			}
+			recovery.Reason = "最后一条记录校验失败"
+			break
+		}
+		if err := fn(payload); err != nil {
+			return recovery, fmt.Errorf("第 %d 条记录：%w", recovery.Records, err)
+		}
+		recovery.Records++
+		offset = end
+	}
+
+	if offset < fileSize {
+		recovery.TruncatedBytes = fileSize - offset
+		if err := l.file.Truncate(offset); err != nil {
+			return recovery, err
+		}
+		if err := l.file.Sync(); err != nil {
+			return recovery, err
+		}
+	}
+	l.size = offset
+	return recovery, nil
+}
+
+func (l *BlockLog) writeHeader() error {
+	if err := l.file.Truncate(0); err != nil {
+		return err
+	}
+	header := append([]byte(blockLogMagic), blockLogVersion)
+	if _, err := l.file.WriteAt(header, 0); err != nil {
+		return err
+	}
+	l.size = int64(len(header))
+	return l.file.Sync()
+}
+
+// 追加一条记录，写入失败时把文件截回写入前的长度
+func (l *BlockLog) Append(payload []byte) error {
+	if len(payload) > maxRecordSize {
+		return fmt.Errorf("记录长度 %d 超过上限 %d", len(payload), maxRecordSize)
+	}
+	l.mux.Lock()
+	defer l.mux.Unlock()
+
+	rec := make([]byte, recordHeaderSize+len(payload))
+	binary.BigEndian.PutUint32(rec, uint32(len(payload)))
+	binary.BigEndian.PutUint32(rec[4:], crc32.Checksum(payload, crcTable))
+	copy(rec[recordHeaderSize:], payload)
+
+	if _, err := l.file.WriteAt(rec, l.size); err != nil {
+		l.file.Truncate(l.size)
+		return err
+	}
+	l.size += int64(len(rec))
+	return l.maybeSync()
+}
+
+func (l *BlockLog) maybeSync() error {
+	switch l.policy {
+	case SYNC_ALWAYS:
+	case SYNC_INTERVAL:
+		if time.Since(l.lastSync) < LOG_SYNC_INTERVAL {
+			return nil
+		}
+	default:
+		return nil
+	}
+	l.lastSync = time.Now()
+	return l.file.Sync()
+}
+
+func (l *BlockLog) Close() error {
+	l.mux.Lock()
+	defer l.mux.Unlock()
+	if err := l.file.Sync(); err != nil {
+		l.file.Close()
+		return err
+	}
+	return l.file.Close()
+}
+
+// 把负载写成一个新的日志文件并原子地替换 path，
+// 替换过程中崩溃只会留下旧文件或新文件之一
+func writeBlockLog(path string, payloads [][]byte) error {
+	tmp := path + ".tmp"
+	os.Remove(tmp)
+	l, _, err := OpenBlockLog(tmp, SYNC_NEVER, func([]byte) error { return nil })
+	if err != nil {
+		return err
+	}
+	for _, p := range payloads {
+		if err := l.Append(p); err != nil {
+			l.Close()
+			return err
+		}
+	}
+	if err := l.Close(); err != nil {
+		return err
+	}
+	if err := os.Rename(tmp, path); err != nil {
+		return err
+	}
+	return syncDir(filepath.Dir(path))
+}
+
+// 重命名后同步目录项，保证新文件名落盘
+func syncDir(dir string) error {
+	d, err := os.Open(dir)
+	if err != nil {
+		return err
+	}
+	defer d.Close()
+	return d.Sync()
+}
@@ -0,0 +1,119 @@
+package block
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+// 写入 n 条记录后关闭，返回文件路径和每条记录的负载
+func writeTestLog(t *testing.T, n int) (string, [][]byte) {
+	t.Helper()
+	path := filepath.Join(t.TempDir(), "blocks.log")
+	l, _, err := OpenBlockLog(path, SYNC_ALWAYS, func([]byte) error { return nil })
+	if err != nil {
+		t.Fatal(err)
+	}
+	payloads := make([][]byte, 0, n)
+	for i := 0; i < n; i++ {
+		p := []byte(fmt.Sprintf("block-%d", i))
+		if err := l.Append(p); err != nil {
+			t.Fatal(err)
+		}
+		payloads = append(payloads, p)
+	}
+	if err := l.Close(); err != nil {
+		t.Fatal(err)
+	}
+	return path, payloads
+}
+
+func openTestLog(t *testing.T, path string) (*BlockLog, [][]byte, LogRecovery, error) {
+	t.Helper()
+	var read [][]byte
+	l, recovery, err := OpenBlockLog(path, SYNC_ALWAYS, func(p []byte) error {
+		read = append(read, append([]byte(nil), p...))
+		return nil
+	})
+	return l, read, recovery, err
+}
+
+func appendBytes(t *testing.T, path string, data []byte) {
+	t.Helper()
+	f, err := os.OpenFile(path, os.O_WRONLY|os.O_APPEND, 0644)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+	if _, err := f.Write(data); err != nil {
+		t.Fatal(err)
+	}
+}
+
+// 进程在写最后一条记录时退出，重新打开后截断不完整的尾部，之前的记录完好，之后可以继续追加
+func TestBlockLogTornTail(t *testing.T) {
+	tails := []struct {
+		name string
+		data []byte
+	}{
+		{"记录头不完整", []byte{0, 0, 0}},
+		{"负载不完整", []byte{0, 0, 0, 100, 1, 2, 3, 4, 'x', 'y'}},
+		{"校验和错误", []byte{0, 0, 0, 2, 1, 2, 3, 4, 'x', 'y'}},
+	}
+	for _, tt := range tails {
+		t.Run(tt.name, func(t *testing.T) {
+			path, payloads := writeTestLog(t, 3)
+			info, err := os.Stat(path)
+			if err != nil {
+				t.Fatal(err)
+			}
+			appendBytes(t, path, tt.data)
+
+			l, read, recovery, err := openTestLog(t, path)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if recovery.Records != len(payloads) || len(read) != len(payloads) {
+				t.Fatalf("读出 %d 条记录，期望 %d 条", recovery.Records, len(payloads))
+			}
+			if recovery.TruncatedBytes != int64(len(tt.data)) {
+				t.Errorf("截断 %d 字节，期望 %d 字节", recovery.TruncatedBytes, len(tt.data))
+			}
+			if after, _ := os.Stat(path); after.Size() != info.Size() {
+				t.Errorf("截断后文件长度 %d，期望 %d", after.Size(), info.Size())
+			}
+
+			if err := l.Append([]byte("block-3")); err != nil {
+				t.Fatal(err)
+			}
+			l.Close()
+			l, read, recovery, err = openTestLog(t, path)
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer l.Close()
+			if recovery.Records != 4 || recovery.TruncatedBytes != 0 || string(read[3]) != "block-3" {
+				t.Errorf("继续追加后重新打开：%v", recovery)
+			}
+		})
+	}
+}
+
+// 中间的记录损坏时不能丢弃后面的数据，返回 ErrLogCorrupted
+func TestBlockLogCorruptedMiddle(t *testing.T) {
+	path, _ := writeTestLog(t, 3)
+	data, err := os.ReadFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// 第一条记录的负载的第一个字节
+	data[blockLogHeaderSize+recordHeaderSize] ^= 0xff
+	if err := os.WriteFile(path, data, 0644); err != nil {
+		t.Fatal(err)
+	}
+	if _, _, _, err := openTestLog(t, path); !errors.Is(err, ErrLogCorrupted) {
+		t.Fatalf("期望 ErrLogCorrupted，得到 %v", err)
+	}
+}
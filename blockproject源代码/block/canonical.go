@@ -0,0 +1,70 @@
+package block
+
+import (
+	"encoding/binary"
+	"math/big"
+)
+
+// 规范编码的版本号，编码格式变化时递增，写在编码的第一个字节。
+// testdata/canonical_vectors.json 是当前版本的标准向量，其他语言实现编码时可以用来核对，
+// 修改编码后需要同步更新，canonical_test.go 会检查代码与向量一致
+const (
+	HEADER_ENCODING_VERSION      = 2
+	TRANSACTION_ENCODING_VERSION = 4
+)
+
+// 区块头规范编码的长度，nonce 固定在最后 8 字节，挖矿时只需改写这 8 个字节
+const (
+	HEADER_ENCODING_SIZE = 1 + 8 + 8 + 32 + 32 + 8 + 8
+	headerNonceOffset    = HEADER_ENCODING_SIZE - 8
+)
+
+// 区块头的规范编码，区块哈希、工作量证明都基于它计算，与 JSON 表示无关。
+// 所有整数都是大端定长：
+//
+//	版本(1) | 区块号(8) | 时间戳(8) | 上一个区块哈希(32) | Merkle 根(32) | 难度(8) | nonce(8)
+//
+// 区块号、难度、nonce 超过 64 位的区块不合法，编码时只取低 64 位
+func (h *BlockHeader) Encode() []byte {
+	buf := make([]byte, 0, HEADER_ENCODING_SIZE)
+	buf = append(buf, HEADER_ENCODING_VERSION)
+	buf = binary.BigEndian.AppendUint64(buf, bigToUint64(h.number))
+	buf = binary.BigEndian.AppendUint64(buf, uint64(h.timestamp))
+	buf = append(buf, h.previousHash[:]...)
+	buf = append(buf, h.merkleRoot[:]...)
+	buf = binary.BigEndian.AppendUint64(buf, bigToUint64(h.difficulty))
+	buf = binary.BigEndian.AppendUint64(buf, bigToUint64(h.nonce))
+	return buf
+}
+
+// 区块的区块头规范编码
+func (b *Block) EncodeHeader() []byte {
+	return b.Header().Encode()
+}
+
+// 交易的规范编码，交易哈希和签名都基于它计算：
+//
+//	版本(1) | 链 ID | 交易序号 | 发送地址 | 接收地址 | 金额 | 交易费
+//
+// 链 ID 和交易序号为 uvarint，地址为 uvarint 长度 + UTF-8 字节，金额和交易费为符号字节 + uvarint 长度 + 大端绝对值
+func (t *Transaction) Encode() []byte {
+	w := &binWriter{buf: []byte{TRANSACTION_ENCODING_VERSION}}
+	w.uvarint(t.chainID)
+	w.uvarint(t.nonce)
+	w.string(t.senderAddress)
+	w.string(t.receiveAddress)
+	w.bigInt(t.value)
+	w.bigInt(t.fee)
+	return w.buf
+}
+
+func bigToUint64(v *big.Int) uint64 {
+	if v == nil {
+		return 0
+	}
+	return v.Uint64()
+}
+
+func fitsUint64(v *big.Int) bool {
+	return v != nil && v.IsUint64()
+}
@@ -0,0 +1,169 @@
+package block
+
+import (
+	"encoding/hex"
+	"encoding/json"
+	"math/big"
+	"os"
+	"testing"
+)
+
+// testdata/canonical_vectors.json 的结构
+type canonicalVectors struct {
+	HeaderEncodingVersion      int `json:"header_encoding_version"`
+	TransactionEncodingVersion int `json:"transaction_encoding_version"`
+	Transactions               []struct {
+		ChainID   uint64 `json:"chain_id"`
+		Nonce     uint64 `json:"nonce"`
+		Sender    string `json:"sender"`
+		Recipient string `json:"recipient"`
+		Value     string `json:"value"`
+		Fee       string `json:"fee"`
+		Encoding  string `json:"encoding"`
+		Hash      string `json:"hash"`
+	} `json:"transactions"`
+	Headers []struct {
+		Number       uint64 `json:"number"`
+		Timestamp    int64  `json:"timestamp"`
+		PreviousHash string `json:"previous_hash"`
+		Transactions []int  `json:"transactions"`
+		Difficulty   uint64 `json:"difficulty"`
+		Nonce        uint64 `json:"nonce"`
+		MerkleRoot   string `json:"merkle_root"`
+		Encoding     string `json:"encoding"`
+		Hash         string `json:"hash"`
+	} `json:"headers"`
+	MerkleProofs []struct {
+		Header int `json:"header"`
+		Index  int `json:"index"`
+		Path   []struct {
+			Hash     string `json:"hash"`
+			Position string `json:"position"`
+		} `json:"path"`
+	} `json:"merkle_proofs"`
+}
+
+func loadCanonicalVectors(t *testing.T) *canonicalVectors {
+	t.Helper()
+	data, err := os.ReadFile("testdata/canonical_vectors.json")
+	if err != nil {
+		t.Fatal(err)
+	}
+	v := new(canonicalVectors)
+	if err := json.Unmarshal(data, v); err != nil {
+		t.Fatal(err)
+	}
+	return v
+}
+
+func decodeVectorHash(t *testing.T, s string) [32]byte {
+	t.Helper()
+	var h [32]byte
+	p, err := hex.DecodeString(s)
+	if err != nil || len(p) != 32 {
+		t.Fatalf("向量中的哈希 %q 不合法", s)
+	}
+	copy(h[:], p)
+	return h
+}
+
+// 向量中的交易，按下标对应
+func vectorTransactions(t *testing.T, v *canonicalVectors) []*Transaction {
+	t.Helper()
+	txs := make([]*Transaction, 0, len(v.Transactions))
+	for _, tv := range v.Transactions {
+		value, ok := new(big.Int).SetString(tv.Value, 10)
+		if !ok {
+			t.Fatalf("金额 %q 不合法", tv.Value)
+		}
+		fee, ok := new(big.Int).SetString(tv.Fee, 10)
+		if !ok {
+			t.Fatalf("交易费 %q 不合法", tv.Fee)
+		}
+		txs = append(txs, NewChainTransaction(tv.ChainID, tv.Nonce, tv.Sender, tv.Recipient, value, fee))
+	}
+	return txs
+}
+
+// 编码格式变化时必须同时更新版本号和向量文件
+func TestCanonicalVersions(t *testing.T) {
+	v := loadCanonicalVectors(t)
+	if v.HeaderEncodingVersion != HEADER_ENCODING_VERSION {
+		t.Errorf("向量的区块头编码版本 %d，代码是 %d", v.HeaderEncodingVersion, HEADER_ENCODING_VERSION)
+	}
+	if v.TransactionEncodingVersion != TRANSACTION_ENCODING_VERSION {
+		t.Errorf("向量的交易编码版本 %d，代码是 %d", v.TransactionEncodingVersion, TRANSACTION_ENCODING_VERSION)
+	}
+}
+
+func TestCanonicalTransactionVectors(t *testing.T) {
+	v := loadCanonicalVectors(t)
+	for i, tx := range vectorTransactions(t, v) {
+		tv := v.Transactions[i]
+		if got := hex.EncodeToString(tx.Encode()); got != tv.Encoding {
+			t.Errorf("交易 %d 的编码\n得到 %s\n期望 %s", i, got, tv.Encoding)
+		}
+		if got := tx.Hash(); got != decodeVectorHash(t, tv.Hash) {
+			t.Errorf("交易 %d 的哈希 %x，期望 %s", i, got, tv.Hash)
+		}
+	}
+}
+
+func TestCanonicalHeaderVectors(t *testing.T) {
+	v := loadCanonicalVectors(t)
+	txs := vectorTransactions(t, v)
+	for i, hv := range v.Headers {
+		h := &BlockHeader{
+			number:       new(big.Int).SetUint64(hv.Number),
+			timestamp:    hv.Timestamp,
+			previousHash: decodeVectorHash(t, hv.PreviousHash),
+			difficulty:   new(big.Int).SetUint64(hv.Difficulty),
+			nonce:        new(big.Int).SetUint64(hv.Nonce),
+		}
+		if len(hv.Transactions) > 0 {
+			included := make([]*Transaction, 0, len(hv.Transactions))
+			for _, idx := range hv.Transactions {
+				included = append(included, txs[idx])
+			}
+			h.merkleRoot = MerkleRoot(included)
+		}
+		if h.merkleRoot != decodeVectorHash(t, hv.MerkleRoot) {
+			t.Errorf("区块头 %d 的 Merkle 根 %x，期望 %s", i, h.merkleRoot, hv.MerkleRoot)
+		}
+		if got := hex.EncodeToString(h.Encode()); got != hv.Encoding {
+			t.Errorf("区块头 %d 的编码\n得到 %s\n期望 %s", i, got, hv.Encoding)
+		}
+		if got := h.Hash(); got != decodeVectorHash(t, hv.Hash) {
+			t.Errorf("区块头 %d 的哈希 %x，期望 %s", i, got, hv.Hash)
+		}
+	}
+}
+
+func TestCanonicalMerkleProofVectors(t *testing.T) {
+	v := loadCanonicalVectors(t)
+	txs := vectorTransactions(t, v)
+	for _, pv := range v.MerkleProofs {
+		hv := v.Headers[pv.Header]
+		included := make([]*Transaction, 0, len(hv.Transactions))
+		for _, idx := range hv.Transactions {
+			included = append(included, txs[idx])
+		}
+		proof, err := MerkleProof(included, pv.Index)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(proof) != len(pv.Path) {
+			t.Fatalf("区块头 %d 交易 %d 的证明长度 %d，期望 %d", pv.Header, pv.Index, len(proof), len(pv.Path))
+		}
+		for j, step := range proof {
+			want := pv.Path[j]
+			if step.Hash != decodeVectorHash(t, want.Hash) || step.Left != (want.Position == "left") {
+				t.Errorf("区块头 %d 交易 %d 的证明第 %d 步不一致", pv.Header, pv.Index, j)
+			}
+		}
+		root := decodeVectorHash(t, hv.MerkleRoot)
+		if !VerifyMerkleProof(included[pv.Index].Hash(), proof, root) {
+			t.Errorf("区块头 %d 交易 %d 的证明无法通过校验", pv.Header, pv.Index)
+		}
+	}
+}
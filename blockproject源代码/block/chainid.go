@@ -0,0 +1,43 @@
+package block
+
+import (
+	"fmt"
+	"io"
+	"net/http"
+	"strconv"
+)
+
+// 链 ID，区分使用同一套代码的不同网络（开发、测试、演示）。
+// 链 ID 写入交易的规范编码，在一条链上签名的交易不能在另一条链上重放；
+// 节点之间的请求也带上链 ID，不同链的节点不会互相同步。可以由链配置修改，见 ChainSpec.Apply
+var CHAIN_ID uint64 = 1
+
+// 节点之间的请求中携带链 ID 的 HTTP 头
+const CHAIN_ID_HEADER = "X-Chain-Id"
+
+// 创建发给邻居节点的请求，带上本节点的链 ID
+func newPeerRequest(method string, endpoint string, body io.Reader) (*http.Request, error) {
+	req, err := http.NewRequest(method, endpoint, body)
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set(CHAIN_ID_HEADER, strconv.FormatUint(CHAIN_ID, 10))
+	return req, nil
+}
+
+// 检查请求携带的链 ID 与本节点一致。
+// 钱包和浏览器的请求不带链 ID，不检查；交易本身的链 ID 在签名校验时检查
+func CheckChainID(req *http.Request) error {
+	v := req.Header.Get(CHAIN_ID_HEADER)
+	if v == "" {
+		return nil
+	}
+	id, err := strconv.ParseUint(v, 10, 64)
+	if err != nil {
+		return fmt.Errorf("非法的链 ID %q", v)
+	}
+	if id != CHAIN_ID {
+		return fmt.Errorf("请求的链 ID %d 与本节点的 %d 不同：%w", id, CHAIN_ID, ErrChainID)
+	}
+	return nil
+}
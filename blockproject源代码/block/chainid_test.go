@@ -0,0 +1,104 @@
+package block
+
+import (
+	"errors"
+	"math/big"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"testing"
+)
+
+// 为其他链签名的交易不能在本链上使用：交易校验、交易池和区块校验都拒绝
+func TestRejectOtherChainTransaction(t *testing.T) {
+	miner := newTestAccount(t)
+	bc := mineTestChainBy(t, NewMemoryStore(), miner, 2)
+
+	CHAIN_ID++
+	other := miner.sign(t, "recipient", 10, 0, 1)
+	CHAIN_ID--
+	if other.chainID != CHAIN_ID+1 {
+		t.Fatalf("交易的链 ID %d", other.chainID)
+	}
+
+	if err := verifyTransaction(other); !errors.Is(err, ErrChainID) {
+		t.Fatalf("交易校验结果 %v，期望 %v", err, ErrChainID)
+	}
+	// 交易池按本链的链 ID 重新计算哈希，其他链的签名对它无效
+	if bc.AddTransaction(miner.address, "recipient", other.value, other.fee, 1, other.senderPublicKey, other.signature) {
+		t.Fatal("为其他链签名的交易进入了交易池")
+	}
+
+	txs := []*Transaction{other, NewCoinbaseTransaction(3, miner.address, BlockReward(3))}
+	b := NewBlock(big.NewInt(3), big.NewInt(0), bc.LastBlock().hash, txs)
+	if err := VerifyBody(b.Header(), txs); !errors.Is(err, ErrChainID) {
+		t.Fatalf("区块校验结果 %v，期望 %v", err, ErrChainID)
+	}
+}
+
+func TestCheckChainID(t *testing.T) {
+	tests := []struct {
+		name    string
+		header  string
+		wantErr error
+	}{
+		{"不带链 ID", "", nil},
+		{"链 ID 相同", strconv.FormatUint(CHAIN_ID, 10), nil},
+		{"链 ID 不同", strconv.FormatUint(CHAIN_ID+1, 10), ErrChainID},
+		{"链 ID 不是数字", "abc", errors.New("非法的链 ID")},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			req := httptest.NewRequest("GET", "/status", nil)
+			if tt.header != "" {
+				req.Header.Set(CHAIN_ID_HEADER, tt.header)
+			}
+			err := CheckChainID(req)
+			if tt.wantErr == nil && err != nil {
+				t.Fatalf("期望通过，返回 %v", err)
+			}
+			if tt.wantErr == ErrChainID && !errors.Is(err, ErrChainID) {
+				t.Fatalf("返回 %v，期望 %v", err, ErrChainID)
+			}
+			if tt.wantErr != nil && err == nil {
+				t.Fatal("期望返回错误")
+			}
+		})
+	}
+}
+
+// 节点发给邻居的请求带上本节点的链 ID，其他链的邻居按 CheckChainID 拒绝
+func TestPeerRequestChainID(t *testing.T) {
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		if err := CheckChainID(req); err != nil {
+			w.WriteHeader(http.StatusForbidden)
+			return
+		}
+		w.WriteHeader(http.StatusOK)
+	}))
+	defer srv.Close()
+
+	// 以链 ID 为 id 的节点身份发出请求，请求构造完后恢复本节点的链 ID
+	status := func(id uint64) int {
+		t.Helper()
+		old := CHAIN_ID
+		CHAIN_ID = id
+		req, err := newPeerRequest("GET", srv.URL+"/status", nil)
+		CHAIN_ID = old
+		if err != nil {
+			t.Fatal(err)
+		}
+		resp, err := http.DefaultClient.Do(req)
+		if err != nil {
+			t.Fatal(err)
+		}
+		resp.Body.Close()
+		return resp.StatusCode
+	}
+	if code := status(CHAIN_ID); code != http.StatusOK {
+		t.Fatalf("同一条链的请求返回 %d", code)
+	}
+	if code := status(CHAIN_ID + 1); code != http.StatusForbidden {
+		t.Fatalf("其他链的请求返回 %d，期望 %d", code, http.StatusForbidden)
+	}
+}
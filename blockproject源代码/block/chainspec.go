@@ -0,0 +1,160 @@
+package block
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"math/big"
+	"os"
+	"sort"
+	"time"
+)
+
+// 默认链配置的创世纪块时间（Unix 秒），未指定链配置文件的节点使用同一个创世纪块
+const DEFAULT_GENESIS_TIMESTAMP = 1686877569
+
+// 链配置：创世纪块和影响共识的链参数，同一条链上的所有节点必须使用相同的配置，
+// 否则创世纪块哈希不同，节点之间不会同步
+type ChainSpec struct {
+	// 链 ID，见 CHAIN_ID
+	ChainID uint64 `json:"chain_id"`
+	// 创世纪块的时间戳，Unix 秒
+	GenesisTimestamp int64 `json:"genesis_timestamp"`
+	// 创世纪块中预先分配给各地址的金额，以挖矿奖励交易写入创世纪块，同样需要等待 COINBASE_MATURITY 个区块才能花费
+	Alloc map[string]*big.Int `json:"alloc"`
+	// 创世纪块的难度，之后的难度由 NextDifficulty 计算
+	Difficulty int `json:"difficulty"`
+	// 初始的挖矿奖励
+	Reward int64 `json:"reward"`
+	// 挖矿定时器的间隔（秒），目标出块间隔见 TARGET_BLOCK_INTERVAL
+	BlockInterval int64 `json:"block_interval"`
+	// 挖矿奖励计划，见 REWARD_HALVING_INTERVAL、MAX_SUPPLY、COINBASE_MATURITY
+	HalvingInterval  uint64   `json:"halving_interval"`
+	MaxSupply        *big.Int `json:"max_supply"`
+	CoinbaseMaturity uint64   `json:"coinbase_maturity"`
+}
+
+// 包中共识参数的初始值，在 Apply 修改它们之前记录下来，默认值只在各参数的声明处写一次
+var defaultChainSpec = ChainSpec{
+	ChainID:          CHAIN_ID,
+	GenesisTimestamp: DEFAULT_GENESIS_TIMESTAMP,
+	Difficulty:       MINING_DIFFICULT,
+	Reward:           MINING_REWARD,
+	BlockInterval:    MINING_TIMER_SEC,
+	HalvingInterval:  REWARD_HALVING_INTERVAL,
+	MaxSupply:        MAX_SUPPLY,
+	CoinbaseMaturity: COINBASE_MATURITY,
+}
+
+// 与包中默认参数一致的链配置，不受之前 Apply 的影响
+func DefaultChainSpec() *ChainSpec {
+	spec := defaultChainSpec
+	spec.Alloc = map[string]*big.Int{}
+	spec.MaxSupply = new(big.Int).Set(defaultChainSpec.MaxSupply)
+	return &spec
+}
+
+// 读取 JSON 格式的链配置文件，没有写的字段使用 DefaultChainSpec 的值
+func LoadChainSpec(path string) (*ChainSpec, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	spec := DefaultChainSpec()
+	decoder := json.NewDecoder(bytes.NewReader(data))
+	decoder.DisallowUnknownFields()
+	if err := decoder.Decode(spec); err != nil {
+		return nil, fmt.Errorf("解析链配置 %s 失败：%w", path, err)
+	}
+	if err := spec.Validate(); err != nil {
+		return nil, fmt.Errorf("链配置 %s 不合法：%w", path, err)
+	}
+	return spec, nil
+}
+
+func (cs *ChainSpec) Validate() error {
+	if cs.ChainID == 0 {
+		return fmt.Errorf("chain_id 必须大于 0")
+	}
+	if cs.Difficulty <= 0 {
+		return fmt.Errorf("difficulty %d 必须大于 0", cs.Difficulty)
+	}
+	if cs.Reward < 0 {
+		return fmt.Errorf("reward %d 不能为负", cs.Reward)
+	}
+	if cs.BlockInterval <= 0 {
+		return fmt.Errorf("block_interval %d 必须大于 0", cs.BlockInterval)
+	}
+	if cs.MaxSupply == nil || cs.MaxSupply.Sign() < 0 {
+		return fmt.Errorf("max_supply %v 不能为负", cs.MaxSupply)
+	}
+	for addr, v := range cs.Alloc {
+		if addr == "" || addr == MINING_ACCOUNT_ADDRESS {
+			return fmt.Errorf("alloc 中的地址 %q 不合法", addr)
+		}
+		if v == nil || v.Sign() <= 0 {
+			return fmt.Errorf("alloc 中地址 %s 的金额 %v 必须大于 0", addr, v)
+		}
+	}
+	if len(cs.Alloc) >= MAX_BLOCK_TXS {
+		return fmt.Errorf("alloc 中的地址数量 %d 超过上限", len(cs.Alloc))
+	}
+	return nil
+}
+
+// 把链配置中的参数设置为本节点使用的共识参数，需要在创建区块链、校验或导入区块之前调用
+func (cs *ChainSpec) Apply() {
+	CHAIN_ID = cs.ChainID
+	MINING_DIFFICULT = cs.Difficulty
+	MINING_REWARD = cs.Reward
+	MINING_TIMER_SEC = cs.BlockInterval
+	TARGET_BLOCK_INTERVAL = targetBlockInterval(cs.BlockInterval)
+	REWARD_HALVING_INTERVAL = cs.HalvingInterval
+	MAX_SUPPLY = new(big.Int).Set(cs.MaxSupply)
+	COINBASE_MATURITY = cs.CoinbaseMaturity
+}
+
+// 按链配置生成创世纪块，相同的配置总是得到相同的区块和哈希。
+// 预分配按地址排序写入，每个地址一笔挖矿奖励交易
+func (cs *ChainSpec) Genesis() *Block {
+	addrs := make([]string, 0, len(cs.Alloc))
+	for addr := range cs.Alloc {
+		addrs = append(addrs, addr)
+	}
+	sort.Strings(addrs)
+	txs := make([]*Transaction, 0, len(addrs))
+	for _, addr := range addrs {
+		txs = append(txs, NewChainTransaction(cs.ChainID, 0, MINING_ACCOUNT_ADDRESS, addr, new(big.Int).Set(cs.Alloc[addr]), nil))
+	}
+	b := NewBlock(big.NewInt(0), big.NewInt(0), [32]byte{}, txs)
+	b.timestamp = time.Unix(cs.GenesisTimestamp, 0).UnixNano()
+	b.difficulty = big.NewInt(int64(cs.Difficulty))
+	b.hash = b.Hash()
+	return b
+}
+
+// 存储为空时写入链配置的创世纪块，否则检查存储中的创世纪块与链配置一致
+func InitGenesis(store BlockStore, spec *ChainSpec) error {
+	genesis := spec.Genesis()
+	existing, err := store.GetByNumber(0)
+	if errors.Is(err, ErrBlockNotFound) {
+		return store.Append(genesis)
+	}
+	if err != nil {
+		return err
+	}
+	if existing.hash != genesis.hash {
+		return fmt.Errorf("存储中的创世纪块 %x 与链配置的创世纪块 %x 不同", existing.hash, genesis.hash)
+	}
+	return nil
+}
+
+// 本地链创世纪块的哈希，与邻居不同时不同步
+func (bc *Blockchain) GenesisHash() [32]byte {
+	genesis, err := bc.store.GetByNumber(0)
+	if err != nil {
+		return [32]byte{}
+	}
+	return genesis.hash
+}
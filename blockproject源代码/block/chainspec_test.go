@@ -0,0 +1,76 @@
+package block
+
+import (
+	"math/big"
+	"testing"
+	"time"
+)
+
+// 默认链配置与包中参数的初始值一致，Apply 其它链配置之后也不变
+func TestDefaultChainSpecAfterApply(t *testing.T) {
+	defer DefaultChainSpec().Apply()
+
+	def := DefaultChainSpec()
+	if def.ChainID != CHAIN_ID || def.Difficulty != MINING_DIFFICULT || def.Reward != MINING_REWARD ||
+		def.BlockInterval != MINING_TIMER_SEC || def.HalvingInterval != REWARD_HALVING_INTERVAL ||
+		def.MaxSupply.Cmp(MAX_SUPPLY) != 0 || def.CoinbaseMaturity != COINBASE_MATURITY {
+		t.Fatalf("默认链配置 %+v 与包中参数不一致", def)
+	}
+
+	custom := &ChainSpec{
+		ChainID:          7,
+		GenesisTimestamp: 1,
+		Difficulty:       0x2000,
+		Reward:           10,
+		BlockInterval:    3,
+		HalvingInterval:  5,
+		MaxSupply:        big.NewInt(100),
+		CoinbaseMaturity: 2,
+	}
+	custom.Apply()
+	if CHAIN_ID != 7 || MINING_REWARD != 10 || TARGET_BLOCK_INTERVAL != 8*time.Second || MAX_SUPPLY.Int64() != 100 {
+		t.Fatal("Apply 没有设置共识参数")
+	}
+	custom.MaxSupply.SetInt64(1)
+	if MAX_SUPPLY.Int64() != 100 {
+		t.Fatal("Apply 之后修改链配置影响了 MAX_SUPPLY")
+	}
+
+	after := DefaultChainSpec()
+	if after.ChainID != def.ChainID || after.Reward != def.Reward || after.Difficulty != def.Difficulty ||
+		after.BlockInterval != def.BlockInterval || after.MaxSupply.Cmp(def.MaxSupply) != 0 {
+		t.Fatalf("Apply 之后默认链配置变为 %+v", after)
+	}
+	if after.Genesis().hash != def.Genesis().hash {
+		t.Fatal("Apply 之后默认创世纪块变化")
+	}
+}
+
+// 存储中已有的创世纪块与链配置（未指定时为默认链配置）不同时拒绝启动
+func TestGenesisMismatch(t *testing.T) {
+	other := DefaultChainSpec()
+	other.GenesisTimestamp++
+	tests := []struct {
+		name    string
+		stored  *ChainSpec
+		spec    *ChainSpec
+		wantErr bool
+	}{
+		{"默认链配置一致", DefaultChainSpec(), nil, false},
+		{"默认链配置不同", other, nil, true},
+		{"指定链配置一致", other, other, false},
+		{"指定链配置不同", DefaultChainSpec(), other, true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			store := NewMemoryStore()
+			if err := store.Append(tt.stored.Genesis()); err != nil {
+				t.Fatal(err)
+			}
+			_, err := NewBlockchainWithSpec("miner", 5000, store, tt.spec)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("错误 %v，期望出错 %v", err, tt.wantErr)
+			}
+		})
+	}
+}
@@ -0,0 +1,135 @@
+package block
+
+import (
+	"crypto/ecdsa"
+	"errors"
+	"fmt"
+	"jhblockchain/utils"
+	"runtime"
+	"strings"
+)
+
+// 共识引擎类型，对应命令行参数 --consensus
+const (
+	CONSENSUS_POW = "pow"
+	CONSENSUS_POA = "poa"
+)
+
+// 出块被放弃或本节点不能出块时 Seal 返回的错误
+var (
+	ErrSealAborted = errors.New("sealing aborted")
+	ErrNotInTurn   = errors.New("not in turn to seal")
+)
+
+// 共识引擎：决定区块头中由共识确定的字段、如何封装新区块以及如何校验区块头。
+// 区块号、父区块哈希、时间戳等与共识无关的规则由 VerifyHeader 统一检查
+type ConsensusEngine interface {
+	// 填写新区块 b 中由共识决定的字段（难度），parent 为父区块头，
+	// ancestor 用于读取更早的区块头
+	Prepare(parent *BlockHeader, b *Block, ancestor HeaderGetter) error
+	// 封装新区块，成功后写入区块的 nonce、哈希或签名。
+	// abort 被关闭（链尾变化）时放弃并返回 ErrSealAborted
+	Seal(b *Block, abort <-chan struct{}) error
+	// 校验区块头 h 满足共识规则，prev 为父区块头，ancestor 用于读取更早的区块头
+	Verify(prev *BlockHeader, h *BlockHeader, ancestor HeaderGetter) error
+}
+
+// 根据名称创建共识引擎。
+// workers 为工作量证明的并行线程数，signers 为权威证明的出块节点公钥（wallet.PublicKeyStr 的格式，
+// 用逗号分隔），key 为本节点的出块私钥，为 nil 时只校验不出块
+func OpenEngine(kind string, workers int, signers string, key *ecdsa.PrivateKey) (ConsensusEngine, error) {
+	switch kind {
+	case CONSENSUS_POW:
+		return NewPoWEngine(workers), nil
+	case CONSENSUS_POA:
+		keys := make([]*ecdsa.PublicKey, 0)
+		for _, s := range strings.Split(signers, ",") {
+			if s = strings.TrimSpace(s); s == "" {
+				continue
+			}
+			if len(s) != 128 {
+				return nil, fmt.Errorf("非法的出块节点公钥 %q", s)
+			}
+			keys = append(keys, utils.PublicKeyFromString(s))
+		}
+		return NewPoAEngine(keys, key)
+	default:
+		return nil, fmt.Errorf("未知的共识引擎 %q", kind)
+	}
+}
+
+// 工作量证明：难度由链上历史计算，见 NextDifficulty，多个线程并行搜索 nonce
+type PoWEngine struct {
+	workers int
+	meter   miningMeter
+}
+
+// 创建工作量证明引擎，workers <= 0 时使用 CPU 核数
+func NewPoWEngine(workers int) *PoWEngine {
+	if workers <= 0 {
+		workers = runtime.NumCPU()
+	}
+	return &PoWEngine{workers: workers}
+}
+
+func (pe *PoWEngine) Prepare(parent *BlockHeader, b *Block, ancestor HeaderGetter) error {
+	difficulty, err := NextDifficulty(parent, ancestor)
+	if err != nil {
+		return err
+	}
+	b.difficulty = difficulty
+	return nil
+}
+
+func (pe *PoWEngine) Verify(prev *BlockHeader, h *BlockHeader, ancestor HeaderGetter) error {
+	if len(h.seal) != 0 {
+		return headerError(h, ErrInvalidSeal, "工作量证明的区块不能带出块签名")
+	}
+	difficulty, err := NextDifficulty(prev, ancestor)
+	if err != nil {
+		return headerError(h, ErrDifficulty, "无法计算难度：%v", err)
+	}
+	if h.difficulty.Cmp(difficulty) != 0 {
+		return headerError(h, ErrDifficulty, "难度 %v 与按链上历史计算的难度 %v 不符", h.difficulty, difficulty)
+	}
+	if !h.validProof() {
+		return headerError(h, ErrInvalidProof, "区块哈希不满足难度 %v", h.difficulty)
+	}
+	return nil
+}
+
+func (pe *PoWEngine) Stats() *MiningStats {
+	return pe.meter.stats(pe.workers)
+}
+
+// 设置本地链使用的共识引擎，需要在开始出块和同步之前调用
+func (bc *Blockchain) SetEngine(engine ConsensusEngine) {
+	bc.engine = engine
+}
+
+func (bc *Blockchain) Engine() ConsensusEngine {
+	return bc.engine
+}
+
+// 挖矿统计，只有工作量证明引擎有哈希计数，其他引擎返回零值
+func (bc *Blockchain) MiningStats() *MiningStats {
+	if pe, ok := bc.engine.(*PoWEngine); ok {
+		return pe.Stats()
+	}
+	return &MiningStats{}
+}
+
+// 以当前链尾为父区块准备新区块的时间戳和共识字段，调用方持有 bc.mux
+func (bc *Blockchain) prepare(b *Block) error {
+	parent := bc.LastBlock().Header()
+	ancestor := headersOf(bc.store.GetByNumber)
+	mtp, err := MedianTimePast(parent, ancestor)
+	if err != nil {
+		return err
+	}
+	// 本地时钟落后于链上时间时，时间戳取过去时间中位数之后，保证区块能通过校验
+	if b.timestamp <= mtp {
+		b.timestamp = mtp + 1
+	}
+	return bc.engine.Prepare(parent, b, ancestor)
+}
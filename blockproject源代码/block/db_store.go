@@ -0,0 +1,413 @@
+package block
+
+import (
+	"bytes"
+	"encoding/binary"
+	"encoding/json"
+	"fmt"
+	"math/big"
+	"os"
+	"path/filepath"
+	"time"
+
+	bolt "go.etcd.io/bbolt"
+)
+
+// 数据库存储使用的文件名，位于数据目录下
+const DB_FILE_NAME = "blockchain.db"
+
+// 每次遍历从数据库读出的区块数，遍历回调执行期间不持有读事务
+const dbIterateBatch = 128
+
+// 索引格式版本，与数据库中记录的版本不同时打开数据库会重建索引
+const dbIndexVersion = 2
+
+var (
+	// 区块号 -> 区块 JSON
+	bucketBlocks = []byte("blocks")
+	// 区块哈希 -> 区块号
+	bucketHashes = []byte("hashes")
+	// 交易哈希 -> 区块号 + 交易下标
+	bucketTransactions = []byte("transactions")
+	// 地址 -> 子桶（区块号 + 交易下标 -> 交易哈希 + 交易后的余额）
+	bucketAddresses = []byte("addresses")
+	// 元数据
+	bucketMeta = []byte("meta")
+
+	dbBuckets    = [][]byte{bucketBlocks, bucketHashes, bucketTransactions, bucketAddresses, bucketMeta}
+	indexBuckets = [][]byte{bucketHashes, bucketTransactions, bucketAddresses}
+
+	keyIndexVersion = []byte("index_version")
+	// 账户状态快照，见 SnapshotStore
+	keyStateSnapshot = []byte("state_snapshot")
+)
+
+// 基于 bbolt 的嵌入式数据库存储，区块和各类索引都保存在 B+ 树里，
+// 查询是 O(log n)，启动时也不需要把整条链读入内存
+type DBStore struct {
+	db *bolt.DB
+}
+
+// sync 为 SYNC_ALWAYS 时每次提交都 fsync，其他策略关闭 bbolt 的提交刷盘
+func NewDBStore(datadir string, sync SyncPolicy) (*DBStore, error) {
+	if err := os.MkdirAll(datadir, 0755); err != nil {
+		return nil, err
+	}
+	db, err := bolt.Open(filepath.Join(datadir, DB_FILE_NAME), 0600, &bolt.Options{Timeout: time.Second})
+	if err != nil {
+		return nil, fmt.Errorf("无法打开数据库：%w", err)
+	}
+	db.NoSync = sync != SYNC_ALWAYS
+	err = db.Update(func(tx *bolt.Tx) error {
+		for _, name := range dbBuckets {
+			if _, err := tx.CreateBucketIfNotExists(name); err != nil {
+				return err
+			}
+		}
+		return checkIndexVersion(tx)
+	})
+	if err != nil {
+		db.Close()
+		return nil, err
+	}
+	return &DBStore{db: db}, nil
+}
+
+func (ds *DBStore) Append(b *Block) error {
+	return ds.db.Update(func(tx *bolt.Tx) error {
+		return putBlock(tx, b)
+	})
+}
+
+func (ds *DBStore) GetByNumber(number uint64) (*Block, error) {
+	var b *Block
+	err := ds.db.View(func(tx *bolt.Tx) error {
+		var err error
+		b, err = getBlock(tx, number)
+		return err
+	})
+	return b, err
+}
+
+func (ds *DBStore) GetByHash(hash [32]byte) (*Block, error) {
+	var b *Block
+	err := ds.db.View(func(tx *bolt.Tx) error {
+		v := tx.Bucket(bucketHashes).Get(hash[:])
+		if v == nil {
+			return ErrBlockNotFound
+		}
+		var err error
+		b, err = getBlock(tx, binary.BigEndian.Uint64(v))
+		return err
+	})
+	return b, err
+}
+
+func (ds *DBStore) Iterate(fn func(b *Block) bool) error {
+	next := uint64(0)
+	for {
+		blocks := make([]*Block, 0, dbIterateBatch)
+		err := ds.db.View(func(tx *bolt.Tx) error {
+			c := tx.Bucket(bucketBlocks).Cursor()
+			for k, v := c.Seek(encodeNumber(next)); k != nil && len(blocks) < dbIterateBatch; k, v = c.Next() {
+				b, err := decodeBlock(v)
+				if err != nil {
+					return err
+				}
+				blocks = append(blocks, b)
+			}
+			return nil
+		})
+		if err != nil {
+			return err
+		}
+		for _, b := range blocks {
+			if !fn(b) {
+				return nil
+			}
+		}
+		if len(blocks) < dbIterateBatch {
+			return nil
+		}
+		next += uint64(len(blocks))
+	}
+}
+
+func (ds *DBStore) Head() (*Block, error) {
+	var b *Block
+	err := ds.db.View(func(tx *bolt.Tx) error {
+		_, v := tx.Bucket(bucketBlocks).Cursor().Last()
+		if v == nil {
+			return ErrBlockNotFound
+		}
+		var err error
+		b, err = decodeBlock(v)
+		return err
+	})
+	return b, err
+}
+
+func (ds *DBStore) GetTxLocation(hash [32]byte) (TxLocation, error) {
+	var loc TxLocation
+	err := ds.db.View(func(tx *bolt.Tx) error {
+		v := tx.Bucket(bucketTransactions).Get(hash[:])
+		if v == nil {
+			return ErrTransactionNotFound
+		}
+		loc = decodeLocation(v)
+		return nil
+	})
+	return loc, err
+}
+
+func (ds *DBStore) AddressTransactions(address string, before *TxLocation, limit int) ([]AddressTx, error) {
+	txs := make([]AddressTx, 0)
+	err := ds.db.View(func(tx *bolt.Tx) error {
+		ab := tx.Bucket(bucketAddresses).Bucket([]byte(address))
+		if ab == nil {
+			return nil
+		}
+		c := ab.Cursor()
+		var k, v []byte
+		if before == nil {
+			k, v = c.Last()
+		} else if k, _ = c.Seek(encodeLocation(*before)); k == nil {
+			k, v = c.Last()
+		} else {
+			k, v = c.Prev()
+		}
+		for ; k != nil && (limit <= 0 || len(txs) < limit); k, v = c.Prev() {
+			atx, err := decodeAddressTx(k, v)
+			if err != nil {
+				return err
+			}
+			txs = append(txs, atx)
+		}
+		return nil
+	})
+	return txs, err
+}
+
+// 删除旧区块及其索引、写入新区块都在同一个事务里完成，替换要么全部成功要么全部失败
+func (ds *DBStore) ReplaceFrom(number uint64, blocks []*Block) error {
+	return ds.db.Update(func(tx *bolt.Tx) error {
+		count := uint64(0)
+		if k, _ := tx.Bucket(bucketBlocks).Cursor().Last(); k != nil {
+			count = binary.BigEndian.Uint64(k) + 1
+		}
+		if number > count {
+			return fmt.Errorf("无法从区块 %d 开始替换，当前只有 %d 个区块", number, count)
+		}
+		// 从链尾开始删除，保证地址索引中每个地址的最后一条记录始终是最新余额
+		for n := count; n > number; n-- {
+			if err := removeBlock(tx, n-1); err != nil {
+				return err
+			}
+		}
+		for _, b := range blocks {
+			if err := putBlock(tx, b); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+}
+
+func (ds *DBStore) SaveSnapshot(data []byte) error {
+	return ds.db.Update(func(tx *bolt.Tx) error {
+		return tx.Bucket(bucketMeta).Put(keyStateSnapshot, data)
+	})
+}
+
+func (ds *DBStore) LoadSnapshot() ([]byte, error) {
+	var data []byte
+	err := ds.db.View(func(tx *bolt.Tx) error {
+		v := tx.Bucket(bucketMeta).Get(keyStateSnapshot)
+		if v == nil {
+			return ErrSnapshotNotFound
+		}
+		// bbolt 返回的切片只在事务内有效
+		data = append([]byte(nil), v...)
+		return nil
+	})
+	return data, err
+}
+
+func (ds *DBStore) Close() error {
+	return ds.db.Close()
+}
+
+func recreateBuckets(tx *bolt.Tx, names ...[]byte) error {
+	for _, name := range names {
+		if err := tx.DeleteBucket(name); err != nil {
+			return err
+		}
+		if _, err := tx.CreateBucket(name); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// 索引格式变化后根据区块重建全部索引
+func checkIndexVersion(tx *bolt.Tx) error {
+	meta := tx.Bucket(bucketMeta)
+	version := encodeNumber(dbIndexVersion)
+	if v := meta.Get(keyIndexVersion); v != nil && binary.BigEndian.Uint64(v) == dbIndexVersion {
+		return nil
+	}
+	if err := recreateBuckets(tx, indexBuckets...); err != nil {
+		return err
+	}
+	err := tx.Bucket(bucketBlocks).ForEach(func(k, v []byte) error {
+		b, err := decodeBlock(v)
+		if err != nil {
+			return err
+		}
+		return indexBlock(tx, b, binary.BigEndian.Uint64(k))
+	})
+	if err != nil {
+		return err
+	}
+	return meta.Put(keyIndexVersion, version)
+}
+
+// 写入区块并更新哈希、交易、地址索引
+func putBlock(tx *bolt.Tx, b *Block) error {
+	blocks := tx.Bucket(bucketBlocks)
+	expect := uint64(0)
+	if k, _ := blocks.Cursor().Last(); k != nil {
+		expect = binary.BigEndian.Uint64(k) + 1
+	}
+	if err := checkNumber(b, expect); err != nil {
+		return err
+	}
+
+	m, err := b.MarshalJSON()
+	if err != nil {
+		return err
+	}
+	if err := blocks.Put(encodeNumber(expect), m); err != nil {
+		return err
+	}
+	return indexBlock(tx, b, expect)
+}
+
+func indexBlock(tx *bolt.Tx, b *Block, number uint64) error {
+	if err := tx.Bucket(bucketHashes).Put(b.hash[:], encodeNumber(number)); err != nil {
+		return err
+	}
+
+	txs := tx.Bucket(bucketTransactions)
+	addresses := tx.Bucket(bucketAddresses)
+	for i, t := range b.transactions {
+		loc := TxLocation{Number: number, Index: i}
+		if err := txs.Put(t.hash[:], encodeLocation(loc)); err != nil {
+			return err
+		}
+		for _, addr := range t.addresses() {
+			ab, err := addresses.CreateBucketIfNotExists([]byte(addr))
+			if err != nil {
+				return err
+			}
+			balance := new(big.Int)
+			if k, v := ab.Cursor().Last(); k != nil {
+				last, err := decodeAddressTx(k, v)
+				if err != nil {
+					return err
+				}
+				balance = last.Balance
+			}
+			balance.Add(balance, t.balanceDelta(addr))
+			if err := ab.Put(encodeLocation(loc), encodeAddressTx(t.hash, balance)); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// 删除区块及其在各个索引中的记录
+func removeBlock(tx *bolt.Tx, number uint64) error {
+	b, err := getBlock(tx, number)
+	if err != nil {
+		return err
+	}
+	if err := tx.Bucket(bucketHashes).Delete(b.hash[:]); err != nil {
+		return err
+	}
+	txs := tx.Bucket(bucketTransactions)
+	addresses := tx.Bucket(bucketAddresses)
+	for i, t := range b.transactions {
+		key := encodeLocation(TxLocation{Number: number, Index: i})
+		// 校验通过的链上交易哈希唯一（普通交易带交易序号，挖矿奖励交易以区块号为序号），
+		// 这里仍只删除指向本区块的索引，不会误删其他区块的记录
+		if v := txs.Get(t.hash[:]); v != nil && bytes.Equal(v, key) {
+			if err := txs.Delete(t.hash[:]); err != nil {
+				return err
+			}
+		}
+		for _, addr := range t.addresses() {
+			if ab := addresses.Bucket([]byte(addr)); ab != nil {
+				if err := ab.Delete(key); err != nil {
+					return err
+				}
+			}
+		}
+	}
+	return tx.Bucket(bucketBlocks).Delete(encodeNumber(number))
+}
+
+func getBlock(tx *bolt.Tx, number uint64) (*Block, error) {
+	v := tx.Bucket(bucketBlocks).Get(encodeNumber(number))
+	if v == nil {
+		return nil, ErrBlockNotFound
+	}
+	return decodeBlock(v)
+}
+
+// bbolt 返回的切片只在事务内有效，json 解码会复制所需数据
+func decodeBlock(v []byte) (*Block, error) {
+	var b *Block
+	if err := json.Unmarshal(v, &b); err != nil {
+		return nil, err
+	}
+	return b, nil
+}
+
+// 区块号使用大端编码，保证按键排序即按区块号排序
+func encodeNumber(number uint64) []byte {
+	k := make([]byte, 8)
+	binary.BigEndian.PutUint64(k, number)
+	return k
+}
+
+func encodeLocation(loc TxLocation) []byte {
+	k := make([]byte, 12)
+	binary.BigEndian.PutUint64(k, loc.Number)
+	binary.BigEndian.PutUint32(k[8:], uint32(loc.Index))
+	return k
+}
+
+// 地址索引的值：交易哈希 + 余额
+func encodeAddressTx(hash [32]byte, balance *big.Int) []byte {
+	w := new(binWriter)
+	w.fixed(hash[:])
+	w.bigInt(balance)
+	return w.buf
+}
+
+func decodeAddressTx(k, v []byte) (AddressTx, error) {
+	atx := AddressTx{Location: decodeLocation(k)}
+	r := &binReader{data: v}
+	r.fixed(atx.Hash[:])
+	atx.Balance = r.bigInt()
+	return atx, r.finish()
+}
+
+func decodeLocation(k []byte) TxLocation {
+	return TxLocation{
+		Number: binary.BigEndian.Uint64(k),
+		Index:  int(binary.BigEndian.Uint32(k[8:])),
+	}
+}
@@ -0,0 +1,76 @@
+package block
+
+import (
+	"fmt"
+	"math/big"
+	"time"
+)
+
+// 目标出块间隔。挖矿定时器每 MINING_TIMER_SEC 秒触发一次，
+// 目标间隔比它长 5 秒，即工作量证明本身平均约用 5 秒
+var TARGET_BLOCK_INTERVAL = targetBlockInterval(MINING_TIMER_SEC)
+
+func targetBlockInterval(timerSec int64) time.Duration {
+	return time.Duration(timerSec+5) * time.Second
+}
+
+const (
+	// 每隔多少个区块调整一次难度
+	RETARGET_INTERVAL = 10
+	// 单次调整最多放大或缩小的倍数
+	RETARGET_MAX_FACTOR = 4
+	// 难度下限
+	MIN_MINING_DIFFICULT = 0x1000
+)
+
+// 按区块号读取本链上的祖先区块，校验邻居的链时从链本身读取，挖矿和导入时从存储读取
+type BlockGetter func(number uint64) (*Block, error)
+
+// 计算 parent 之后下一个区块应使用的难度。
+// 难度只由链上历史决定，写入区块头并在校验时核对，所有节点对每个区块的难度结论一致。
+// 下一个区块号是 RETARGET_INTERVAL 的整数倍时，根据最近 RETARGET_INTERVAL 个区块的实际用时
+// 与目标用时的比例调整难度，单次最多调整 RETARGET_MAX_FACTOR 倍；其余区块沿用父区块的难度。
+// 创世纪块的时间戳是链配置中的固定值，与第一个区块相隔很久，第一个窗口从区块 1 开始计时
+func NextDifficulty(parent *BlockHeader, ancestor HeaderGetter) (*big.Int, error) {
+	if !fitsUint64(parent.number) || !fitsUint64(parent.difficulty) {
+		return nil, fmt.Errorf("区块 %v 的区块号或难度不合法", parent.number)
+	}
+	next := parent.number.Uint64() + 1
+	if next%RETARGET_INTERVAL != 0 {
+		return new(big.Int).Set(parent.difficulty), nil
+	}
+	start := next - RETARGET_INTERVAL
+	if start == 0 {
+		start = 1
+	}
+	first, err := ancestor(start)
+	if err != nil {
+		return nil, fmt.Errorf("读取区块 %d 失败：%w", start, err)
+	}
+
+	// 窗口内第一个区块到父区块之间的出块间隔数，通常为 RETARGET_INTERVAL-1，第一个窗口少一个
+	expected := int64(TARGET_BLOCK_INTERVAL) * int64(next-1-start)
+	actual := parent.timestamp - first.timestamp
+	if actual < expected/RETARGET_MAX_FACTOR {
+		actual = expected / RETARGET_MAX_FACTOR
+	}
+	if actual > expected*RETARGET_MAX_FACTOR {
+		actual = expected * RETARGET_MAX_FACTOR
+	}
+
+	// 难度与期望尝试次数成正比，出块太快就按比例提高难度，太慢就降低
+	difficulty := new(big.Int).Mul(parent.difficulty, big.NewInt(expected))
+	difficulty.Div(difficulty, big.NewInt(actual))
+	if difficulty.Cmp(big.NewInt(MIN_MINING_DIFFICULT)) < 0 {
+		difficulty.SetInt64(MIN_MINING_DIFFICULT)
+	}
+	if !difficulty.IsUint64() {
+		difficulty.SetUint64(^uint64(0))
+	}
+	return difficulty, nil
+}
+
+// 本地链下一个区块应使用的难度
+func (bc *Blockchain) NextDifficulty() (*big.Int, error) {
+	return NextDifficulty(bc.LastBlock().Header(), headersOf(bc.store.GetByNumber))
+}
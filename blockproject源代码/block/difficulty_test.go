@@ -0,0 +1,78 @@
+package block
+
+import (
+	"math/big"
+	"testing"
+	"time"
+)
+
+// n 个区块头，创世纪块使用默认链配置的时间戳，区块 1 在一年之后，区块 i 与前一个区块相隔 interval(i)
+func retargetChain(n int, interval func(i int) time.Duration) []*BlockHeader {
+	genesis := time.Unix(DEFAULT_GENESIS_TIMESTAMP, 0)
+	timestamps := []int64{genesis.UnixNano(), genesis.AddDate(1, 0, 0).UnixNano()}
+	for i := 2; i < n; i++ {
+		timestamps = append(timestamps, timestamps[i-1]+int64(interval(i)))
+	}
+	return timestampChain(timestamps)
+}
+
+func every(d time.Duration) func(int) time.Duration {
+	return func(int) time.Duration { return d }
+}
+
+func TestNextDifficulty(t *testing.T) {
+	target := TARGET_BLOCK_INTERVAL
+	base := big.NewInt(int64(MINING_DIFFICULT))
+	scaled := func(num, den int64) *big.Int {
+		d := new(big.Int).Mul(base, big.NewInt(num))
+		return d.Div(d, big.NewInt(den))
+	}
+	tests := []struct {
+		name       string
+		headers    []*BlockHeader
+		parent     int
+		difficulty *big.Int
+		want       *big.Int
+	}{
+		{"不是调整高度时沿用父区块的难度", retargetChain(10, every(target/10)), 4, nil, base},
+		// 创世纪块的时间戳比区块 1 早很多年，计入窗口的话第一个窗口总会按下限缩小 4 倍
+		{"第一个窗口从区块 1 计时", retargetChain(10, every(target)), 9, nil, base},
+		{"出块快一倍时难度加倍", retargetChain(10, every(target/2)), 9, nil, scaled(2, 1)},
+		{"出块慢一倍时难度减半", retargetChain(10, every(target*2)), 9, nil, scaled(1, 2)},
+		{"出块过快时最多放大 4 倍", retargetChain(10, every(target/100)), 9, nil, scaled(RETARGET_MAX_FACTOR, 1)},
+		{"时间戳相同时最多放大 4 倍", retargetChain(10, every(0)), 9, nil, scaled(RETARGET_MAX_FACTOR, 1)},
+		{"出块过慢时最多缩小 4 倍", retargetChain(10, every(target*100)), 9, nil, scaled(1, RETARGET_MAX_FACTOR)},
+		{"刚好 4 倍时不截断", retargetChain(10, every(target*RETARGET_MAX_FACTOR)), 9, nil, scaled(1, RETARGET_MAX_FACTOR)},
+		// 区块 10 之前出块很慢，只统计区块 10 到 19 的 9 个间隔
+		{"只统计最近 10 个区块", retargetChain(20, func(i int) time.Duration {
+			if i <= 10 {
+				return target * 100
+			}
+			return target / 2
+		}), 19, nil, scaled(2, 1)},
+		{"不低于难度下限", retargetChain(10, every(target*100)), 9, big.NewInt(MIN_MINING_DIFFICULT + 1), big.NewInt(MIN_MINING_DIFFICULT)},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			parent := tt.headers[tt.parent]
+			if tt.difficulty != nil {
+				parent.difficulty = tt.difficulty
+			}
+			got, err := NextDifficulty(parent, headerGetter(tt.headers))
+			if err != nil {
+				t.Fatal(err)
+			}
+			if got.Cmp(tt.want) != 0 {
+				t.Fatalf("难度 %v，期望 %v", got, tt.want)
+			}
+		})
+	}
+}
+
+// 读不到窗口内第一个区块时返回错误，不按父区块的难度继续
+func TestNextDifficultyMissingAncestor(t *testing.T) {
+	headers := retargetChain(10, every(TARGET_BLOCK_INTERVAL))
+	if _, err := NextDifficulty(headers[9], headerGetter(nil)); err == nil {
+		t.Fatal("期望读取祖先区块失败")
+	}
+}
@@ -0,0 +1,163 @@
+package block
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+)
+
+// 导出文件格式：
+//
+//	魔数 "JHCHAIN\x00" | 版本(uint16 大端) | 区块数(uint64 大端) | 区块记录...
+//
+// 区块记录：长度(uint32 大端) | 区块的 MarshalBinary 编码。
+// 版本 2 起交易带有公钥和签名；版本 1 的文件中没有签名，无法通过校验，不再支持。
+// 版本 3 在区块末尾增加了权威证明的出块签名，版本 4 的交易带有交易费，版本 5 的交易带有链 ID，版本 6 的交易带有发送方交易序号
+const (
+	exportMagic   = "JHCHAIN\x00"
+	EXPORT_FORMAT = 6
+)
+
+// 单个区块记录的最大长度，防止损坏的文件申请过大的内存
+const maxExportRecordSize = 64 << 20
+
+// 导入结果
+type ImportResult struct {
+	// 文件中的区块数
+	Total int
+	// 与本地已有区块相同而跳过的区块数
+	Skipped int
+	// 新写入存储的区块数
+	Imported int
+}
+
+// 把存储中的整条链按顺序写到 w，返回写出的区块数
+func ExportChain(store BlockStore, w io.Writer) (int, error) {
+	head, err := store.Head()
+	if err != nil {
+		return 0, err
+	}
+	count := head.number.Uint64() + 1
+
+	bw := bufio.NewWriter(w)
+	header := make([]byte, len(exportMagic)+2+8)
+	copy(header, exportMagic)
+	binary.BigEndian.PutUint16(header[len(exportMagic):], EXPORT_FORMAT)
+	binary.BigEndian.PutUint64(header[len(exportMagic)+2:], count)
+	if _, err := bw.Write(header); err != nil {
+		return 0, err
+	}
+
+	written := 0
+	var werr error
+	err = store.Iterate(func(b *Block) bool {
+		if uint64(written) == count {
+			return false
+		}
+		m, err := b.MarshalBinary()
+		if err != nil {
+			werr = err
+			return false
+		}
+		var length [4]byte
+		binary.BigEndian.PutUint32(length[:], uint32(len(m)))
+		if _, werr = bw.Write(length[:]); werr != nil {
+			return false
+		}
+		if _, werr = bw.Write(m); werr != nil {
+			return false
+		}
+		written++
+		return true
+	})
+	if err == nil {
+		err = werr
+	}
+	if err != nil {
+		return written, err
+	}
+	if uint64(written) != count {
+		return written, fmt.Errorf("存储中只有 %d 个区块，期望 %d 个", written, count)
+	}
+	return written, bw.Flush()
+}
+
+// 从 r 读取导出文件，逐个完整校验（包括余额）后追加到存储。
+// 存储中已有的区块必须与文件中对应的区块完全相同，只追加更高的区块；
+// 任何一个区块校验失败都会停止导入，之前已写入的区块保留。engine 需与导出链时使用的共识引擎一致
+func ImportChain(store BlockStore, engine ConsensusEngine, r io.Reader) (ImportResult, error) {
+	var result ImportResult
+	br := bufio.NewReader(r)
+
+	header := make([]byte, len(exportMagic)+2+8)
+	if _, err := io.ReadFull(br, header); err != nil {
+		return result, fmt.Errorf("读取文件头失败：%w", err)
+	}
+	if string(header[:len(exportMagic)]) != exportMagic {
+		return result, errors.New("不是区块链导出文件")
+	}
+	if version := binary.BigEndian.Uint16(header[len(exportMagic):]); version != EXPORT_FORMAT {
+		return result, fmt.Errorf("不支持的导出格式版本 %d", version)
+	}
+	count := binary.BigEndian.Uint64(header[len(exportMagic)+2:])
+
+	var prev *Block
+	state := NewStateDB()
+	local, err := store.Head()
+	if err != nil && !errors.Is(err, ErrBlockNotFound) {
+		return result, err
+	}
+
+	var length [4]byte
+	for i := uint64(0); i < count; i++ {
+		if _, err := io.ReadFull(br, length[:]); err != nil {
+			return result, fmt.Errorf("读取第 %d 个区块失败：%w", i, err)
+		}
+		size := binary.BigEndian.Uint32(length[:])
+		if size > maxExportRecordSize {
+			return result, fmt.Errorf("第 %d 个区块长度 %d 超过上限", i, size)
+		}
+		m := make([]byte, size)
+		if _, err := io.ReadFull(br, m); err != nil {
+			return result, fmt.Errorf("读取第 %d 个区块失败：%w", i, err)
+		}
+		b := new(Block)
+		if err := b.UnmarshalBinary(m); err != nil {
+			return result, fmt.Errorf("解码第 %d 个区块失败：%w", i, err)
+		}
+		result.Total++
+
+		if err := VerifyBlock(engine, prev, b, store.GetByNumber); err != nil {
+			return result, err
+		}
+		if err := VerifyBalances(b, state); err != nil {
+			return result, err
+		}
+		if local != nil && i <= local.number.Uint64() {
+			existing, err := store.GetByNumber(i)
+			if err != nil {
+				return result, err
+			}
+			if existing.hash != b.hash || !bytes.Equal(existing.seal, b.seal) {
+				return result, fmt.Errorf("区块 %d 与本地区块不同，无法导入", i)
+			}
+			result.Skipped++
+		} else {
+			if err := store.Append(b); err != nil {
+				return result, err
+			}
+			result.Imported++
+		}
+		if err := state.ApplyBlock(b); err != nil {
+			return result, err
+		}
+		prev = b
+	}
+	if _, err := br.ReadByte(); err != io.EOF {
+		return result, errors.New("文件末尾有多余的数据")
+	}
+	return result, nil
+}
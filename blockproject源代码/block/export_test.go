@@ -0,0 +1,141 @@
+package block
+
+import (
+	"bytes"
+	"encoding/binary"
+	"testing"
+)
+
+// 在内存存储上挖出带一笔转账的短链，返回区块链和它的存储
+func minedTestChain(t *testing.T, blocks int) (*Blockchain, BlockStore) {
+	t.Helper()
+	store := NewMemoryStore()
+	return mineTestChain(t, store, blocks), store
+}
+
+// 在 store 上挖出 blocks 个区块，第 2 个区块带一笔转账
+func mineTestChain(t *testing.T, store BlockStore, blocks int) *Blockchain {
+	t.Helper()
+	return mineTestChainBy(t, store, newTestAccount(t), blocks)
+}
+
+// 由 miner 在 store 上挖出 blocks 个区块，第 2 个区块带一笔 miner 转给 recipient 的 100，交易费 1
+func mineTestChainBy(t *testing.T, store BlockStore, miner *testAccount, blocks int) *Blockchain {
+	t.Helper()
+	maturity := COINBASE_MATURITY
+	COINBASE_MATURITY = 0
+	t.Cleanup(func() { COINBASE_MATURITY = maturity })
+
+	bc, err := NewBlockchainWithStore(miner.address, 5000, store)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i := 0; i < blocks; i++ {
+		if i == 1 && !miner.send(t, bc, "recipient", 100, 1, 0) {
+			t.Fatal("转账没有进入交易池")
+		}
+		if !bc.Mining() {
+			t.Fatalf("第 %d 个区块挖矿失败", i+1)
+		}
+	}
+	return bc
+}
+
+func exportTestChain(t *testing.T, store BlockStore) []byte {
+	t.Helper()
+	var buf bytes.Buffer
+	n, err := ExportChain(store, &buf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	head, _ := store.Head()
+	if uint64(n) != head.number.Uint64()+1 {
+		t.Fatalf("导出 %d 个区块，链高 %v", n, head.number)
+	}
+	return buf.Bytes()
+}
+
+// 导出后导入到空存储，区块和账户状态与原链一致；再次导入同一个文件时全部跳过
+func TestExportImportRoundTrip(t *testing.T) {
+	bc, store := minedTestChain(t, 3)
+	data := exportTestChain(t, store)
+
+	target := NewMemoryStore()
+	result, err := ImportChain(target, bc.Engine(), bytes.NewReader(data))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if result.Total != 4 || result.Imported != 4 || result.Skipped != 0 {
+		t.Fatalf("导入结果 %+v", result)
+	}
+	for n := uint64(0); n < 4; n++ {
+		want, _ := store.GetByNumber(n)
+		got, err := target.GetByNumber(n)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if got.hash != want.hash || len(got.transactions) != len(want.transactions) {
+			t.Fatalf("区块 %d 与原链不同", n)
+		}
+		for i, tx := range want.transactions {
+			g := got.transactions[i]
+			if g.hash != tx.hash ||
+				!bytes.Equal(publicKeyBytes(g.senderPublicKey), publicKeyBytes(tx.senderPublicKey)) ||
+				!bytes.Equal(signatureBytes(g.signature), signatureBytes(tx.signature)) {
+				t.Fatalf("区块 %d 第 %d 笔交易与原链不同", n, i)
+			}
+		}
+	}
+
+	imported, err := NewBlockchainWithStore(bc.blockchainAddress, 5001, target)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, addr := range []string{bc.blockchainAddress, "recipient"} {
+		if got, want := imported.CalculateTotalAmount(addr), bc.CalculateTotalAmount(addr); got.Cmp(want) != 0 {
+			t.Errorf("%s 的余额 %v，原链为 %v", addr, got, want)
+		}
+	}
+
+	result, err = ImportChain(target, bc.Engine(), bytes.NewReader(data))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if result.Skipped != 4 || result.Imported != 0 {
+		t.Fatalf("重复导入结果 %+v", result)
+	}
+}
+
+func TestImportRejectsBadFiles(t *testing.T) {
+	bc, store := minedTestChain(t, 2)
+	data := exportTestChain(t, store)
+	_, otherStore := minedTestChain(t, 1)
+
+	badMagic := append([]byte(nil), data...)
+	badMagic[0] = 'X'
+	badVersion := append([]byte(nil), data...)
+	binary.BigEndian.PutUint16(badVersion[len(exportMagic):], EXPORT_FORMAT+1)
+	damaged := append([]byte(nil), data...)
+	// 最后一个区块记录的末尾是出块签名的长度，工作量证明的区块为 0，改成 1 后记录长度不够
+	damaged[len(damaged)-1] ^= 0x01
+
+	tests := []struct {
+		name  string
+		data  []byte
+		store BlockStore
+	}{
+		{"魔数错误", badMagic, NewMemoryStore()},
+		{"版本错误", badVersion, NewMemoryStore()},
+		{"截断的文件", data[:len(data)-10], NewMemoryStore()},
+		{"末尾有多余数据", append(append([]byte(nil), data...), 0), NewMemoryStore()},
+		{"区块记录损坏", damaged, NewMemoryStore()},
+		{"与本地链不同", data, otherStore},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if _, err := ImportChain(tt.store, bc.Engine(), bytes.NewReader(tt.data)); err == nil {
+				t.Fatal("期望导入失败")
+			}
+		})
+	}
+}
@@ -0,0 +1,169 @@
+package block
+
+import (
+	"encoding/json"
+	"math/big"
+	"sort"
+)
+
+const (
+	// 估算交易费时统计最近多少个区块
+	FEE_ESTIMATE_BLOCKS = 20
+	// 交易费率的单位：每 FEE_RATE_UNIT 字节的交易费
+	FEE_RATE_UNIT = 1000
+)
+
+// 区块 number 的矿工可以领取的总额：区块奖励加上 txs 中普通交易的交易费
+func minerReward(number uint64, txs []*Transaction) *big.Int {
+	total := BlockReward(number)
+	for _, t := range txs {
+		if !t.IsCoinbase() && t.fee != nil {
+			total.Add(total, t.fee)
+		}
+	}
+	return total
+}
+
+// 交易的费率，按 FEE_RATE_UNIT 字节向上取整
+func feeRate(fee *big.Int, size int) *big.Int {
+	rate := new(big.Int).Mul(fee, big.NewInt(FEE_RATE_UNIT))
+	s := big.NewInt(int64(size))
+	rate.Add(rate, s).Sub(rate, big.NewInt(1))
+	return rate.Div(rate, s)
+}
+
+// 选出可以打包进下一个区块的交易，保证区块能通过 VerifyBalances。
+// 区块的奖励由矿工打包时自己添加，交易池里不会有挖矿奖励交易；
+// 普通交易按费率（交易费 / 编码长度）从高到低选取，费率相同时保持交易池顺序，
+// 总长度不超过 MAX_BLOCK_SIZE - BLOCK_SIZE_RESERVE，数量为挖矿奖励交易留出一个位置。
+// 同一发送方的交易按交易序号依次打包，序号靠后的交易和发送方余额暂时不足的交易在其他交易选定后重试，
+// 仍不能打包的交易和超出限制的交易留在交易池中等待下一个区块
+func (bc *Blockchain) selectTransactions() []*Transaction {
+	running := make(map[string]*big.Int)
+	balance := func(addr string) *big.Int {
+		v, ok := running[addr]
+		if !ok {
+			v = bc.state.Spendable(addr)
+			running[addr] = v
+		}
+		return v
+	}
+	nonces := make(map[string]uint64)
+	nonce := func(addr string) uint64 {
+		n, ok := nonces[addr]
+		if !ok {
+			n = bc.state.Nonce(addr)
+			nonces[addr] = n
+		}
+		return n
+	}
+	type candidate struct {
+		t    *Transaction
+		size int
+	}
+	selected := make([]*Transaction, 0)
+	candidates := make([]candidate, 0)
+	space := MAX_BLOCK_SIZE - BLOCK_SIZE_RESERVE
+	slots := MAX_BLOCK_TXS - 1
+	for _, t := range bc.CopyTransactionPool() {
+		candidates = append(candidates, candidate{t, t.Size()})
+	}
+	// 比较 fee_i / size_i 与 fee_j / size_j，交叉相乘避免取整
+	sort.SliceStable(candidates, func(i, j int) bool {
+		a := new(big.Int).Mul(candidates[i].t.fee, big.NewInt(int64(candidates[j].size)))
+		b := new(big.Int).Mul(candidates[j].t.fee, big.NewInt(int64(candidates[i].size)))
+		return a.Cmp(b) > 0
+	})
+
+	for len(candidates) > 0 && slots > 0 {
+		waiting := candidates[:0:0]
+		for _, c := range candidates {
+			t := c.t
+			if c.size > space || slots == 0 || t.nonce < nonce(t.senderAddress) {
+				continue
+			}
+			if t.nonce > nonce(t.senderAddress) || balance(t.senderAddress).Cmp(t.cost()) < 0 {
+				waiting = append(waiting, c)
+				continue
+			}
+			nonces[t.senderAddress]++
+			balance(t.senderAddress).Sub(balance(t.senderAddress), t.cost())
+			balance(t.receiveAddress).Add(balance(t.receiveAddress), t.value)
+			selected = append(selected, t)
+			space -= c.size
+			slots--
+		}
+		// 这一轮没有选出新交易时，剩下的交易余额都不足或者前面缺少交易序号
+		if len(waiting) == len(candidates) {
+			break
+		}
+		candidates = waiting
+	}
+	return selected
+}
+
+// 根据最近区块中交易的费率估算交易费。
+// Low、Medium、High 分别为费率的第 25、50、90 百分位，单位为每 FEE_RATE_UNIT 字节的交易费；
+// 最近的区块中没有普通交易时都为 0
+type FeeEstimate struct {
+	Blocks  int
+	Samples int
+	Low     *big.Int
+	Medium  *big.Int
+	High    *big.Int
+}
+
+func (fe *FeeEstimate) MarshalJSON() ([]byte, error) {
+	return json.Marshal(struct {
+		Blocks   int      `json:"blocks"`
+		Samples  int      `json:"samples"`
+		Low      *big.Int `json:"low"`
+		Medium   *big.Int `json:"medium"`
+		High     *big.Int `json:"high"`
+		UnitSize int      `json:"unit_bytes"`
+	}{
+		Blocks:   fe.Blocks,
+		Samples:  fe.Samples,
+		Low:      fe.Low,
+		Medium:   fe.Medium,
+		High:     fe.High,
+		UnitSize: FEE_RATE_UNIT,
+	})
+}
+
+// 统计最近 FEE_ESTIMATE_BLOCKS 个区块中普通交易的费率
+func (bc *Blockchain) EstimateFees() (*FeeEstimate, error) {
+	head := bc.LastBlock().number.Uint64()
+	rates := make([]*big.Int, 0)
+	blocks := 0
+	for n := head; blocks < FEE_ESTIMATE_BLOCKS; n-- {
+		b, err := bc.store.GetByNumber(n)
+		if err != nil {
+			return nil, err
+		}
+		blocks++
+		for _, t := range b.transactions {
+			if !t.IsCoinbase() && t.fee != nil {
+				rates = append(rates, feeRate(t.fee, t.Size()))
+			}
+		}
+		if n == 0 {
+			break
+		}
+	}
+	sort.Slice(rates, func(i, j int) bool { return rates[i].Cmp(rates[j]) < 0 })
+	percentile := func(p int) *big.Int {
+		if len(rates) == 0 {
+			return new(big.Int)
+		}
+		// 最近秩法：第 ceil(p% * n) 个样本
+		return new(big.Int).Set(rates[(len(rates)*p+99)/100-1])
+	}
+	return &FeeEstimate{
+		Blocks:  blocks,
+		Samples: len(rates),
+		Low:     percentile(25),
+		Medium:  percentile(50),
+		High:    percentile(90),
+	}, nil
+}
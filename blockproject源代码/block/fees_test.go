@@ -0,0 +1,158 @@
+package block
+
+import (
+	"errors"
+	"math/big"
+	"sort"
+	"testing"
+)
+
+// 矿工出块后给 n 个新账户各转 1000，返回这些账户
+func fundedAccounts(t *testing.T, n int) (*Blockchain, *testAccount, []*testAccount) {
+	t.Helper()
+	miner := newTestAccount(t)
+	bc := mineTestChainBy(t, NewMemoryStore(), miner, 2)
+	accounts := make([]*testAccount, 0, n)
+	for i := 0; i < n; i++ {
+		a := newTestAccount(t)
+		if !miner.send(t, bc, a.address, 1000, 0, uint64(i+1)) {
+			t.Fatal("转账没有进入交易池")
+		}
+		accounts = append(accounts, a)
+	}
+	mineBlocks(t, bc, 1)
+	return bc, miner, accounts
+}
+
+// 不同发送方的交易按费率从高到低打包，同一发送方的交易仍按交易序号打包
+func TestSelectTransactionsByFeeRate(t *testing.T) {
+	bc, _, accounts := fundedAccounts(t, 3)
+	a, b, c := accounts[0], accounts[1], accounts[2]
+	a.send(t, bc, "recipient", 10, 1, 0)
+	b.send(t, bc, "recipient", 10, 5, 0)
+	c.send(t, bc, "recipient", 10, 3, 0)
+	// a 的第二笔交易费率最高，但要等 a 的第一笔之后
+	a.send(t, bc, "recipient", 10, 9, 1)
+
+	selected := bc.selectTransactions()
+	got := make([]string, 0, len(selected))
+	for _, tx := range selected {
+		got = append(got, tx.senderAddress+":"+tx.fee.String())
+	}
+	want := []string{b.address + ":5", c.address + ":3", a.address + ":1", a.address + ":9"}
+	if len(got) != len(want) {
+		t.Fatalf("打包了 %d 笔交易，期望 %d 笔", len(got), len(want))
+	}
+	for i := range want {
+		if got[i] != want[i] {
+			t.Fatalf("打包顺序 %v，期望 %v", got, want)
+		}
+	}
+}
+
+// 挖矿奖励交易的金额是区块奖励加上打包交易的交易费
+func TestCoinbaseCollectsFees(t *testing.T) {
+	bc, miner, accounts := fundedAccounts(t, 2)
+	accounts[0].send(t, bc, "recipient", 10, 7, 0)
+	accounts[1].send(t, bc, "recipient", 10, 4, 0)
+	before := bc.CalculateTotalAmount(miner.address)
+	mineBlocks(t, bc, 1)
+
+	b := bc.LastBlock()
+	reward := BlockReward(b.number.Uint64())
+	want := new(big.Int).Add(reward, big.NewInt(11))
+	var coinbase *Transaction
+	for _, tx := range b.transactions {
+		if tx.IsCoinbase() {
+			coinbase = tx
+		}
+	}
+	if coinbase == nil || coinbase.receiveAddress != miner.address || coinbase.value.Cmp(want) != 0 {
+		t.Fatalf("挖矿奖励交易 %+v，期望给矿工 %v", coinbase, want)
+	}
+	if got := new(big.Int).Sub(bc.CalculateTotalAmount(miner.address), before); got.Cmp(want) != 0 {
+		t.Fatalf("矿工余额增加 %v，期望 %v", got, want)
+	}
+}
+
+// 交易费不能为负，挖矿奖励交易不能带交易费
+func TestRejectInvalidFee(t *testing.T) {
+	bc, miner, _ := fundedAccounts(t, 0)
+	tx := miner.sign(t, "recipient", 10, -1, 1)
+	if err := verifyTransaction(tx); !errors.Is(err, ErrTxValue) {
+		t.Fatalf("交易费为负时校验结果 %v", err)
+	}
+	if bc.AddTransaction(miner.address, "recipient", tx.value, tx.fee, 1, tx.senderPublicKey, tx.signature) {
+		t.Fatal("交易费为负的交易不应进入交易池")
+	}
+
+	coinbase := NewCoinbaseTransaction(3, miner.address, big.NewInt(5000))
+	coinbase.fee = big.NewInt(1)
+	coinbase.hash = coinbase.Hash()
+	if err := verifyTransaction(coinbase); !errors.Is(err, ErrCoinbase) {
+		t.Fatalf("挖矿奖励交易带交易费时校验结果 %v", err)
+	}
+}
+
+// 估算值取最近区块中普通交易费率的第 25、50、90 百分位
+func TestEstimateFees(t *testing.T) {
+	bc, _, accounts := fundedAccounts(t, 4)
+	for i, a := range accounts {
+		a.send(t, bc, "recipient", 10, int64(100*(i+1)), 0)
+	}
+	mineBlocks(t, bc, 1)
+
+	rates := make([]*big.Int, 0)
+	bc.store.Iterate(func(b *Block) bool {
+		for _, tx := range b.transactions {
+			if !tx.IsCoinbase() {
+				rates = append(rates, feeRate(tx.fee, tx.Size()))
+			}
+		}
+		return true
+	})
+	sort.Slice(rates, func(i, j int) bool { return rates[i].Cmp(rates[j]) < 0 })
+	// 区块 2 的转账、给 4 个账户的转账和它们的 4 笔转账，共 9 笔
+	if len(rates) != 9 {
+		t.Fatalf("链上有 %d 笔普通交易，期望 9 笔", len(rates))
+	}
+
+	estimate, err := bc.EstimateFees()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if estimate.Blocks != 5 || estimate.Samples != 9 {
+		t.Fatalf("统计了 %d 个区块、%d 笔交易，期望 5 个、9 笔", estimate.Blocks, estimate.Samples)
+	}
+	// 最近秩法：9 笔交易的第 25、50、90 百分位分别是第 3、5、9 笔
+	for _, c := range []struct {
+		name string
+		got  *big.Int
+		want *big.Int
+	}{
+		{"low", estimate.Low, rates[2]},
+		{"medium", estimate.Medium, rates[4]},
+		{"high", estimate.High, rates[8]},
+	} {
+		if c.got.Cmp(c.want) != 0 {
+			t.Errorf("%s 为 %v，期望 %v", c.name, c.got, c.want)
+		}
+	}
+}
+
+// 最近的区块中没有普通交易时估算值都为 0
+func TestEstimateFeesEmpty(t *testing.T) {
+	bc, err := NewBlockchainWithStore("miner", 5000, NewMemoryStore())
+	if err != nil {
+		t.Fatal(err)
+	}
+	mineBlocks(t, bc, 2)
+	estimate, err := bc.EstimateFees()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if estimate.Blocks != 3 || estimate.Samples != 0 ||
+		estimate.Low.Sign() != 0 || estimate.Medium.Sign() != 0 || estimate.High.Sign() != 0 {
+		t.Fatalf("估算结果 %+v", estimate)
+	}
+}
@@ -0,0 +1,149 @@
+package block
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+)
+
+// 区块得到多少个确认后视为最终确定，不再考虑被分叉替换。
+// 区块本身算 1 个确认，之后每接一个区块加 1。这是本节点的判断标准，不影响区块校验：
+// 本节点不会切换到在最终确定区块或之前分叉的链，即使那条链更重。可以用启动参数修改
+var FINALITY_CONFIRMATIONS uint64 = 6
+
+var ErrFinalizedReorg = errors.New("reorg below finalized block")
+
+// 区块在本地链上的确认情况
+type Confirmation struct {
+	Number        uint64
+	BlockHash     [32]byte
+	Confirmations uint64
+	Finalized     bool
+}
+
+// 高度为 head 时区块 number 的确认数
+func confirmationsAt(number uint64, head uint64) uint64 {
+	if number > head {
+		return 0
+	}
+	return head - number + 1
+}
+
+// 区块 number 的确认数和是否已经最终确定
+func (bc *Blockchain) ConfirmationOf(number uint64) (*Confirmation, error) {
+	head := bc.LastBlock().number.Uint64()
+	b, err := bc.store.GetByNumber(number)
+	if err != nil {
+		return nil, err
+	}
+	return newConfirmation(b, head), nil
+}
+
+// 交易所在区块的确认情况，交易不在链上时返回 ErrTransactionNotFound
+func (bc *Blockchain) TransactionConfirmation(hash [32]byte) (*Confirmation, error) {
+	head := bc.LastBlock().number.Uint64()
+	loc, err := bc.store.GetTxLocation(hash)
+	if err != nil {
+		return nil, err
+	}
+	b, err := bc.store.GetByNumber(loc.Number)
+	if err != nil {
+		return nil, err
+	}
+	return newConfirmation(b, head), nil
+}
+
+func newConfirmation(b *Block, head uint64) *Confirmation {
+	n := confirmationsAt(b.number.Uint64(), head)
+	// 创世纪块由链配置确定，总是最终确定的
+	return &Confirmation{
+		Number:        b.number.Uint64(),
+		BlockHash:     b.hash,
+		Confirmations: n,
+		Finalized:     n >= FINALITY_CONFIRMATIONS || b.number.Sign() == 0,
+	}
+}
+
+// 最新的最终确定区块：确认数达到 FINALITY_CONFIRMATIONS 的最高区块，链不够长时为创世纪块
+func (bc *Blockchain) FinalizedBlock() (*Block, error) {
+	return bc.store.GetByNumber(finalizedNumber(bc.LastBlock().number.Uint64()))
+}
+
+// 链高为 head 时最新的最终确定区块的区块号
+func finalizedNumber(head uint64) uint64 {
+	if FINALITY_CONFIRMATIONS == 0 {
+		return head
+	}
+	if head+1 >= FINALITY_CONFIRMATIONS {
+		return head + 1 - FINALITY_CONFIRMATIONS
+	}
+	return 0
+}
+
+// 检查从区块号 fork 开始替换本地链是否会替换最终确定的区块，只在链尾之后追加区块时总是允许
+func (bc *Blockchain) checkFinality(fork uint64) error {
+	head := bc.LastBlock().number.Uint64()
+	if fork > head {
+		return nil
+	}
+	if finalized := finalizedNumber(head); fork <= finalized {
+		return fmt.Errorf("分叉点 %d 不晚于最终确定的区块 %d：%w", fork, finalized, ErrFinalizedReorg)
+	}
+	return nil
+}
+
+// 本节点的最终确定头：最新的最终确定区块和当前链高
+type FinalizedHead struct {
+	Block *Block
+	Head  uint64
+}
+
+func (bc *Blockchain) Finalized() (*FinalizedHead, error) {
+	head := bc.LastBlock().number.Uint64()
+	b, err := bc.FinalizedBlock()
+	if err != nil {
+		return nil, err
+	}
+	return &FinalizedHead{Block: b, Head: head}, nil
+}
+
+func (f *FinalizedHead) MarshalJSON() ([]byte, error) {
+	number := f.Block.number.Uint64()
+	return json.Marshal(struct {
+		Number                uint64 `json:"number"`
+		Hash                  string `json:"hash"`
+		Timestamp             int64  `json:"timestamp"`
+		Head                  uint64 `json:"head"`
+		Confirmations         uint64 `json:"confirmations"`
+		RequiredConfirmations uint64 `json:"required_confirmations"`
+	}{
+		Number:                number,
+		Hash:                  fmt.Sprintf("%x", f.Block.hash),
+		Timestamp:             f.Block.timestamp,
+		Head:                  f.Head,
+		Confirmations:         confirmationsAt(number, f.Head),
+		RequiredConfirmations: FINALITY_CONFIRMATIONS,
+	})
+}
+
+// 在 JSON 对象 m 中加入确认数和是否最终确定，用于区块和交易的查询结果
+func (c *Confirmation) AppendTo(m []byte) ([]byte, error) {
+	fields := make(map[string]json.RawMessage)
+	if err := json.Unmarshal(m, &fields); err != nil {
+		return nil, err
+	}
+	extra := map[string]interface{}{
+		"block_number":  c.Number,
+		"block_hash":    fmt.Sprintf("%x", c.BlockHash),
+		"confirmations": c.Confirmations,
+		"finalized":     c.Finalized,
+	}
+	for k, v := range extra {
+		raw, err := json.Marshal(v)
+		if err != nil {
+			return nil, err
+		}
+		fields[k] = raw
+	}
+	return json.Marshal(fields)
+}
@@ -0,0 +1,137 @@
+package block
+
+import (
+	"errors"
+	"testing"
+)
+
+// 在测试期间使用 n 个确认的最终确定标准
+func setFinality(t *testing.T, n uint64) {
+	t.Helper()
+	old := FINALITY_CONFIRMATIONS
+	FINALITY_CONFIRMATIONS = n
+	t.Cleanup(func() { FINALITY_CONFIRMATIONS = old })
+}
+
+func TestConfirmations(t *testing.T) {
+	setFinality(t, 3)
+	bc, store := minedTestChain(t, 7)
+	for n := uint64(0); n <= 7; n++ {
+		c, err := bc.ConfirmationOf(n)
+		if err != nil {
+			t.Fatal(err)
+		}
+		b, _ := store.GetByNumber(n)
+		want := 8 - n
+		if c.Number != n || c.BlockHash != b.hash || c.Confirmations != want {
+			t.Errorf("区块 %d 的确认情况 %+v，期望 %d 个确认", n, c, want)
+		}
+		if c.Finalized != (n <= 5) {
+			t.Errorf("区块 %d 有 %d 个确认，最终确定为 %v", n, c.Confirmations, c.Finalized)
+		}
+	}
+	if _, err := bc.ConfirmationOf(8); !errors.Is(err, ErrBlockNotFound) {
+		t.Fatalf("链尾之后的区块返回 %v", err)
+	}
+
+	b, _ := store.GetByNumber(2)
+	var transfer *Transaction
+	for _, tx := range b.transactions {
+		if !tx.IsCoinbase() {
+			transfer = tx
+		}
+	}
+	c, err := bc.TransactionConfirmation(transfer.hash)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if c.Number != 2 || c.Confirmations != 6 || !c.Finalized {
+		t.Fatalf("区块 2 中交易的确认情况 %+v", c)
+	}
+	if _, err := bc.TransactionConfirmation([32]byte{1}); !errors.Is(err, ErrTransactionNotFound) {
+		t.Fatalf("不在链上的交易返回 %v", err)
+	}
+}
+
+// 最终确定区块随链高和确认数要求移动，链不够长时为创世纪块，确认数为 0 时为链尾
+func TestFinalizedBlock(t *testing.T) {
+	bc, _ := minedTestChain(t, 7)
+	tests := []struct {
+		confirmations uint64
+		want          uint64
+	}{
+		{0, 7},
+		{1, 7},
+		{3, 5},
+		{8, 0},
+		{20, 0},
+	}
+	for _, tt := range tests {
+		setFinality(t, tt.confirmations)
+		f, err := bc.Finalized()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if got := f.Block.number.Uint64(); got != tt.want || f.Head != 7 {
+			t.Errorf("要求 %d 个确认时最终确定区块 %d、链高 %d，期望 %d、7", tt.confirmations, got, f.Head, tt.want)
+		}
+	}
+
+	setFinality(t, 3)
+	mineBlocks(t, bc, 1)
+	if b, _ := bc.FinalizedBlock(); b.number.Uint64() != 6 {
+		t.Fatalf("出块后最终确定区块 %v，期望 6", b.number)
+	}
+}
+
+// 本地链在区块 2 之后出了 3 个区块，邻居在同一位置分叉出 4 个区块。
+// 分叉点 3 已经最终确定时拒绝切换，否则切换到邻居更重的链
+func TestReorgBelowFinalized(t *testing.T) {
+	tests := []struct {
+		name          string
+		confirmations uint64
+		replaced      bool
+	}{
+		{"分叉点已最终确定", 3, false},
+		{"分叉点尚未最终确定", 4, true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			setFinality(t, tt.confirmations)
+			local, store := minedTestChain(t, 2)
+			peer := forkPeer(t, store)
+			mineBlocks(t, peer, 4)
+			mineBlocks(t, local, 3)
+			head := local.LastBlock().hash
+
+			branch := make([]*Block, 0)
+			for n := uint64(3); n <= 6; n++ {
+				b, _ := peer.GetBlockByNumber(n)
+				branch = append(branch, b)
+			}
+			err := local.ReorganizeFrom(3, branch)
+			if tt.replaced && err != nil {
+				t.Fatal(err)
+			}
+			if !tt.replaced {
+				if !errors.Is(err, ErrFinalizedReorg) {
+					t.Fatalf("替换最终确定的区块返回 %v，期望 %v", err, ErrFinalizedReorg)
+				}
+				if local.LastBlock().hash != head || local.state.Height() != 5 {
+					t.Fatal("拒绝切换后本地链发生了变化")
+				}
+				if resolveWith(t, local, peer) || local.LastBlock().hash != head {
+					t.Fatal("同步时切换到了在最终确定区块处分叉的链")
+				}
+				// 在链尾之后追加区块不替换任何区块，总是允许
+				if err := local.checkFinality(6); err != nil {
+					t.Fatal(err)
+				}
+				return
+			}
+			if local.LastBlock().hash != peer.LastBlock().hash {
+				t.Fatal("没有切换到邻居的链")
+			}
+		})
+	}
+}
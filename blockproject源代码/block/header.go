@@ -0,0 +1,240 @@
+package block
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"math/big"
+)
+
+// 每次请求最多返回的区块头数量
+const MAX_HEADERS_PER_REQUEST = 500
+
+// 区块定位器最多包含的哈希数，链尾的 LOCATOR_DENSE 个区块逐个列出，之后间隔每次翻倍，
+// 2^64 个区块也只需要七十多个哈希
+const (
+	MAX_LOCATOR_HASHES = 128
+	LOCATOR_DENSE      = 10
+)
+
+// 区块头：区块中参与哈希计算的字段，不包含交易。
+// 交易通过 Merkle 根与区块头绑定，同步时可以先下载并校验区块头，再只下载缺少的区块体
+type BlockHeader struct {
+	number       *big.Int
+	timestamp    int64
+	previousHash [32]byte
+	merkleRoot   [32]byte
+	difficulty   *big.Int
+	nonce        *big.Int
+	hash         [32]byte
+	// 出块签名，见 Block.seal
+	seal []byte
+}
+
+// 按区块号读取区块头，与 BlockGetter 对应，校验区块头链时计算难度使用
+type HeaderGetter func(number uint64) (*BlockHeader, error)
+
+// 把按区块号读取区块的函数转换为读取区块头的函数
+func headersOf(get BlockGetter) HeaderGetter {
+	return func(number uint64) (*BlockHeader, error) {
+		b, err := get(number)
+		if err != nil {
+			return nil, err
+		}
+		return b.Header(), nil
+	}
+}
+
+// 区块的区块头，与区块共用区块号、难度和 nonce，调用方不应修改
+func (b *Block) Header() *BlockHeader {
+	return &BlockHeader{
+		number:       b.number,
+		timestamp:    b.timestamp,
+		previousHash: b.previousHash,
+		merkleRoot:   b.merkleRoot,
+		difficulty:   b.difficulty,
+		nonce:        b.nonce,
+		hash:         b.hash,
+		seal:         b.seal,
+	}
+}
+
+// 用区块头和区块体组装区块，交易的 Merkle 根必须与区块头一致
+func NewBlockFromHeader(h *BlockHeader, txs []*Transaction) (*Block, error) {
+	if MerkleRoot(txs) != h.merkleRoot {
+		return nil, fmt.Errorf("区块 %v 的交易与区块头的 Merkle 根不符", h.number)
+	}
+	if len(txs) > MAX_BLOCK_TXS {
+		return nil, fmt.Errorf("区块 %v 的交易数量 %d 超过上限 %d", h.number, len(txs), MAX_BLOCK_TXS)
+	}
+	return &Block{
+		nonce:        h.nonce,
+		previousHash: h.previousHash,
+		timestamp:    h.timestamp,
+		transactions: txs,
+		merkleRoot:   h.merkleRoot,
+		number:       h.number,
+		difficulty:   h.difficulty,
+		hash:         h.hash,
+		txSize:       uint16(len(txs)),
+		seal:         h.seal,
+	}, nil
+}
+
+func (h *BlockHeader) Number() *big.Int {
+	return h.number
+}
+
+// 区块头中记录的区块哈希
+func (h *BlockHeader) BlockHash() [32]byte {
+	return h.hash
+}
+
+// 根据区块头的内容计算哈希，见 Encode
+func (h *BlockHeader) Hash() [32]byte {
+	return sha256.Sum256(h.Encode())
+}
+
+// 区块头的工作量：找到满足难度要求的哈希平均需要尝试的次数，即 2^256 / (target + 1)。
+// 难度不合法的区块工作量为 0
+func (h *BlockHeader) Work() *big.Int {
+	target := proofTarget(h.difficulty)
+	if target == nil {
+		return new(big.Int)
+	}
+	work := new(big.Int).Lsh(big.NewInt(1), 256)
+	return work.Div(work, target.Add(target, big.NewInt(1)))
+}
+
+func (h *BlockHeader) validProof() bool {
+	target := proofTarget(h.difficulty)
+	if target == nil {
+		return false
+	}
+	return target.Cmp(bytesToBigInt(h.Hash())) > 0
+}
+
+func (h *BlockHeader) MarshalJSON() ([]byte, error) {
+	return json.Marshal(struct {
+		Number       *big.Int `json:"number"`
+		Timestamp    int64    `json:"timestamp"`
+		PreviousHash string   `json:"previous_hash"`
+		MerkleRoot   string   `json:"merkle_root"`
+		Difficulty   *big.Int `json:"difficulty"`
+		Nonce        *big.Int `json:"nonce"`
+		Hash         string   `json:"hash"`
+		Seal         string   `json:"seal,omitempty"`
+	}{
+		Number:       h.number,
+		Timestamp:    h.timestamp,
+		PreviousHash: fmt.Sprintf("%x", h.previousHash),
+		MerkleRoot:   fmt.Sprintf("%x", h.merkleRoot),
+		Difficulty:   h.difficulty,
+		Nonce:        h.nonce,
+		Hash:         fmt.Sprintf("%x", h.hash),
+		Seal:         hex.EncodeToString(h.seal),
+	})
+}
+
+func (h *BlockHeader) UnmarshalJSON(data []byte) error {
+	var v struct {
+		Number       *big.Int `json:"number"`
+		Timestamp    int64    `json:"timestamp"`
+		PreviousHash string   `json:"previous_hash"`
+		MerkleRoot   string   `json:"merkle_root"`
+		Difficulty   *big.Int `json:"difficulty"`
+		Nonce        *big.Int `json:"nonce"`
+		Hash         string   `json:"hash"`
+		Seal         string   `json:"seal"`
+	}
+	if err := json.Unmarshal(data, &v); err != nil {
+		return err
+	}
+	if v.Number == nil || v.Difficulty == nil || v.Nonce == nil {
+		return fmt.Errorf("区块头缺少 number、difficulty 或 nonce")
+	}
+	h.number = v.Number
+	h.timestamp = v.Timestamp
+	h.difficulty = v.Difficulty
+	h.nonce = v.Nonce
+	for _, f := range []struct {
+		name  string
+		value string
+		dst   *[32]byte
+	}{
+		{"previous_hash", v.PreviousHash, &h.previousHash},
+		{"merkle_root", v.MerkleRoot, &h.merkleRoot},
+		{"hash", v.Hash, &h.hash},
+	} {
+		p, err := decodeHexField(f.value, 32, f.name)
+		if err != nil {
+			return err
+		}
+		if len(p) != 32 {
+			return fmt.Errorf("区块头缺少 %s", f.name)
+		}
+		copy(f.dst[:], p)
+	}
+	h.seal = nil
+	if v.Seal != "" {
+		seal, err := hex.DecodeString(v.Seal)
+		if err != nil {
+			return fmt.Errorf("非法的 seal %q", v.Seal)
+		}
+		h.seal = seal
+	}
+	return nil
+}
+
+// 区块体：区块中的交易
+type BlockBody struct {
+	Transactions []*Transaction `json:"transactions"`
+}
+
+// 从 from 开始按顺序返回至多 count 个区块头，count 超过 MAX_HEADERS_PER_REQUEST 时按上限处理
+func (bc *Blockchain) Headers(from uint64, count int) ([]*BlockHeader, error) {
+	if count <= 0 || count > MAX_HEADERS_PER_REQUEST {
+		count = MAX_HEADERS_PER_REQUEST
+	}
+	headers := make([]*BlockHeader, 0, count)
+	for n := from; len(headers) < count; n++ {
+		b, err := bc.store.GetByNumber(n)
+		if err == ErrBlockNotFound {
+			break
+		}
+		if err != nil {
+			return nil, err
+		}
+		headers = append(headers, b.Header())
+	}
+	return headers, nil
+}
+
+// 返回本地链上第一个出现在 locator 中的区块之后的至多 count 个区块头，locator 中的区块都不在本地链上时从创世纪块开始。
+// 存储中只有主链的区块，按哈希能查到的区块就在本地链上
+func (bc *Blockchain) HeadersAfter(locator [][32]byte, count int) ([]*BlockHeader, error) {
+	from := uint64(0)
+	for _, hash := range locator {
+		b, err := bc.store.GetByHash(hash)
+		if errors.Is(err, ErrBlockNotFound) {
+			continue
+		}
+		if err != nil {
+			return nil, err
+		}
+		from = b.number.Uint64() + 1
+		break
+	}
+	return bc.Headers(from, count)
+}
+
+// 返回哈希为 hash 的区块的区块体
+func (bc *Blockchain) BlockBody(hash [32]byte) (*BlockBody, error) {
+	b, err := bc.store.GetByHash(hash)
+	if err != nil {
+		return nil, err
+	}
+	return &BlockBody{Transactions: b.transactions}, nil
+}
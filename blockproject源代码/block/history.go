@@ -0,0 +1,88 @@
+package block
+
+import (
+	"encoding/json"
+	"fmt"
+	"math/big"
+)
+
+// 交易相对于查询地址的方向
+const (
+	DIRECTION_IN   = "in"
+	DIRECTION_OUT  = "out"
+	DIRECTION_SELF = "self"
+)
+
+// 地址交易历史中的一条记录
+type AddressTransaction struct {
+	Transaction *Transaction
+	Location    TxLocation
+	Timestamp   int64
+	Direction   string
+	// 执行完这笔交易后地址的余额
+	Balance *big.Int
+}
+
+func (at *AddressTransaction) MarshalJSON() ([]byte, error) {
+	return json.Marshal(struct {
+		Hash        string   `json:"hash"`
+		BlockNumber uint64   `json:"block_number"`
+		Index       int      `json:"index"`
+		Timestamp   int64    `json:"timestamp"`
+		Direction   string   `json:"direction"`
+		Sender      string   `json:"sender_blockchain_address"`
+		Recipient   string   `json:"recipient_blockchain_address"`
+		Value       *big.Int `json:"value"`
+		Fee         *big.Int `json:"fee"`
+		Balance     *big.Int `json:"balance"`
+	}{
+		Hash:        fmt.Sprintf("%x", at.Transaction.hash),
+		BlockNumber: at.Location.Number,
+		Index:       at.Location.Index,
+		Timestamp:   at.Timestamp,
+		Direction:   at.Direction,
+		Sender:      at.Transaction.senderAddress,
+		Recipient:   at.Transaction.receiveAddress,
+		Value:       at.Transaction.value,
+		Fee:         at.Transaction.fee,
+		Balance:     at.Balance,
+	})
+}
+
+// 按从新到旧的顺序查询地址的交易历史，before 为上一页最后一条记录的位置
+func (bc *Blockchain) AddressHistory(address string, before *TxLocation, limit int) ([]*AddressTransaction, error) {
+	txs, err := bc.store.AddressTransactions(address, before, limit)
+	if err != nil {
+		return nil, err
+	}
+	history := make([]*AddressTransaction, 0, len(txs))
+	// 同一区块的多笔交易只读一次区块
+	var b *Block
+	for _, atx := range txs {
+		if b == nil || b.number.Uint64() != atx.Location.Number {
+			b, err = bc.store.GetByNumber(atx.Location.Number)
+			if err != nil {
+				return nil, err
+			}
+		}
+		if atx.Location.Index >= len(b.transactions) {
+			return nil, fmt.Errorf("地址索引损坏：区块 %d 没有第 %d 笔交易", atx.Location.Number, atx.Location.Index)
+		}
+		t := b.transactions[atx.Location.Index]
+		direction := DIRECTION_IN
+		if t.senderAddress == address {
+			direction = DIRECTION_OUT
+			if t.receiveAddress == address {
+				direction = DIRECTION_SELF
+			}
+		}
+		history = append(history, &AddressTransaction{
+			Transaction: t,
+			Location:    atx.Location,
+			Timestamp:   b.timestamp,
+			Direction:   direction,
+			Balance:     atx.Balance,
+		})
+	}
+	return history, nil
+}
@@ -0,0 +1,74 @@
+package block
+
+import (
+	"fmt"
+	"testing"
+)
+
+// 地址交易历史从新到旧排列，before 为上一页最后一条记录的位置，limit 为每页条数（<= 0 时不限）
+func TestAddressHistoryPaging(t *testing.T) {
+	for _, kind := range []string{STORE_MEMORY, STORE_FILE, STORE_DB} {
+		t.Run(kind, func(t *testing.T) {
+			store, err := OpenStore(kind, t.TempDir(), SYNC_NEVER)
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer store.Close()
+			miner, alice := newTestAccount(t), newTestAccount(t)
+			bc := mineTestChainBy(t, store, miner, 2)
+			send := func(from *testAccount, to string, value, fee int64, nonce uint64) {
+				t.Helper()
+				if !from.send(t, bc, to, value, fee, nonce) {
+					t.Fatal("转账没有进入交易池")
+				}
+			}
+			// 区块 3 收到两笔，区块 4 转出一笔、转给自己一笔，区块 5 再收到一笔
+			send(miner, alice.address, 1000, 0, 1)
+			send(miner, alice.address, 500, 0, 2)
+			mineBlocks(t, bc, 1)
+			send(alice, "bob", 100, 1, 0)
+			send(alice, alice.address, 10, 0, 1)
+			mineBlocks(t, bc, 1)
+			send(miner, alice.address, 7, 0, 3)
+			mineBlocks(t, bc, 1)
+
+			all := []string{"5-0 in 7 1406", "4-1 self 10 1399", "4-0 out 100 1399", "3-1 in 500 1500", "3-0 in 1000 1000"}
+			page := func(before *TxLocation, limit int) []string {
+				t.Helper()
+				history, err := bc.AddressHistory(alice.address, before, limit)
+				if err != nil {
+					t.Fatal(err)
+				}
+				got := make([]string, 0, len(history))
+				for _, h := range history {
+					b, _ := store.GetByNumber(h.Location.Number)
+					if h.Timestamp != b.timestamp {
+						t.Fatalf("记录 %v 的时间戳不是区块的时间戳", h.Location)
+					}
+					got = append(got, fmt.Sprintf("%v %s %v %v", h.Location, h.Direction, h.Transaction.value, h.Balance))
+				}
+				return got
+			}
+			check := func(name string, got []string, want []string) {
+				t.Helper()
+				if fmt.Sprint(got) != fmt.Sprint(want) {
+					t.Fatalf("%s：%q，期望 %q", name, got, want)
+				}
+			}
+
+			check("不限条数", page(nil, 0), all)
+			check("第一页", page(nil, 2), all[:2])
+			check("第二页", page(&TxLocation{Number: 4, Index: 1}, 2), all[2:4])
+			check("最后一页", page(&TxLocation{Number: 3, Index: 1}, 2), all[4:])
+			check("最后一页之后", page(&TxLocation{Number: 3, Index: 0}, 2), []string{})
+			// before 不必是历史中的记录，返回所有位置在它之前的记录
+			check("区块 4 之前", page(&TxLocation{Number: 4, Index: 0}, 0), all[3:])
+			check("链尾之后", page(&TxLocation{Number: 100, Index: 0}, 1), all[:1])
+
+			history, err := bc.AddressHistory("nobody", nil, 10)
+			if err != nil || len(history) != 0 {
+				t.Fatalf("没有交易的地址返回 %d 条记录，%v", len(history), err)
+			}
+		})
+	}
+}
@@ -0,0 +1,11 @@
+package block
+
+// 区块大小的上限：VerifyBody 按编码长度和交易数检查区块，selectTransactions 打包时为区块头和挖矿奖励交易留出空间
+const (
+	// 区块二进制编码（见 Block.MarshalBinary）的长度上限（字节）
+	MAX_BLOCK_SIZE = 1 << 20
+	// 区块中交易数量的上限，含挖矿奖励交易，不能超过 txSize 的范围
+	MAX_BLOCK_TXS = 4096
+	// 打包时为区块头和挖矿奖励交易预留的长度
+	BLOCK_SIZE_RESERVE = 1024
+)
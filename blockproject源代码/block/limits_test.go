@@ -0,0 +1,139 @@
+package block
+
+import (
+	"errors"
+	"fmt"
+	"math/big"
+	"strings"
+	"testing"
+)
+
+// n 笔金额为 0、接收方各不相同的挖矿奖励交易，除数量外都能通过 VerifyBody
+func coinbaseTxs(number uint64, n int) []*Transaction {
+	txs := make([]*Transaction, 0, n)
+	for i := 0; i < n; i++ {
+		txs = append(txs, NewCoinbaseTransaction(number, fmt.Sprintf("miner%d", i), new(big.Int)))
+	}
+	return txs
+}
+
+func TestVerifyBodyTxLimit(t *testing.T) {
+	for _, n := range []int{MAX_BLOCK_TXS, MAX_BLOCK_TXS + 1} {
+		txs := coinbaseTxs(1, n)
+		b := NewBlock(big.NewInt(1), big.NewInt(0), [32]byte{}, txs)
+		err := VerifyBody(b.Header(), txs)
+		if n <= MAX_BLOCK_TXS && err != nil {
+			t.Fatalf("%d 笔交易：%v", n, err)
+		}
+		if n > MAX_BLOCK_TXS && !errors.Is(err, ErrTooManyTxs) {
+			t.Fatalf("%d 笔交易的校验结果 %v，期望 %v", n, err, ErrTooManyTxs)
+		}
+	}
+}
+
+// 用挖矿奖励交易接收方的长度把区块编码凑到 size 字节
+func blockOfSize(t *testing.T, size int) *Block {
+	t.Helper()
+	for pad := size; pad > 0; {
+		tx := NewCoinbaseTransaction(1, strings.Repeat("m", pad), new(big.Int))
+		b := NewBlock(big.NewInt(1), big.NewInt(0), [32]byte{}, []*Transaction{tx})
+		got := b.Size()
+		if got == size {
+			return b
+		}
+		pad -= got - size
+	}
+	t.Fatalf("无法构造长度为 %d 的区块", size)
+	return nil
+}
+
+func TestVerifyBlockSizeLimit(t *testing.T) {
+	for _, size := range []int{MAX_BLOCK_SIZE, MAX_BLOCK_SIZE + 1} {
+		b := blockOfSize(t, size)
+		// 区块没有工作量证明，长度合法时在之后的检查中失败
+		err := VerifyBlock(acceptEngine{}, nil, b, nil)
+		if size <= MAX_BLOCK_SIZE && errors.Is(err, ErrBlockSize) {
+			t.Fatalf("%d 字节的区块：%v", size, err)
+		}
+		if size > MAX_BLOCK_SIZE && !errors.Is(err, ErrBlockSize) {
+			t.Fatalf("%d 字节的区块校验结果 %v，期望 %v", size, err, ErrBlockSize)
+		}
+	}
+}
+
+// 签名一笔编码长度正好为 size 字节的转账，接收方的长度用来凑长度
+func (a *testAccount) signSized(t *testing.T, size int, nonce uint64) *Transaction {
+	t.Helper()
+	for pad, i := size, 0; i < 10; i++ {
+		tx := a.sign(t, strings.Repeat("r", pad), 1, 0, nonce)
+		got := tx.Size()
+		if got == size {
+			return tx
+		}
+		pad -= got - size
+	}
+	t.Fatalf("无法构造长度为 %d 的交易", size)
+	return nil
+}
+
+// 交易池中的交易正好填满可用空间时全部打包，再多一笔时留在交易池中，打包出的区块不超过 MAX_BLOCK_SIZE
+func TestSelectTransactionsSizeLimit(t *testing.T) {
+	const fit = 4
+	size := (MAX_BLOCK_SIZE - BLOCK_SIZE_RESERVE) / fit
+	for _, n := range []int{fit, fit + 1} {
+		t.Run(fmt.Sprint(n), func(t *testing.T) {
+			miner := newTestAccount(t)
+			bc := mineTestChainBy(t, NewMemoryStore(), miner, 1)
+			for i := 0; i < n; i++ {
+				tx := miner.signSized(t, size, uint64(i))
+				if !bc.AddTransaction(miner.address, tx.receiveAddress, tx.value, tx.fee, tx.nonce, tx.senderPublicKey, tx.signature) {
+					t.Fatal("转账没有进入交易池")
+				}
+			}
+			if got := len(bc.selectTransactions()); got != fit {
+				t.Fatalf("打包了 %d 笔交易，期望 %d 笔", got, fit)
+			}
+			prev := bc.LastBlock()
+			mineBlocks(t, bc, 1)
+			b := bc.LastBlock()
+			if err := VerifyBlock(bc.Engine(), prev, b, bc.store.GetByNumber); err != nil {
+				t.Fatalf("打包出的区块（%d 字节）校验失败：%v", b.Size(), err)
+			}
+			if got := len(bc.TransactionPool()); got != n-fit {
+				t.Fatalf("交易池剩下 %d 笔交易，期望 %d 笔", got, n-fit)
+			}
+		})
+	}
+}
+
+// 交易池中的交易数达到 MAX_BLOCK_TXS-1 时全部打包，再多一笔时留在交易池中，挖矿奖励交易占最后一个位置
+func TestSelectTransactionsCountLimit(t *testing.T) {
+	fit := MAX_BLOCK_TXS - 1
+	miner := newTestAccount(t)
+	bc := mineTestChainBy(t, NewMemoryStore(), miner, 1)
+	for i := 0; i < fit+1; i++ {
+		if !miner.send(t, bc, "recipient", 1, 0, uint64(i)) {
+			t.Fatal("转账没有进入交易池")
+		}
+		if i == fit-1 {
+			if got := len(bc.selectTransactions()); got != fit {
+				t.Fatalf("交易池有 %d 笔交易时打包了 %d 笔", fit, got)
+			}
+		}
+	}
+	if got := len(bc.selectTransactions()); got != fit {
+		t.Fatalf("交易池有 %d 笔交易时打包了 %d 笔，期望 %d 笔", fit+1, got, fit)
+	}
+	prev := bc.LastBlock()
+	mineBlocks(t, bc, 1)
+	b := bc.LastBlock()
+	if len(b.transactions) != MAX_BLOCK_TXS {
+		t.Fatalf("区块有 %d 笔交易，期望 %d 笔", len(b.transactions), MAX_BLOCK_TXS)
+	}
+	if err := VerifyBlock(bc.Engine(), prev, b, bc.store.GetByNumber); err != nil {
+		t.Fatalf("打包出的区块校验失败：%v", err)
+	}
+	if got := len(bc.TransactionPool()); got != 1 {
+		t.Fatalf("交易池剩下 %d 笔交易，期望 1 笔", got)
+	}
+}
@@ -0,0 +1,161 @@
+package block
+
+import (
+	"crypto/sha256"
+	"encoding/json"
+	"fmt"
+)
+
+// Merkle 树节点哈希的前缀，叶子和内部节点使用不同前缀，无法把内部节点伪装成交易
+const (
+	merkleLeafPrefix = 0x00
+	merkleNodePrefix = 0x01
+)
+
+// Merkle 证明中的一步：与当前节点配对的兄弟节点，Left 为 true 时兄弟节点在左边
+type MerkleStep struct {
+	Hash [32]byte
+	Left bool
+}
+
+func (ms MerkleStep) MarshalJSON() ([]byte, error) {
+	position := "right"
+	if ms.Left {
+		position = "left"
+	}
+	return json.Marshal(struct {
+		Hash     string `json:"hash"`
+		Position string `json:"position"`
+	}{
+		Hash:     fmt.Sprintf("%x", ms.Hash),
+		Position: position,
+	})
+}
+
+func merkleLeaf(txHash [32]byte) [32]byte {
+	var buf [1 + 32]byte
+	buf[0] = merkleLeafPrefix
+	copy(buf[1:], txHash[:])
+	return sha256.Sum256(buf[:])
+}
+
+func merkleNode(left, right [32]byte) [32]byte {
+	var buf [1 + 32 + 32]byte
+	buf[0] = merkleNodePrefix
+	copy(buf[1:], left[:])
+	copy(buf[33:], right[:])
+	return sha256.Sum256(buf[:])
+}
+
+// 交易的 Merkle 根：叶子为 SHA-256(0x00 | 交易哈希)，内部节点为 SHA-256(0x01 | 左 | 右)，
+// 某一层节点数为奇数时最后一个节点直接升到上一层。没有交易时为全 0
+func MerkleRoot(txs []*Transaction) [32]byte {
+	if len(txs) == 0 {
+		return [32]byte{}
+	}
+	level := merkleLeaves(txs)
+	for len(level) > 1 {
+		level = merkleParents(level)
+	}
+	return level[0]
+}
+
+// 第 index 笔交易到 Merkle 根的路径，从叶子一层开始
+func MerkleProof(txs []*Transaction, index int) ([]MerkleStep, error) {
+	if index < 0 || index >= len(txs) {
+		return nil, fmt.Errorf("交易下标 %d 超出范围", index)
+	}
+	proof := make([]MerkleStep, 0)
+	level := merkleLeaves(txs)
+	for len(level) > 1 {
+		if sibling := index ^ 1; sibling < len(level) {
+			proof = append(proof, MerkleStep{Hash: level[sibling], Left: sibling < index})
+		}
+		level = merkleParents(level)
+		index /= 2
+	}
+	return proof, nil
+}
+
+// 用证明路径从交易哈希算到根，与 root 比较。只持有区块头的客户端用它确认交易已上链
+func VerifyMerkleProof(txHash [32]byte, proof []MerkleStep, root [32]byte) bool {
+	h := merkleLeaf(txHash)
+	for _, step := range proof {
+		if step.Left {
+			h = merkleNode(step.Hash, h)
+		} else {
+			h = merkleNode(h, step.Hash)
+		}
+	}
+	return h == root
+}
+
+func merkleLeaves(txs []*Transaction) [][32]byte {
+	level := make([][32]byte, len(txs))
+	for i, t := range txs {
+		level[i] = merkleLeaf(t.hash)
+	}
+	return level
+}
+
+func merkleParents(level [][32]byte) [][32]byte {
+	parents := make([][32]byte, 0, (len(level)+1)/2)
+	for i := 0; i < len(level); i += 2 {
+		if i+1 == len(level) {
+			parents = append(parents, level[i])
+		} else {
+			parents = append(parents, merkleNode(level[i], level[i+1]))
+		}
+	}
+	return parents
+}
+
+// 交易的包含证明
+type TransactionProof struct {
+	TxHash     [32]byte
+	Location   TxLocation
+	BlockHash  [32]byte
+	MerkleRoot [32]byte
+	Path       []MerkleStep
+}
+
+func (tp *TransactionProof) MarshalJSON() ([]byte, error) {
+	return json.Marshal(struct {
+		Hash        string       `json:"hash"`
+		BlockNumber uint64       `json:"block_number"`
+		Index       int          `json:"index"`
+		BlockHash   string       `json:"block_hash"`
+		MerkleRoot  string       `json:"merkle_root"`
+		Path        []MerkleStep `json:"path"`
+	}{
+		Hash:        fmt.Sprintf("%x", tp.TxHash),
+		BlockNumber: tp.Location.Number,
+		Index:       tp.Location.Index,
+		BlockHash:   fmt.Sprintf("%x", tp.BlockHash),
+		MerkleRoot:  fmt.Sprintf("%x", tp.MerkleRoot),
+		Path:        tp.Path,
+	})
+}
+
+// 查询交易所在区块及其到区块头 Merkle 根的路径，交易不存在时返回 ErrTransactionNotFound
+func (bc *Blockchain) TransactionProof(hash [32]byte) (*TransactionProof, error) {
+	loc, err := bc.store.GetTxLocation(hash)
+	if err != nil {
+		return nil, err
+	}
+	b, err := bc.store.GetByNumber(loc.Number)
+	if err != nil {
+		return nil, err
+	}
+	path, err := MerkleProof(b.transactions, loc.Index)
+	if err != nil {
+		return nil, err
+	}
+	return &TransactionProof{
+		TxHash:     hash,
+		Location:   loc,
+		BlockHash:  b.hash,
+		MerkleRoot: b.merkleRoot,
+		Path:       path,
+	}, nil
+}
@@ -0,0 +1,201 @@
+package block
+
+import (
+	"crypto/sha256"
+	"encoding/binary"
+	"encoding/json"
+	"fmt"
+	"log"
+	"math/big"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/fatih/color"
+)
+
+// 挖矿线程每尝试多少个 nonce 检查一次是否需要放弃，并累加一次哈希计数
+const powCheckInterval = 1 << 12
+
+// 链尾变化通知：每次链尾变化时关闭当前通道并换一个新通道，
+// 挖矿线程在开始前取得通道，通道被关闭说明正在挖的区块已经过时
+type tipSignal struct {
+	mux sync.Mutex
+	ch  chan struct{}
+}
+
+func newTipSignal() *tipSignal {
+	return &tipSignal{ch: make(chan struct{})}
+}
+
+func (ts *tipSignal) changed() <-chan struct{} {
+	ts.mux.Lock()
+	defer ts.mux.Unlock()
+	return ts.ch
+}
+
+func (ts *tipSignal) notify() {
+	ts.mux.Lock()
+	defer ts.mux.Unlock()
+	close(ts.ch)
+	ts.ch = make(chan struct{})
+}
+
+// 挖矿统计
+type MiningStats struct {
+	// 并行挖矿的线程数
+	Workers int
+	// 是否正在进行工作量证明
+	Active bool
+	// 累计尝试的哈希次数
+	TotalHashes uint64
+	// 最近一次工作量证明的哈希速率（次/秒），正在挖矿时为本轮到目前为止的速率
+	Hashrate float64
+}
+
+func (ms *MiningStats) MarshalJSON() ([]byte, error) {
+	return json.Marshal(struct {
+		Workers     int     `json:"workers"`
+		Active      bool    `json:"active"`
+		TotalHashes uint64  `json:"total_hashes"`
+		Hashrate    float64 `json:"hashrate"`
+	}{
+		Workers:     ms.Workers,
+		Active:      ms.Active,
+		TotalHashes: ms.TotalHashes,
+		Hashrate:    ms.Hashrate,
+	})
+}
+
+// 哈希计数器，各挖矿线程直接累加 total，速率按本轮开始以来的计数计算
+type miningMeter struct {
+	total      uint64
+	mux        sync.Mutex
+	active     int
+	begin      time.Time
+	beginTotal uint64
+	hashrate   float64
+}
+
+func (mm *miningMeter) add(n uint64) {
+	atomic.AddUint64(&mm.total, n)
+}
+
+func (mm *miningMeter) start() {
+	mm.mux.Lock()
+	defer mm.mux.Unlock()
+	if mm.active == 0 {
+		mm.begin = time.Now()
+		mm.beginTotal = atomic.LoadUint64(&mm.total)
+	}
+	mm.active++
+}
+
+func (mm *miningMeter) stop() {
+	mm.mux.Lock()
+	defer mm.mux.Unlock()
+	mm.active--
+	if mm.active == 0 {
+		mm.hashrate = rate(atomic.LoadUint64(&mm.total)-mm.beginTotal, time.Since(mm.begin))
+	}
+}
+
+func (mm *miningMeter) stats(workers int) *MiningStats {
+	mm.mux.Lock()
+	defer mm.mux.Unlock()
+	total := atomic.LoadUint64(&mm.total)
+	stats := &MiningStats{
+		Workers:     workers,
+		Active:      mm.active > 0,
+		TotalHashes: total,
+		Hashrate:    mm.hashrate,
+	}
+	if mm.active > 0 {
+		stats.Hashrate = rate(total-mm.beginTotal, time.Since(mm.begin))
+	}
+	return stats
+}
+
+func rate(hashes uint64, elapsed time.Duration) float64 {
+	if elapsed <= 0 {
+		return 0
+	}
+	return float64(hashes) / elapsed.Seconds()
+}
+
+// 多个线程并行搜索 nonce 直到区块哈希满足难度要求，找到后写入区块的 nonce 和哈希。
+// 第 i 个线程尝试 i, i+n, i+2n ... 的 nonce，区块头编码只生成一次，每次尝试只改写末尾的 nonce。
+// abort 被关闭（链尾变化）时所有线程立即停止，返回 ErrSealAborted
+func (pe *PoWEngine) Seal(b *Block, abort <-chan struct{}) error {
+	target := proofTarget(b.difficulty)
+	if target == nil {
+		return fmt.Errorf("区块 %v 的难度 %v 不合法", b.number, b.difficulty)
+	}
+	workers := pe.workers
+	if workers <= 0 {
+		workers = 1
+	}
+	header := b.EncodeHeader()
+
+	var hashes uint64
+	count := func(n int) {
+		atomic.AddUint64(&hashes, uint64(n))
+		pe.meter.add(uint64(n))
+	}
+	begin := time.Now()
+	pe.meter.start()
+	done := make(chan struct{})
+	var once sync.Once
+	var found bool
+	var wg sync.WaitGroup
+	for i := 0; i < workers; i++ {
+		wg.Add(1)
+		go func(start uint64) {
+			defer wg.Done()
+			h := make([]byte, len(header))
+			copy(h, header)
+			stride := uint64(workers)
+			for nonce, n := start, 0; ; nonce, n = nonce+stride, n+1 {
+				if n == powCheckInterval {
+					count(n)
+					n = 0
+					select {
+					case <-done:
+						return
+					case <-abort:
+						return
+					default:
+					}
+				}
+				binary.BigEndian.PutUint64(h[headerNonceOffset:], nonce)
+				hash := sha256.Sum256(h)
+				if target.Cmp(bytesToBigInt(hash)) > 0 {
+					count(n + 1)
+					once.Do(func() {
+						b.nonce = new(big.Int).SetUint64(nonce)
+						b.hash = hash
+						found = true
+						close(done)
+					})
+					return
+				}
+				// 本线程的 nonce 空间已用完
+				if nonce > ^uint64(0)-stride {
+					count(n + 1)
+					return
+				}
+			}
+		}(uint64(i))
+	}
+	wg.Wait()
+	pe.meter.stop()
+
+	elapsed := time.Since(begin)
+	log.Printf("POW workers:%d hashes:%d time:%s hashrate:%.0f H/s found:%v",
+		workers, hashes, elapsed, rate(hashes, elapsed), found)
+	if !found {
+		color.Yellow("区块 %v 的工作量证明已放弃", b.number)
+		return ErrSealAborted
+	}
+	return nil
+}
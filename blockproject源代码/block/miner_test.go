@@ -0,0 +1,92 @@
+package block
+
+import (
+	"errors"
+	"math/big"
+	"testing"
+	"time"
+)
+
+// 创世纪块难度为 difficulty 的链，之后的区块沿用这个难度，用 workers 个线程挖矿
+func difficultyTestChain(t *testing.T, difficulty int, workers int) (*Blockchain, *PoWEngine) {
+	t.Helper()
+	spec := DefaultChainSpec()
+	spec.Difficulty = difficulty
+	engine := NewPoWEngine(workers)
+	bc, err := NewBlockchainWithEngine("miner", 5000, NewMemoryStore(), spec, engine)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return bc, engine
+}
+
+// 等待 cond 成立，超时后测试失败
+func waitFor(t *testing.T, what string, cond func() bool) {
+	t.Helper()
+	deadline := time.Now().Add(5 * time.Second)
+	for !cond() {
+		if time.Now().After(deadline) {
+			t.Fatalf("等待%s超时", what)
+		}
+		time.Sleep(time.Millisecond)
+	}
+}
+
+// 多个线程中找到 nonce 的那个写入区块，其余线程随之停止
+func TestSealLowDifficulty(t *testing.T) {
+	bc, engine := difficultyTestChain(t, 16, 4)
+	for i := 0; i < 3; i++ {
+		if !bc.Mining() {
+			t.Fatalf("第 %d 个区块挖矿失败", i+1)
+		}
+		b := bc.LastBlock()
+		if b.hash != b.Hash() || !validProof(b, b.difficulty) {
+			t.Fatalf("区块 %v 的工作量证明无效", b.number)
+		}
+	}
+	if stats := engine.Stats(); stats.Active || stats.Workers != 4 || stats.TotalHashes == 0 {
+		t.Fatalf("挖矿结束后的统计 %+v", stats)
+	}
+}
+
+// 链尾变化时正在进行的工作量证明立即放弃，所有线程退出后 Mining 返回，之后可以重新开始挖矿
+func TestMiningAbortsOnTipChange(t *testing.T) {
+	bc, engine := difficultyTestChain(t, 1<<62, 4)
+	for round := 0; round < 2; round++ {
+		done := make(chan bool)
+		go func() { done <- bc.Mining() }()
+		waitFor(t, "开始挖矿", func() bool { return engine.Stats().Active })
+
+		bc.tip.notify()
+		select {
+		case ok := <-done:
+			if ok {
+				t.Fatal("链尾变化后仍然出块")
+			}
+		case <-time.After(5 * time.Second):
+			t.Fatal("链尾变化后挖矿没有停止")
+		}
+		if engine.Stats().Active {
+			t.Fatal("Mining 返回后仍有挖矿线程在运行")
+		}
+		if bc.LastBlock().number.Sign() != 0 {
+			t.Fatal("放弃的区块被写入了链")
+		}
+	}
+}
+
+// 直接调用 Seal 时关闭 abort 通道，返回 ErrSealAborted 且不修改区块
+func TestSealAbort(t *testing.T) {
+	engine := NewPoWEngine(2)
+	b := NewBlock(big.NewInt(1), big.NewInt(0), [32]byte{}, nil)
+	b.difficulty = big.NewInt(1 << 62)
+	hash := b.hash
+	abort := make(chan struct{})
+	time.AfterFunc(10*time.Millisecond, func() { close(abort) })
+	if err := engine.Seal(b, abort); !errors.Is(err, ErrSealAborted) {
+		t.Fatalf("放弃后 Seal 返回 %v", err)
+	}
+	if b.hash != hash || b.nonce.Sign() != 0 {
+		t.Fatal("放弃的工作量证明修改了区块")
+	}
+}
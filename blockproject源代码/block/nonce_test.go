@@ -0,0 +1,65 @@
+package block
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"jhblockchain/utils"
+	"math/big"
+	"sync"
+	"testing"
+)
+
+// 同时提交同一笔签名交易，只有一笔进入交易池
+func TestAddTransactionConcurrentReplay(t *testing.T) {
+	maturity := COINBASE_MATURITY
+	COINBASE_MATURITY = 0
+	defer func() { COINBASE_MATURITY = maturity }()
+
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	sender := AddressFromPublicKey(&key.PublicKey)
+	bc, err := NewBlockchainWithStore(sender, 5000, NewMemoryStore())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bc.Mining() {
+		t.Fatal("挖矿失败")
+	}
+
+	tx := NewTransactionWithFee(sender, "recipient", big.NewInt(100), big.NewInt(1))
+	r, s, err := ecdsa.Sign(rand.Reader, key, tx.hash[:])
+	if err != nil {
+		t.Fatal(err)
+	}
+	sig := &utils.Signature{R: r, S: s}
+
+	const submits = 16
+	var wg sync.WaitGroup
+	var mux sync.Mutex
+	accepted := 0
+	for i := 0; i < submits; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			if bc.AddTransaction(sender, "recipient", big.NewInt(100), big.NewInt(1), 0, &key.PublicKey, sig) {
+				mux.Lock()
+				accepted++
+				mux.Unlock()
+			}
+		}()
+	}
+	wg.Wait()
+
+	if accepted != 1 {
+		t.Fatalf("%d 次提交被接受，期望 1 次", accepted)
+	}
+	if n := len(bc.TransactionPool()); n != 1 {
+		t.Fatalf("交易池中有 %d 笔交易，期望 1 笔", n)
+	}
+	if got := bc.PendingNonce(sender); got != 1 {
+		t.Fatalf("PendingNonce = %d，期望 1", got)
+	}
+}
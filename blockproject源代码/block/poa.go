@@ -0,0 +1,85 @@
+package block
+
+import (
+	"crypto/ecdsa"
+	"crypto/rand"
+	"errors"
+	"jhblockchain/utils"
+	"math/big"
+)
+
+// 权威证明区块的难度固定为 2，每个区块的工作量为 1，分叉选择时累计工作量等于区块数
+const POA_DIFFICULTY = 2
+
+// 权威证明：配置好的一组出块节点按顺序轮流出块，区块 n 由第 n % len(signers) 个节点签名。
+// 签名针对区块哈希，保存在区块的 seal 字段，不参与哈希计算。
+// 因为 seal 不在哈希里，同一个区块哈希只能对应一个合法的 seal：S 必须不大于曲线阶的一半，
+// 否则任何人都能把 S 换成 N-S 得到另一个合法签名；本地已有的区块与收到的区块哈希相同时还要比较 seal
+type PoAEngine struct {
+	signers []*ecdsa.PublicKey
+	// 本节点的出块私钥，为 nil 时只校验不出块
+	key *ecdsa.PrivateKey
+}
+
+func NewPoAEngine(signers []*ecdsa.PublicKey, key *ecdsa.PrivateKey) (*PoAEngine, error) {
+	if len(signers) == 0 {
+		return nil, errors.New("权威证明至少需要一个出块节点")
+	}
+	return &PoAEngine{signers: signers, key: key}, nil
+}
+
+// 负责签名区块 number 的出块节点
+func (pa *PoAEngine) Signer(number uint64) *ecdsa.PublicKey {
+	return pa.signers[number%uint64(len(pa.signers))]
+}
+
+func (pa *PoAEngine) Prepare(parent *BlockHeader, b *Block, ancestor HeaderGetter) error {
+	b.difficulty = big.NewInt(POA_DIFFICULTY)
+	return nil
+}
+
+// 轮到本节点时对区块哈希签名，没有轮到时返回 ErrNotInTurn
+func (pa *PoAEngine) Seal(b *Block, abort <-chan struct{}) error {
+	if pa.key == nil || !pa.key.PublicKey.Equal(pa.Signer(b.number.Uint64())) {
+		return ErrNotInTurn
+	}
+	select {
+	case <-abort:
+		return ErrSealAborted
+	default:
+	}
+	b.hash = b.Hash()
+	r, s, err := ecdsa.Sign(rand.Reader, pa.key, b.hash[:])
+	if err != nil {
+		return err
+	}
+	if !lowS(&pa.key.PublicKey, s) {
+		s.Sub(pa.key.Params().N, s)
+	}
+	b.seal = signatureBytes(&utils.Signature{R: r, S: s})
+	return nil
+}
+
+func (pa *PoAEngine) Verify(prev *BlockHeader, h *BlockHeader, ancestor HeaderGetter) error {
+	if h.difficulty.Cmp(big.NewInt(POA_DIFFICULTY)) != 0 {
+		return headerError(h, ErrDifficulty, "权威证明区块的难度必须为 %d", POA_DIFFICULTY)
+	}
+	sig, err := parseSignature(h.seal)
+	if err != nil || sig == nil {
+		return headerError(h, ErrInvalidSeal, "缺少出块签名或签名格式错误")
+	}
+	signer := pa.Signer(h.number.Uint64())
+	if !lowS(signer, sig.S) {
+		return headerError(h, ErrInvalidSeal, "出块签名的 S 大于曲线阶的一半")
+	}
+	if !ecdsa.Verify(signer, h.hash[:], sig.R, sig.S) {
+		return headerError(h, ErrInvalidSeal, "不是出块节点 %d 的签名", h.number.Uint64()%uint64(len(pa.signers)))
+	}
+	return nil
+}
+
+// S 不大于曲线阶的一半
+func lowS(pub *ecdsa.PublicKey, s *big.Int) bool {
+	half := new(big.Int).Rsh(pub.Params().N, 1)
+	return s.Cmp(half) <= 0
+}
@@ -0,0 +1,79 @@
+package block
+
+import (
+	"bytes"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"errors"
+	"math/big"
+	"testing"
+)
+
+func testPoAEngine(t *testing.T) *PoAEngine {
+	t.Helper()
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	engine, err := NewPoAEngine([]*ecdsa.PublicKey{&key.PublicKey}, key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return engine
+}
+
+// 出块签名的 S 总是在曲线阶的一半以下，把 S 换成 N-S 得到的签名虽然数学上成立，也不能通过校验
+func TestPoASealLowS(t *testing.T) {
+	engine := testPoAEngine(t)
+	genesis := NewBlock(big.NewInt(0), big.NewInt(0), [32]byte{}, nil)
+	n := engine.key.Params().N
+	for i := 0; i < 32; i++ {
+		b := NewBlock(big.NewInt(1), big.NewInt(0), genesis.hash, nil)
+		b.timestamp += int64(i)
+		if err := engine.Prepare(genesis.Header(), b, nil); err != nil {
+			t.Fatal(err)
+		}
+		if err := engine.Seal(b, nil); err != nil {
+			t.Fatal(err)
+		}
+		if err := engine.Verify(genesis.Header(), b.Header(), nil); err != nil {
+			t.Fatal(err)
+		}
+
+		sig, _ := parseSignature(b.seal)
+		if !lowS(&engine.key.PublicKey, sig.S) {
+			t.Fatalf("出块签名的 S 大于曲线阶的一半")
+		}
+		sig.S.Sub(n, sig.S)
+		if !ecdsa.Verify(&engine.key.PublicKey, b.hash[:], sig.R, sig.S) {
+			t.Fatal("N-S 应当是数学上合法的签名")
+		}
+		b.seal = signatureBytes(sig)
+		if err := engine.Verify(genesis.Header(), b.Header(), nil); !errors.Is(err, ErrInvalidSeal) {
+			t.Fatalf("期望 ErrInvalidSeal，得到 %v", err)
+		}
+	}
+}
+
+// 邻居的区块头与本地区块哈希相同但出块签名不同时不同步
+func TestHeaderForkPointSealMismatch(t *testing.T) {
+	bc, store := minedTestChain(t, 3)
+	headers := make([]*BlockHeader, 0)
+	for n := uint64(0); n <= 3; n++ {
+		b, err := store.GetByNumber(n)
+		if err != nil {
+			t.Fatal(err)
+		}
+		headers = append(headers, b.Header())
+	}
+	fork, err := bc.headerForkPoint(0, headers)
+	if err != nil || fork != uint64(len(headers)) {
+		t.Fatalf("相同的链分叉点 %d，错误 %v", fork, err)
+	}
+
+	headers[2].seal = bytes.Repeat([]byte{1}, signatureSize)
+	if _, err := bc.headerForkPoint(0, headers); !errors.Is(err, ErrInvalidSeal) {
+		t.Fatalf("期望 ErrInvalidSeal，得到 %v", err)
+	}
+}
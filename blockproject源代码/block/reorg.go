@@ -0,0 +1,127 @@
+package block
+
+import (
+	"fmt"
+	"log"
+	"math/big"
+
+	"github.com/fatih/color"
+)
+
+// 把本地链从区块号 fork 开始替换为 branch，branch 的第一个区块必须接在本地区块 fork-1 之后。
+// 区块头优先同步时只下载了分叉点之后的区块，使用这个方法切换。branch 需由调用方事先校验。
+// 会替换最终确定的区块时返回 ErrFinalizedReorg，见 FINALITY_CONFIRMATIONS
+func (bc *Blockchain) ReorganizeFrom(fork uint64, branch []*Block) error {
+	bc.mux.Lock()
+	defer bc.mux.Unlock()
+
+	if len(branch) == 0 {
+		return fmt.Errorf("新分支为空")
+	}
+	if int64(fork) > bc.state.Height()+1 {
+		return fmt.Errorf("分叉点 %d 超出本地链高度 %d", fork, bc.state.Height())
+	}
+	if err := bc.checkFinality(fork); err != nil {
+		return err
+	}
+	if fork > 0 {
+		parent, err := bc.store.GetByNumber(fork - 1)
+		if err != nil {
+			return err
+		}
+		if branch[0].previousHash != parent.hash {
+			return fmt.Errorf("新分支没有接在本地区块 %d 之后，本地链可能已经变化", fork-1)
+		}
+	}
+	return bc.replaceBranch(int64(fork), branch)
+}
+
+// 调用方持有 bc.mux
+func (bc *Blockchain) replaceBranch(fork int64, branch []*Block) error {
+	head := bc.state.Height()
+	orphaned := make([]*Block, 0)
+	for n := fork; n <= head; n++ {
+		b, err := bc.store.GetByNumber(uint64(n))
+		if err != nil {
+			return err
+		}
+		orphaned = append(orphaned, b)
+	}
+
+	if err := bc.store.ReplaceFrom(uint64(fork), branch); err != nil {
+		return err
+	}
+	// 存储已经切换，账户状态必须跟上，否则两者不一致
+	if err := bc.state.RevertTo(fork - 1); err != nil {
+		log.Fatal("回滚账户状态失败 ", err)
+	}
+	bc.work.truncate(fork - 1)
+	for _, b := range branch {
+		if err := bc.state.ApplyBlock(b); err != nil {
+			log.Fatal("更新账户状态失败 ", err)
+		}
+		bc.work.push(b)
+	}
+	// 原来的快照可能保存在被丢弃的区块上，按新的链尾重新保存
+	bc.saveSnapshot(branch[len(branch)-1])
+
+	bc.tip.notify()
+	restored := bc.restoreOrphaned(orphaned, branch)
+	color.Yellow("链重组：分叉点 %d，丢弃 %d 个区块，应用 %d 个区块，%d 笔交易放回交易池",
+		fork, len(orphaned), len(branch), restored)
+	return nil
+}
+
+// 重新整理交易池：先放入被丢弃区块中的交易，再放入原交易池中的交易，
+// 跳过挖矿奖励、新分支已打包的交易、重复交易、交易序号不接续的交易以及余额已不足的交易，返回放回交易池的交易数。
+// 两批交易中每个发送方的交易序号都是递增的，按顺序累计每个发送方放回的交易序号和支出，
+// 同一发送方的多笔交易合起来也不能超出可用余额，某一笔被跳过后该发送方之后的交易序号不再接续，也一并跳过
+func (bc *Blockchain) restoreOrphaned(orphaned []*Block, branch []*Block) int {
+	included := make(map[[32]byte]bool)
+	for _, b := range branch {
+		for _, t := range b.transactions {
+			included[t.hash] = true
+		}
+	}
+
+	bc.muxPool.Lock()
+	defer bc.muxPool.Unlock()
+	pool := make([]*Transaction, 0, len(bc.transactionPool))
+	restored := 0
+	nonces := make(map[string]uint64)
+	available := make(map[string]*big.Int)
+	keep := func(t *Transaction) bool {
+		if t.senderAddress == MINING_ACCOUNT_ADDRESS || included[t.hash] {
+			return false
+		}
+		sender := t.senderAddress
+		if _, ok := available[sender]; !ok {
+			nonces[sender] = bc.state.Nonce(sender)
+			available[sender] = bc.state.Spendable(sender)
+		}
+		if t.nonce != nonces[sender] {
+			return false
+		}
+		if available[sender].Cmp(t.cost()) < 0 {
+			color.Yellow("交易 %x 的发送方 %s 余额不足，丢弃", t.hash, sender)
+			return false
+		}
+		nonces[sender]++
+		available[sender].Sub(available[sender], t.cost())
+		included[t.hash] = true
+		pool = append(pool, t)
+		return true
+	}
+	for _, b := range orphaned {
+		for _, t := range b.transactions {
+			if keep(t) {
+				restored++
+			}
+		}
+	}
+	for _, t := range bc.transactionPool {
+		keep(t)
+	}
+	bc.transactionPool = pool
+	return restored
+}
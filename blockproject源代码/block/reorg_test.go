@@ -0,0 +1,159 @@
+package block
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"jhblockchain/utils"
+	"math/big"
+	"testing"
+)
+
+// 持有私钥的测试账户，用来签名并提交转账
+type testAccount struct {
+	key     *ecdsa.PrivateKey
+	address string
+}
+
+func newTestAccount(t *testing.T) *testAccount {
+	t.Helper()
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return &testAccount{key: key, address: AddressFromPublicKey(&key.PublicKey)}
+}
+
+// 签名一笔本链上的转账，不提交
+func (a *testAccount) sign(t *testing.T, recipient string, value, fee int64, nonce uint64) *Transaction {
+	t.Helper()
+	tx := NewChainTransaction(CHAIN_ID, nonce, a.address, recipient, big.NewInt(value), big.NewInt(fee))
+	r, s, err := ecdsa.Sign(rand.Reader, a.key, tx.hash[:])
+	if err != nil {
+		t.Fatal(err)
+	}
+	tx.senderPublicKey = &a.key.PublicKey
+	tx.signature = &utils.Signature{R: r, S: s}
+	return tx
+}
+
+// 签名并提交一笔转账，返回是否进入交易池
+func (a *testAccount) send(t *testing.T, bc *Blockchain, recipient string, value, fee int64, nonce uint64) bool {
+	t.Helper()
+	tx := a.sign(t, recipient, value, fee, nonce)
+	return bc.AddTransaction(a.address, recipient, tx.value, tx.fee, nonce, tx.senderPublicKey, tx.signature)
+}
+
+// 本地链在区块 2 打包了一笔转账、交易池中还有两笔，邻居从区块 1 之后出了更长的链。
+// 切换后存储、账户状态和累计工作量都回到分叉点再应用新分支，被丢弃的交易按发送方的余额和交易序号放回交易池
+func TestReorganizeFrom(t *testing.T) {
+	for _, kind := range []string{STORE_MEMORY, STORE_FILE, STORE_DB} {
+		t.Run(kind, func(t *testing.T) {
+			maturity := COINBASE_MATURITY
+			COINBASE_MATURITY = 0
+			t.Cleanup(func() { COINBASE_MATURITY = maturity })
+
+			dir := t.TempDir()
+			store, err := OpenStore(kind, dir, SYNC_NEVER)
+			if err != nil {
+				t.Fatal(err)
+			}
+			miner := newTestAccount(t)
+			local, err := NewBlockchainWithStore(miner.address, 5000, store)
+			if err != nil {
+				t.Fatal(err)
+			}
+			mineBlocks(t, local, 1)
+
+			peerStore := NewMemoryStore()
+			store.Iterate(func(b *Block) bool {
+				peerStore.Append(b)
+				return true
+			})
+			peer, err := NewBlockchainWithStore("peer", 5001, peerStore)
+			if err != nil {
+				t.Fatal(err)
+			}
+			mineBlocks(t, peer, 3)
+
+			// 区块 2 打包 orphan；回到分叉点后余额只有 5000，orphan 之后放不下 overspend，gap 的交易序号随之不接续
+			if !miner.send(t, local, "recipient", 100, 1, 0) {
+				t.Fatal("转账没有进入交易池")
+			}
+			orphan := local.TransactionPool()[0]
+			mineBlocks(t, local, 1)
+			if !miner.send(t, local, "recipient", 4900, 1, 1) || !miner.send(t, local, "recipient", 10, 1, 2) {
+				t.Fatal("转账没有进入交易池")
+			}
+
+			branch := make([]*Block, 0)
+			for n := uint64(2); n <= 4; n++ {
+				b, _ := peerStore.GetByNumber(n)
+				branch = append(branch, b)
+			}
+			if err := local.ReorganizeFrom(3, branch); err == nil {
+				t.Fatal("新分支没有接在分叉点之前的区块之后，应该拒绝")
+			}
+			if err := local.ReorganizeFrom(2, branch); err != nil {
+				t.Fatal(err)
+			}
+
+			for n := uint64(0); n <= 4; n++ {
+				want, _ := peerStore.GetByNumber(n)
+				got, err := store.GetByNumber(n)
+				if err != nil || got.hash != want.hash {
+					t.Fatalf("区块 %d 与新分支不同", n)
+				}
+			}
+			if head, _ := store.Head(); head.hash != peer.LastBlock().hash {
+				t.Fatal("存储的链尾不是新分支的链尾")
+			}
+			if _, err := store.GetTxLocation(orphan.hash); err == nil {
+				t.Fatal("被丢弃区块中的交易仍能在存储中查到")
+			}
+			if h := local.state.Height(); h != 4 {
+				t.Fatalf("账户状态高度 %d，期望 4", h)
+			}
+			for _, addr := range []string{miner.address, "recipient", "peer"} {
+				if got, want := local.CalculateTotalAmount(addr), peer.CalculateTotalAmount(addr); got.Cmp(want) != 0 {
+					t.Errorf("%s 的余额 %v，新分支上为 %v", addr, got, want)
+				}
+			}
+			if n := local.state.Nonce(miner.address); n != 0 {
+				t.Errorf("矿工的交易序号 %d，回到分叉点后应为 0", n)
+			}
+			if len(local.work.total) != 5 || local.TotalWork().Cmp(peer.TotalWork()) != 0 {
+				t.Fatalf("累计工作量记录了 %d 个区块、总量 %v，新分支为 5 个、%v",
+					len(local.work.total), local.TotalWork(), peer.TotalWork())
+			}
+
+			pool := local.TransactionPool()
+			if len(pool) != 1 || pool[0].hash != orphan.hash {
+				t.Fatalf("交易池中有 %d 笔交易，期望只放回被丢弃区块中的转账", len(pool))
+			}
+			if n := local.PendingNonce(miner.address); n != 1 {
+				t.Fatalf("放回交易池后矿工的下一个交易序号 %d，期望 1", n)
+			}
+
+			if kind == STORE_MEMORY {
+				return
+			}
+			// 重新打开后看到的是切换后的链
+			if err := store.Close(); err != nil {
+				t.Fatal(err)
+			}
+			store, err = OpenStore(kind, dir, SYNC_NEVER)
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer store.Close()
+			reopened, err := NewBlockchainWithStore(miner.address, 5000, store)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if reopened.LastBlock().hash != peer.LastBlock().hash || reopened.TotalWork().Cmp(peer.TotalWork()) != 0 {
+				t.Fatal("重新打开后的链与新分支不同")
+			}
+		})
+	}
+}
@@ -0,0 +1,98 @@
+package block
+
+import "math/big"
+
+// 挖矿奖励计划的默认参数，可以由链配置修改，见 ChainSpec.Apply
+var (
+	// 每隔多少个区块挖矿奖励减半，0 表示不减半
+	REWARD_HALVING_INTERVAL uint64 = 1000
+	// 挖矿奖励发行总量的上限，达到上限后区块不再有挖矿奖励
+	MAX_SUPPLY = big.NewInt(9000000)
+	// 挖矿奖励在多少个区块之后才能花费：区块 n 的挖矿奖励从区块 n+COINBASE_MATURITY 开始可以花费，
+	// 0 表示立即可以花费
+	COINBASE_MATURITY uint64 = 10
+)
+
+// 区块 number 的挖矿奖励上限。
+// 区块 1 开始每个区块奖励 MINING_REWARD，每 REWARD_HALVING_INTERVAL 个区块减半，
+// 按这个计划累计发行量达到 MAX_SUPPLY 后奖励为 0。创世纪块没有挖矿奖励。
+// 奖励只由区块号决定，与之前的区块实际领取了多少无关
+func BlockReward(number uint64) *big.Int {
+	if number == 0 {
+		return new(big.Int)
+	}
+	reward := scheduledReward(number)
+	remaining := new(big.Int).Sub(MAX_SUPPLY, ScheduledSupply(number-1))
+	if remaining.Sign() <= 0 {
+		return new(big.Int)
+	}
+	if reward.Cmp(remaining) > 0 {
+		return remaining
+	}
+	return reward
+}
+
+// 按奖励计划到区块 number（含）为止累计发行的挖矿奖励，不超过 MAX_SUPPLY
+func ScheduledSupply(number uint64) *big.Int {
+	total := new(big.Int)
+	if REWARD_HALVING_INTERVAL == 0 {
+		total.Mul(big.NewInt(MINING_REWARD), new(big.Int).SetUint64(number))
+	} else {
+		// 逐个减半周期累加，奖励减到 0 后不再增加
+		for start := uint64(1); start <= number; start += REWARD_HALVING_INTERVAL {
+			reward := scheduledReward(start)
+			if reward.Sign() == 0 {
+				break
+			}
+			count := REWARD_HALVING_INTERVAL
+			if number-start+1 < count {
+				count = number - start + 1
+			}
+			total.Add(total, reward.Mul(reward, new(big.Int).SetUint64(count)))
+			if start > ^uint64(0)-REWARD_HALVING_INTERVAL {
+				break
+			}
+		}
+	}
+	if total.Cmp(MAX_SUPPLY) > 0 {
+		total.Set(MAX_SUPPLY)
+	}
+	return total
+}
+
+// 不考虑发行上限时区块 number（>= 1）的奖励
+func scheduledReward(number uint64) *big.Int {
+	reward := big.NewInt(MINING_REWARD)
+	if REWARD_HALVING_INTERVAL == 0 {
+		return reward
+	}
+	halvings := (number - 1) / REWARD_HALVING_INTERVAL
+	if halvings >= 63 {
+		return new(big.Int)
+	}
+	return reward.Rsh(reward, uint(halvings))
+}
+
+// 区块中挖矿奖励交易给各地址的收入
+func blockRewardDiff(b *Block) stateDiff {
+	diff := make(stateDiff)
+	for _, t := range b.transactions {
+		if !t.IsCoinbase() || t.value == nil {
+			continue
+		}
+		if _, ok := diff[t.receiveAddress]; !ok {
+			diff[t.receiveAddress] = new(big.Int)
+		}
+		diff[t.receiveAddress].Add(diff[t.receiveAddress], t.value)
+	}
+	return diff
+}
+
+// 下一个区块为 next 时仍未成熟的挖矿奖励所在区块的范围 [from, to)
+func immatureRange(next int64) (int64, int64) {
+	from := next - int64(COINBASE_MATURITY) + 1
+	if from < 0 {
+		from = 0
+	}
+	return from, next
+}
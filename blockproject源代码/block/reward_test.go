@@ -0,0 +1,97 @@
+package block
+
+import (
+	"errors"
+	"math/big"
+	"testing"
+)
+
+// 在测试期间使用给定的奖励计划
+func setRewardSchedule(t *testing.T, reward int64, interval uint64, supply int64) {
+	t.Helper()
+	oldReward, oldInterval, oldSupply := MINING_REWARD, REWARD_HALVING_INTERVAL, MAX_SUPPLY
+	MINING_REWARD, REWARD_HALVING_INTERVAL, MAX_SUPPLY = reward, interval, big.NewInt(supply)
+	t.Cleanup(func() {
+		MINING_REWARD, REWARD_HALVING_INTERVAL, MAX_SUPPLY = oldReward, oldInterval, oldSupply
+	})
+}
+
+// 默认计划：每 1000 个区块减半，前三个周期发行 5000000+2500000+1250000，
+// 第四个周期每块 625，到区块 3400 正好达到 9000000 的上限
+func TestBlockReward(t *testing.T) {
+	setRewardSchedule(t, 5000, 1000, 9000000)
+	tests := []struct {
+		number uint64
+		reward int64
+		supply int64
+	}{
+		{0, 0, 0},
+		{1, 5000, 5000},
+		{1000, 5000, 5000000},
+		{1001, 2500, 5002500},
+		{2000, 2500, 7500000},
+		{2001, 1250, 7501250},
+		{3000, 1250, 8750000},
+		{3001, 625, 8750625},
+		{3400, 625, 9000000},
+		{3401, 0, 9000000},
+		{1 << 40, 0, 9000000},
+	}
+	for _, tt := range tests {
+		if got := BlockReward(tt.number); got.Int64() != tt.reward {
+			t.Errorf("区块 %d 的奖励 %v，期望 %d", tt.number, got, tt.reward)
+		}
+		if got := ScheduledSupply(tt.number); got.Int64() != tt.supply {
+			t.Errorf("到区块 %d 的发行量 %v，期望 %d", tt.number, got, tt.supply)
+		}
+	}
+}
+
+// 上限不是区块奖励的整数倍时，最后一个有奖励的区块只发剩下的部分
+func TestBlockRewardPartialCap(t *testing.T) {
+	setRewardSchedule(t, 5000, 0, 10001)
+	want := []int64{0, 5000, 5000, 1, 0}
+	for n, reward := range want {
+		if got := BlockReward(uint64(n)); got.Int64() != reward {
+			t.Errorf("区块 %d 的奖励 %v，期望 %d", n, got, reward)
+		}
+	}
+	if got := ScheduledSupply(1000); got.Int64() != 10001 {
+		t.Errorf("发行量 %v 超过上限", got)
+	}
+}
+
+// 区块 1 的挖矿奖励在区块 1+COINBASE_MATURITY 之前不能花费
+func TestImmatureCoinbaseSpend(t *testing.T) {
+	maturity := COINBASE_MATURITY
+	COINBASE_MATURITY = 2
+	t.Cleanup(func() { COINBASE_MATURITY = maturity })
+
+	miner := newTestAccount(t)
+	bc, err := NewBlockchainWithStore(miner.address, 5000, NewMemoryStore())
+	if err != nil {
+		t.Fatal(err)
+	}
+	mineBlocks(t, bc, 1)
+	if got := bc.CalculateImmatureAmount(miner.address); got.Int64() != MINING_REWARD {
+		t.Fatalf("未成熟的挖矿奖励 %v，期望 %d", got, MINING_REWARD)
+	}
+
+	spend := NewBlock(big.NewInt(2), big.NewInt(0), bc.LastBlock().hash, []*Transaction{
+		miner.sign(t, "recipient", 100, 1, 0),
+	})
+	if err := VerifyBalances(spend, bc.state); !errors.Is(err, ErrInsufficientBalance) {
+		t.Fatalf("花费未成熟的挖矿奖励，校验结果 %v", err)
+	}
+	if miner.send(t, bc, "recipient", 100, 1, 0) {
+		t.Fatal("花费未成熟挖矿奖励的交易不应进入交易池")
+	}
+
+	mineBlocks(t, bc, 1)
+	if err := VerifyBalances(spend, bc.state); err != nil {
+		t.Fatalf("挖矿奖励成熟后仍不能花费：%v", err)
+	}
+	if !miner.send(t, bc, "recipient", 100, 1, 0) {
+		t.Fatal("挖矿奖励成熟后转账没有进入交易池")
+	}
+}
@@ -0,0 +1,112 @@
+package block
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"jhblockchain/utils"
+	"math/big"
+
+	"github.com/btcsuite/btcd/btcutil/base58"
+)
+
+// 公钥和签名的编码长度：P-256 的两个 32 字节坐标，或签名的 R、S
+const (
+	publicKeySize = 64
+	signatureSize = 64
+)
+
+// 创建带发送方公钥和签名的交易，签名随交易一起上链，任何节点都可以重新验证
+func NewSignedTransaction(sender string, receive string, value *big.Int, fee *big.Int, nonce uint64,
+	senderPublicKey *ecdsa.PublicKey, s *utils.Signature) *Transaction {
+	t := NewChainTransaction(CHAIN_ID, nonce, sender, receive, value, fee)
+	t.senderPublicKey = senderPublicKey
+	t.signature = s
+	return t
+}
+
+// 由公钥得到区块链地址：X、Y 坐标（大端，不补齐前导 0）拼接后的 SHA-256，再做 base58 编码。
+// 钱包用同样的方法生成地址，普通交易的发送地址必须是签名公钥对应的地址
+func AddressFromPublicKey(pub *ecdsa.PublicKey) string {
+	h := sha256.New()
+	h.Write(pub.X.Bytes())
+	h.Write(pub.Y.Bytes())
+	return base58.Encode(h.Sum(nil))
+}
+
+// 区块 number 中给 recipient 的挖矿奖励交易，交易序号为区块号
+func NewCoinbaseTransaction(number uint64, recipient string, value *big.Int) *Transaction {
+	return NewChainTransaction(CHAIN_ID, number, MINING_ACCOUNT_ADDRESS, recipient, value, nil)
+}
+
+// 挖矿奖励交易，由矿工在打包时加入，没有签名
+func (t *Transaction) IsCoinbase() bool {
+	return t.senderAddress == MINING_ACCOUNT_ADDRESS
+}
+
+func (t *Transaction) verifySignature() bool {
+	if t.senderPublicKey == nil || t.signature == nil || t.signature.R == nil || t.signature.S == nil {
+		return false
+	}
+	return ecdsa.Verify(t.senderPublicKey, t.hash[:], t.signature.R, t.signature.S)
+}
+
+// 公钥编码为 X、Y 两个定长 32 字节大端整数，nil 编码为空
+func publicKeyBytes(pub *ecdsa.PublicKey) []byte {
+	if pub == nil {
+		return nil
+	}
+	p := make([]byte, publicKeySize)
+	pub.X.FillBytes(p[:32])
+	pub.Y.FillBytes(p[32:])
+	return p
+}
+
+func parsePublicKey(p []byte) (*ecdsa.PublicKey, error) {
+	if len(p) == 0 {
+		return nil, nil
+	}
+	if len(p) != publicKeySize {
+		return nil, fmt.Errorf("公钥长度 %d 错误", len(p))
+	}
+	return &ecdsa.PublicKey{
+		Curve: elliptic.P256(),
+		X:     new(big.Int).SetBytes(p[:32]),
+		Y:     new(big.Int).SetBytes(p[32:]),
+	}, nil
+}
+
+// 签名编码为 R、S 两个定长 32 字节大端整数，nil 编码为空
+func signatureBytes(s *utils.Signature) []byte {
+	if s == nil {
+		return nil
+	}
+	p := make([]byte, signatureSize)
+	s.R.FillBytes(p[:32])
+	s.S.FillBytes(p[32:])
+	return p
+}
+
+func parseSignature(p []byte) (*utils.Signature, error) {
+	if len(p) == 0 {
+		return nil, nil
+	}
+	if len(p) != signatureSize {
+		return nil, fmt.Errorf("签名长度 %d 错误", len(p))
+	}
+	return &utils.Signature{
+		R: new(big.Int).SetBytes(p[:32]),
+		S: new(big.Int).SetBytes(p[32:]),
+	}, nil
+}
+
+// JSON 中公钥和签名都是定长的十六进制字符串，为空表示没有
+func decodeHexField(s string, size int, name string) ([]byte, error) {
+	p, err := hex.DecodeString(s)
+	if err != nil || (len(p) != 0 && len(p) != size) {
+		return nil, fmt.Errorf("非法的%s %q", name, s)
+	}
+	return p, nil
+}
@@ -0,0 +1,67 @@
+package block
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"errors"
+	"jhblockchain/utils"
+	"math/big"
+	"testing"
+)
+
+// 私钥 d 对应的 P-256 公钥
+func publicKeyOf(d int64) *ecdsa.PublicKey {
+	curve := elliptic.P256()
+	x, y := curve.ScalarBaseMult(big.NewInt(d).Bytes())
+	return &ecdsa.PublicKey{Curve: curve, X: x, Y: y}
+}
+
+// 地址是 X、Y（不补齐前导 0）拼接后 SHA-256 的 base58 编码，期望值由独立的实现计算
+func TestAddressFromPublicKey(t *testing.T) {
+	tests := []struct {
+		name string
+		d    int64
+		want string
+	}{
+		{"私钥为 1，公钥为基点", 1, "FZyJC4EMgLhjsgPFvPBm1WcvZsbE8bjb1B8pF64HjGyc"},
+		// X 只有 31 字节，补齐到 32 字节时地址是 3VyRB7mQFD9qmwy6uagwMKtaEtH9Ts343kdvDVe4WhCh
+		{"X 有前导 0", 379, "DgBdnfd61CJUwyRbapFMuSVqDgWxgaxC8AAfiAt2v7EC"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			pub := publicKeyOf(tt.d)
+			if got := AddressFromPublicKey(pub); got != tt.want {
+				t.Fatalf("地址 %s，期望 %s", got, tt.want)
+			}
+		})
+	}
+	if n := len(publicKeyOf(379).X.Bytes()); n != 31 {
+		t.Fatalf("私钥 379 的 X 坐标有 %d 字节，期望 31", n)
+	}
+}
+
+// 签名有效但发送地址不是签名公钥对应的地址时拒绝
+func TestSenderAddressMismatch(t *testing.T) {
+	miner := newTestAccount(t)
+	bc := mineTestChainBy(t, NewMemoryStore(), miner, 1)
+	other := newTestAccount(t)
+
+	// 以矿工的地址为发送方，用另一个账户的私钥签名
+	tx := NewChainTransaction(CHAIN_ID, 0, miner.address, "recipient", big.NewInt(10), big.NewInt(0))
+	r, s, err := ecdsa.Sign(rand.Reader, other.key, tx.hash[:])
+	if err != nil {
+		t.Fatal(err)
+	}
+	tx.senderPublicKey = &other.key.PublicKey
+	tx.signature = &utils.Signature{R: r, S: s}
+	if !tx.verifySignature() {
+		t.Fatal("签名本身应该有效")
+	}
+	if err := verifyTransaction(tx); !errors.Is(err, ErrSenderAddress) {
+		t.Fatalf("校验结果 %v，期望 %v", err, ErrSenderAddress)
+	}
+	if bc.AddTransaction(miner.address, "recipient", tx.value, tx.fee, 0, tx.senderPublicKey, tx.signature) {
+		t.Fatal("发送地址与公钥不符的交易进入了交易池")
+	}
+}
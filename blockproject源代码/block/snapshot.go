@@ -0,0 +1,179 @@
+package block
+
+import (
+	"errors"
+	"fmt"
+	"log"
+	"math/big"
+	"sort"
+
+	"github.com/fatih/color"
+)
+
+// 每隔多少个区块保存一次账户状态快照，0 表示不保存。快照包含每个区块的改动，大小随链长增长，不宜每个区块都保存
+var STATE_SNAPSHOT_INTERVAL uint64 = 100
+
+// 快照编码格式的版本，格式变化后旧快照作废，启动时重新重放全部区块
+const stateSnapshotVersion = 1
+
+var ErrSnapshotNotFound = errors.New("state snapshot not found")
+
+// 可以保存账户状态快照的存储。启动时先从快照恢复账户状态和累计工作量，
+// 只重放快照之后的区块，不需要从创世纪块开始读出整条链
+type SnapshotStore interface {
+	// 保存快照，覆盖之前的快照
+	SaveSnapshot(data []byte) error
+	// 读取最近保存的快照，没有快照时返回 ErrSnapshotNotFound
+	LoadSnapshot() ([]byte, error)
+}
+
+// 快照编码：版本 | 高度 | 该高度区块的哈希 | 账户状态 | 每个区块的累计工作量。
+// 恢复时要求存储中同一高度的区块哈希相同，链在快照之前发生过重组时快照作废
+func encodeSnapshot(head *Block, state *StateDB, work *workIndex) ([]byte, error) {
+	state.mux.RLock()
+	defer state.mux.RUnlock()
+	work.mux.RLock()
+	defer work.mux.RUnlock()
+	n := head.number.Uint64() + 1
+	if uint64(len(state.journal)) != n || uint64(len(work.total)) != n {
+		return nil, fmt.Errorf("账户状态高度 %d、累计工作量高度 %d 与区块 %d 不符", len(state.journal)-1, len(work.total)-1, n-1)
+	}
+
+	w := new(binWriter)
+	w.uvarint(stateSnapshotVersion)
+	w.uvarint(head.number.Uint64())
+	w.fixed(head.hash[:])
+	writeBalances(w, state.balances)
+	writeNonces(w, state.nonces)
+	w.uvarint(uint64(len(state.journal)))
+	for i := range state.journal {
+		writeBalances(w, state.journal[i])
+		writeNonces(w, state.nonceJournal[i])
+		writeBalances(w, state.rewards[i])
+		w.bigInt(work.total[i])
+	}
+	return w.buf, nil
+}
+
+func decodeSnapshot(data []byte) (uint64, [32]byte, *StateDB, *workIndex, error) {
+	var hash [32]byte
+	r := &binReader{data: data}
+	if v := r.uvarint(); r.err == nil && v != stateSnapshotVersion {
+		return 0, hash, nil, nil, fmt.Errorf("快照版本 %d 不支持", v)
+	}
+	height := r.uvarint()
+	r.fixed(hash[:])
+	state := NewStateDB()
+	state.balances = readBalances(r)
+	state.nonces = readNonces(r)
+	work := newWorkIndex()
+	n := r.uvarint()
+	if r.err == nil && n != height+1 {
+		return 0, hash, nil, nil, fmt.Errorf("快照高度 %d 与区块改动数 %d 不符", height, n)
+	}
+	for i := uint64(0); i < n && r.err == nil; i++ {
+		state.journal = append(state.journal, readBalances(r))
+		state.nonceJournal = append(state.nonceJournal, readNonces(r))
+		state.rewards = append(state.rewards, readBalances(r))
+		work.total = append(work.total, r.bigInt())
+	}
+	if err := r.finish(); err != nil {
+		return 0, hash, nil, nil, err
+	}
+	return height, hash, state, work, nil
+}
+
+// 按地址排序写入，相同的状态总是得到相同的编码
+func writeBalances(w *binWriter, m map[string]*big.Int) {
+	addrs := make([]string, 0, len(m))
+	for addr := range m {
+		addrs = append(addrs, addr)
+	}
+	sort.Strings(addrs)
+	w.uvarint(uint64(len(addrs)))
+	for _, addr := range addrs {
+		w.string(addr)
+		w.bigInt(m[addr])
+	}
+}
+
+func readBalances(r *binReader) map[string]*big.Int {
+	n := r.uvarint()
+	m := make(map[string]*big.Int)
+	for i := uint64(0); i < n && r.err == nil; i++ {
+		addr := r.string()
+		m[addr] = r.bigInt()
+	}
+	return m
+}
+
+func writeNonces(w *binWriter, m map[string]uint64) {
+	addrs := make([]string, 0, len(m))
+	for addr := range m {
+		addrs = append(addrs, addr)
+	}
+	sort.Strings(addrs)
+	w.uvarint(uint64(len(addrs)))
+	for _, addr := range addrs {
+		w.string(addr)
+		w.uvarint(m[addr])
+	}
+}
+
+func readNonces(r *binReader) map[string]uint64 {
+	n := r.uvarint()
+	m := make(map[string]uint64)
+	for i := uint64(0); i < n && r.err == nil; i++ {
+		addr := r.string()
+		m[addr] = r.uvarint()
+	}
+	return m
+}
+
+// 从存储中的快照恢复账户状态和累计工作量，返回快照的高度。
+// 存储不支持快照、没有快照或快照与存储中的链不一致时返回 -1，由调用方从创世纪块开始重放
+func (bc *Blockchain) restoreSnapshot() int64 {
+	ss, ok := bc.store.(SnapshotStore)
+	if !ok {
+		return -1
+	}
+	data, err := ss.LoadSnapshot()
+	if errors.Is(err, ErrSnapshotNotFound) {
+		return -1
+	}
+	if err != nil {
+		color.Red("读取账户状态快照失败，重放全部区块：%v", err)
+		return -1
+	}
+	height, hash, state, work, err := decodeSnapshot(data)
+	if err != nil {
+		color.Red("账户状态快照损坏，重放全部区块：%v", err)
+		return -1
+	}
+	b, err := bc.store.GetByNumber(height)
+	if err != nil || b.hash != hash {
+		color.Yellow("账户状态快照的区块 %d 已不在链上，重放全部区块", height)
+		return -1
+	}
+	bc.state = state
+	bc.work = work
+	return int64(height)
+}
+
+// 保存账户状态的快照，head 为状态当前高度的区块，存储不支持快照时什么也不做。
+// 快照只用于加快启动，保存失败不影响运行
+func (bc *Blockchain) saveSnapshot(head *Block) {
+	ss, ok := bc.store.(SnapshotStore)
+	if !ok || STATE_SNAPSHOT_INTERVAL == 0 {
+		return
+	}
+	data, err := encodeSnapshot(head, bc.state, bc.work)
+	if err == nil {
+		err = ss.SaveSnapshot(data)
+	}
+	if err != nil {
+		color.Red("保存账户状态快照失败：%v", err)
+		return
+	}
+	log.Printf("保存账户状态快照，高度 %v", head.number)
+}
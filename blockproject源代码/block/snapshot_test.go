@@ -0,0 +1,102 @@
+package block
+
+import (
+	"testing"
+)
+
+// 记录启动时是否从创世纪块开始遍历了整个存储
+type replayCountStore struct {
+	*DBStore
+	iterated bool
+}
+
+func (s *replayCountStore) Iterate(fn func(b *Block) bool) error {
+	s.iterated = true
+	return s.DBStore.Iterate(fn)
+}
+
+func openTestDB(t *testing.T, dir string) *DBStore {
+	t.Helper()
+	store, err := NewDBStore(dir, SYNC_NEVER)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return store
+}
+
+// 重新打开数据库后从快照恢复的账户状态与重放全部区块得到的一致；
+// 快照缺失、损坏或不在链上时重放全部区块
+func TestSnapshotRestore(t *testing.T) {
+	interval := STATE_SNAPSHOT_INTERVAL
+	STATE_SNAPSHOT_INTERVAL = 2
+	defer func() { STATE_SNAPSHOT_INTERVAL = interval }()
+
+	dir := t.TempDir()
+	store := openTestDB(t, dir)
+	bc := mineTestChain(t, store, 5)
+	head, _ := store.Head()
+	// 最近的快照在区块 4，区块 5 需要重放
+	snapshot, err := store.LoadSnapshot()
+	if err != nil {
+		t.Fatal(err)
+	}
+	height, _, _, _, err := decodeSnapshot(snapshot)
+	if err != nil || height != 4 {
+		t.Fatalf("快照高度 %d，错误 %v", height, err)
+	}
+	fake := *head
+	fake.hash[0] ^= 0xff
+	stale, err := encodeSnapshot(&fake, bc.state, bc.work)
+	if err != nil {
+		t.Fatal(err)
+	}
+	store.Close()
+
+	tests := []struct {
+		name     string
+		snapshot []byte
+		iterate  bool
+	}{
+		{"从快照恢复", snapshot, false},
+		{"快照损坏", []byte("garbage"), true},
+		{"快照的区块不在链上", stale, true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			db := openTestDB(t, dir)
+			defer db.Close()
+			if err := db.SaveSnapshot(tt.snapshot); err != nil {
+				t.Fatal(err)
+			}
+			counting := &replayCountStore{DBStore: db}
+			restored, err := NewBlockchainWithStore(bc.blockchainAddress, 5001, counting)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if counting.iterated != tt.iterate {
+				t.Errorf("遍历整个存储 %v，期望 %v", counting.iterated, tt.iterate)
+			}
+			if restored.state.Height() != bc.state.Height() || restored.TotalWork().Cmp(bc.TotalWork()) != 0 {
+				t.Fatalf("高度 %d 工作量 %v，原链为 %d %v",
+					restored.state.Height(), restored.TotalWork(), bc.state.Height(), bc.TotalWork())
+			}
+			for _, addr := range []string{bc.blockchainAddress, "recipient"} {
+				if restored.state.Balance(addr).Cmp(bc.state.Balance(addr)) != 0 ||
+					restored.state.Spendable(addr).Cmp(bc.state.Spendable(addr)) != 0 ||
+					restored.state.Nonce(addr) != bc.state.Nonce(addr) {
+					t.Errorf("%s 的状态与原链不同", addr)
+				}
+			}
+			for h := int64(0); h <= bc.state.Height(); h++ {
+				want, _ := bc.state.StateAt(h)
+				got, err := restored.state.StateAt(h)
+				if err != nil {
+					t.Fatal(err)
+				}
+				if got.Balance(bc.blockchainAddress).Cmp(want.Balance(bc.blockchainAddress)) != 0 {
+					t.Errorf("高度 %d 的历史余额与原链不同", h)
+				}
+			}
+		})
+	}
+}
@@ -0,0 +1,296 @@
+package block
+
+import (
+	"fmt"
+	"math/big"
+	"sync"
+)
+
+// 一个区块对各地址余额的改动
+type stateDiff map[string]*big.Int
+
+// 一个区块中各发送方上链的交易数，即交易序号的增量
+type nonceDiff map[string]uint64
+
+// 账户状态表，保存每个地址的余额和下一笔交易的序号。
+// 区块追加到链上时增量更新，同时记录每个区块的改动，
+// 用于重组时回滚以及查询历史高度的余额
+type StateDB struct {
+	mux      sync.RWMutex
+	balances map[string]*big.Int
+	nonces   map[string]uint64
+	// journal[i] 是区块 i 的改动
+	journal []stateDiff
+	// nonceJournal[i] 是区块 i 对交易序号的改动
+	nonceJournal []nonceDiff
+	// rewards[i] 是区块 i 中挖矿奖励的收入，用于计算尚未成熟的余额
+	rewards []stateDiff
+}
+
+func NewStateDB() *StateDB {
+	return &StateDB{
+		balances:     make(map[string]*big.Int),
+		nonces:       make(map[string]uint64),
+		journal:      make([]stateDiff, 0),
+		nonceJournal: make([]nonceDiff, 0),
+		rewards:      make([]stateDiff, 0),
+	}
+}
+
+// 复制一份状态，之后两者互不影响。用于在不改动本地状态的情况下回滚并校验其他分支
+func (s *StateDB) Copy() *StateDB {
+	s.mux.RLock()
+	defer s.mux.RUnlock()
+	balances := make(map[string]*big.Int, len(s.balances))
+	for addr, v := range s.balances {
+		balances[addr] = new(big.Int).Set(v)
+	}
+	nonces := make(map[string]uint64, len(s.nonces))
+	for addr, n := range s.nonces {
+		nonces[addr] = n
+	}
+	// 每个区块的改动写入后不再修改，可以共用
+	return &StateDB{
+		balances:     balances,
+		nonces:       nonces,
+		journal:      append([]stateDiff(nil), s.journal...),
+		nonceJournal: append([]nonceDiff(nil), s.nonceJournal...),
+		rewards:      append([]stateDiff(nil), s.rewards...),
+	}
+}
+
+// 当前状态对应的区块高度，空状态返回 -1
+func (s *StateDB) Height() int64 {
+	s.mux.RLock()
+	defer s.mux.RUnlock()
+	return int64(len(s.journal)) - 1
+}
+
+// 返回地址的当前余额
+func (s *StateDB) Balance(address string) *big.Int {
+	s.mux.RLock()
+	defer s.mux.RUnlock()
+	return s.balance(address)
+}
+
+// 地址尚未成熟的挖矿奖励，即下一个区块中还不能花费的部分
+func (s *StateDB) Immature(address string) *big.Int {
+	s.mux.RLock()
+	defer s.mux.RUnlock()
+	return s.immature(address, int64(len(s.journal)))
+}
+
+// 地址在下一个区块中可以花费的余额，不含尚未成熟的挖矿奖励
+func (s *StateDB) Spendable(address string) *big.Int {
+	s.mux.RLock()
+	defer s.mux.RUnlock()
+	return new(big.Int).Sub(s.balance(address), s.immature(address, int64(len(s.journal))))
+}
+
+// 地址下一笔上链交易应使用的序号，即已上链的交易数
+func (s *StateDB) Nonce(address string) uint64 {
+	s.mux.RLock()
+	defer s.mux.RUnlock()
+	return s.nonces[address]
+}
+
+func (s *StateDB) balance(address string) *big.Int {
+	if v, ok := s.balances[address]; ok {
+		return new(big.Int).Set(v)
+	}
+	return big.NewInt(0)
+}
+
+// 下一个区块为 next 时地址尚未成熟的挖矿奖励
+func (s *StateDB) immature(address string, next int64) *big.Int {
+	total := new(big.Int)
+	from, to := immatureRange(next)
+	for i := from; i < to; i++ {
+		if v, ok := s.rewards[i][address]; ok {
+			total.Add(total, v)
+		}
+	}
+	return total
+}
+
+// 把区块的交易应用到状态上，区块必须紧接在当前高度之后
+func (s *StateDB) ApplyBlock(b *Block) error {
+	s.mux.Lock()
+	defer s.mux.Unlock()
+	if err := checkNumber(b, uint64(len(s.journal))); err != nil {
+		return err
+	}
+	diff := blockStateDiff(b)
+	for addr, delta := range diff {
+		s.add(addr, delta)
+	}
+	nonces := blockNonceDiff(b)
+	for addr, n := range nonces {
+		s.nonces[addr] += n
+	}
+	s.journal = append(s.journal, diff)
+	s.nonceJournal = append(s.nonceJournal, nonces)
+	s.rewards = append(s.rewards, blockRewardDiff(b))
+	return nil
+}
+
+// 撤销最后一个区块的改动
+func (s *StateDB) RevertBlock() error {
+	s.mux.Lock()
+	defer s.mux.Unlock()
+	if len(s.journal) == 0 {
+		return fmt.Errorf("状态为空，无法回滚")
+	}
+	s.revert()
+	return nil
+}
+
+// 回滚到指定高度，height 为 -1 时清空状态
+func (s *StateDB) RevertTo(height int64) error {
+	s.mux.Lock()
+	defer s.mux.Unlock()
+	if height < -1 || height >= int64(len(s.journal)) {
+		return fmt.Errorf("无法回滚到高度 %d，当前高度 %d", height, len(s.journal)-1)
+	}
+	for int64(len(s.journal))-1 > height {
+		s.revert()
+	}
+	return nil
+}
+
+// 返回指定高度时的余额和交易序号快照，快照之后不随链的变化而改变
+func (s *StateDB) StateAt(height int64) (*AccountState, error) {
+	s.mux.RLock()
+	defer s.mux.RUnlock()
+	if height < -1 || height >= int64(len(s.journal)) {
+		return nil, fmt.Errorf("高度 %d 超出范围，当前高度 %d", height, len(s.journal)-1)
+	}
+	balances := make(map[string]*big.Int, len(s.balances))
+	for addr, v := range s.balances {
+		balances[addr] = new(big.Int).Set(v)
+	}
+	for i := int64(len(s.journal)) - 1; i > height; i-- {
+		for addr, delta := range s.journal[i] {
+			v, ok := balances[addr]
+			if !ok {
+				v = new(big.Int)
+				balances[addr] = v
+			}
+			v.Sub(v, delta)
+		}
+	}
+	nonces := make(map[string]uint64, len(s.nonces))
+	for addr, n := range s.nonces {
+		nonces[addr] = n
+	}
+	for i := int64(len(s.nonceJournal)) - 1; i > height; i-- {
+		for addr, n := range s.nonceJournal[i] {
+			nonces[addr] -= n
+		}
+	}
+	immature := make(map[string]*big.Int)
+	from, to := immatureRange(height + 1)
+	for i := from; i < to; i++ {
+		for addr, v := range s.rewards[i] {
+			if _, ok := immature[addr]; !ok {
+				immature[addr] = new(big.Int)
+			}
+			immature[addr].Add(immature[addr], v)
+		}
+	}
+	return &AccountState{height: height, balances: balances, nonces: nonces, immature: immature}, nil
+}
+
+func (s *StateDB) add(addr string, delta *big.Int) {
+	v, ok := s.balances[addr]
+	if !ok {
+		v = new(big.Int)
+		s.balances[addr] = v
+	}
+	v.Add(v, delta)
+	if v.Sign() == 0 {
+		delete(s.balances, addr)
+	}
+}
+
+func (s *StateDB) revert() {
+	last := s.journal[len(s.journal)-1]
+	for addr, delta := range last {
+		s.add(addr, new(big.Int).Neg(delta))
+	}
+	for addr, n := range s.nonceJournal[len(s.nonceJournal)-1] {
+		s.nonces[addr] -= n
+		if s.nonces[addr] == 0 {
+			delete(s.nonces, addr)
+		}
+	}
+	s.journal = s.journal[:len(s.journal)-1]
+	s.nonceJournal = s.nonceJournal[:len(s.nonceJournal)-1]
+	s.rewards = s.rewards[:len(s.rewards)-1]
+}
+
+// 计算区块中所有交易对余额的改动：发送方减少金额和交易费，接收方增加金额。
+// 交易费由矿工在挖矿奖励交易中领取
+func blockStateDiff(b *Block) stateDiff {
+	diff := make(stateDiff)
+	for _, t := range b.transactions {
+		if t.value == nil {
+			continue
+		}
+		if _, ok := diff[t.senderAddress]; !ok {
+			diff[t.senderAddress] = new(big.Int)
+		}
+		if _, ok := diff[t.receiveAddress]; !ok {
+			diff[t.receiveAddress] = new(big.Int)
+		}
+		diff[t.senderAddress].Sub(diff[t.senderAddress], t.cost())
+		diff[t.receiveAddress].Add(diff[t.receiveAddress], t.value)
+	}
+	return diff
+}
+
+// 区块中每个发送方的普通交易数，挖矿奖励交易不使用交易序号
+func blockNonceDiff(b *Block) nonceDiff {
+	diff := make(nonceDiff)
+	for _, t := range b.transactions {
+		if !t.IsCoinbase() {
+			diff[t.senderAddress]++
+		}
+	}
+	return diff
+}
+
+// 某个高度的只读余额快照
+type AccountState struct {
+	height   int64
+	balances map[string]*big.Int
+	nonces   map[string]uint64
+	// 在 height 之后的下一个区块中仍未成熟的挖矿奖励
+	immature map[string]*big.Int
+}
+
+func (as *AccountState) Height() int64 {
+	return as.height
+}
+
+func (as *AccountState) Balance(address string) *big.Int {
+	if v, ok := as.balances[address]; ok {
+		return new(big.Int).Set(v)
+	}
+	return big.NewInt(0)
+}
+
+func (as *AccountState) Nonce(address string) uint64 {
+	return as.nonces[address]
+}
+
+func (as *AccountState) Immature(address string) *big.Int {
+	if v, ok := as.immature[address]; ok {
+		return new(big.Int).Set(v)
+	}
+	return big.NewInt(0)
+}
+
+func (as *AccountState) Spendable(address string) *big.Int {
+	return new(big.Int).Sub(as.Balance(address), as.Immature(address))
+}
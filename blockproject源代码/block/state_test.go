@@ -0,0 +1,117 @@
+package block
+
+import (
+	"fmt"
+	"testing"
+)
+
+// 各地址在某个高度的余额和交易序号
+type accountSnapshot map[string]string
+
+func snapshotOf(state BalanceReader, addrs []string) accountSnapshot {
+	snap := make(accountSnapshot)
+	for _, addr := range addrs {
+		snap[addr] = fmt.Sprintf("%v/%d", state.Balance(addr), state.Nonce(addr))
+	}
+	return snap
+}
+
+// 每出一个区块记录一次各地址的余额和交易序号，StateAt 和 RevertTo 得到的状态与当时记录的完全相同
+func TestStateRevertAndStateAt(t *testing.T) {
+	miner, alice := newTestAccount(t), newTestAccount(t)
+	store := NewMemoryStore()
+	bc := mineTestChainBy(t, store, miner, 2)
+	addrs := []string{miner.address, alice.address, "bob", "recipient", MINING_ACCOUNT_ADDRESS}
+
+	// 区块 0 到 2 由 mineTestChainBy 挖出，从头重放记录这几个高度的状态
+	replay := NewStateDB()
+	history := make([]accountSnapshot, 0)
+	store.Iterate(func(b *Block) bool {
+		if err := replay.ApplyBlock(b); err != nil {
+			t.Fatal(err)
+		}
+		history = append(history, snapshotOf(replay, addrs))
+		return true
+	})
+	mine := func() {
+		t.Helper()
+		mineBlocks(t, bc, 1)
+		history = append(history, snapshotOf(bc.state, addrs))
+	}
+	if !miner.send(t, bc, alice.address, 1000, 0, 1) {
+		t.Fatal("转账没有进入交易池")
+	}
+	mine()
+	if !alice.send(t, bc, "bob", 100, 2, 0) || !miner.send(t, bc, alice.address, 5, 0, 2) {
+		t.Fatal("转账没有进入交易池")
+	}
+	mine()
+	mine()
+	head := int64(len(history)) - 1
+	if head != bc.state.Height() {
+		t.Fatalf("记录了 %d 个高度，状态高度 %d", len(history), bc.state.Height())
+	}
+
+	for h := int64(0); h <= head; h++ {
+		as, err := bc.StateAt(h)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if got := snapshotOf(as, addrs); fmt.Sprint(got) != fmt.Sprint(history[h]) {
+			t.Errorf("StateAt(%d) 为 %v，期望 %v", h, got, history[h])
+		}
+
+		reverted := bc.state.Copy()
+		if err := reverted.RevertTo(h); err != nil {
+			t.Fatal(err)
+		}
+		if reverted.Height() != h {
+			t.Fatalf("RevertTo(%d) 后高度 %d", h, reverted.Height())
+		}
+		if got := snapshotOf(reverted, addrs); fmt.Sprint(got) != fmt.Sprint(history[h]) {
+			t.Errorf("RevertTo(%d) 后为 %v，期望 %v", h, got, history[h])
+		}
+		// 回滚后重新应用之后的区块，回到链尾的状态
+		for n := h + 1; n <= head; n++ {
+			b, _ := store.GetByNumber(uint64(n))
+			if err := reverted.ApplyBlock(b); err != nil {
+				t.Fatal(err)
+			}
+		}
+		if got := snapshotOf(reverted, addrs); fmt.Sprint(got) != fmt.Sprint(history[head]) {
+			t.Errorf("从高度 %d 重新应用后为 %v，期望 %v", h, got, history[head])
+		}
+	}
+
+	empty := bc.state.Copy()
+	if err := empty.RevertTo(-1); err != nil {
+		t.Fatal(err)
+	}
+	if empty.Height() != -1 || len(empty.balances) != 0 || len(empty.nonces) != 0 {
+		t.Fatalf("RevertTo(-1) 后高度 %d，还有 %d 个余额、%d 个交易序号", empty.Height(), len(empty.balances), len(empty.nonces))
+	}
+	if err := empty.RevertBlock(); err == nil {
+		t.Fatal("空状态不能再回滚")
+	}
+	if _, err := bc.StateAt(-1); err != nil {
+		t.Fatalf("StateAt(-1)：%v", err)
+	}
+}
+
+// 超出范围的高度返回错误，状态保持不变
+func TestStateRevertOutOfRange(t *testing.T) {
+	bc, _ := minedTestChain(t, 3)
+	addrs := []string{bc.blockchainAddress, "recipient"}
+	before := fmt.Sprint(snapshotOf(bc.state, addrs))
+	for _, h := range []int64{-2, 4, 100} {
+		if err := bc.state.RevertTo(h); err == nil {
+			t.Errorf("RevertTo(%d) 应该返回错误", h)
+		}
+		if _, err := bc.StateAt(h); err == nil {
+			t.Errorf("StateAt(%d) 应该返回错误", h)
+		}
+	}
+	if bc.state.Height() != 3 || fmt.Sprint(snapshotOf(bc.state, addrs)) != before {
+		t.Fatal("出错的回滚改变了状态")
+	}
+}
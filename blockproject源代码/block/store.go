@@ -0,0 +1,426 @@
+package block
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"math/big"
+	"os"
+	"path/filepath"
+	"sort"
+	"sync"
+
+	"github.com/fatih/color"
+)
+
+const (
+	STORE_FILE   = "file"
+	STORE_MEMORY = "memory"
+	STORE_DB     = "db"
+
+	// 文件存储使用的文件名，位于数据目录下
+	BLOCK_LOG_NAME = "blocks.log"
+	// 旧版本使用的 JSON 行文件，打开时自动导入
+	LEGACY_BLOCK_FILE_NAME = "blockchain.txt"
+)
+
+var (
+	ErrBlockNotFound       = errors.New("block not found")
+	ErrTransactionNotFound = errors.New("transaction not found")
+)
+
+// 交易在链上的位置：所在区块号和在区块交易列表中的下标
+type TxLocation struct {
+	Number uint64
+	Index  int
+}
+
+func (loc TxLocation) Less(other TxLocation) bool {
+	if loc.Number != other.Number {
+		return loc.Number < other.Number
+	}
+	return loc.Index < other.Index
+}
+
+// 格式为 "区块号-下标"，用作分页游标
+func (loc TxLocation) String() string {
+	return fmt.Sprintf("%d-%d", loc.Number, loc.Index)
+}
+
+func ParseTxLocation(s string) (TxLocation, error) {
+	var loc TxLocation
+	if _, err := fmt.Sscanf(s, "%d-%d", &loc.Number, &loc.Index); err != nil || loc.Index < 0 {
+		return loc, fmt.Errorf("非法的交易位置 %q", s)
+	}
+	return loc, nil
+}
+
+// 地址索引中的一条记录
+type AddressTx struct {
+	Location TxLocation
+	Hash     [32]byte
+	// 执行完这笔交易后地址的余额
+	Balance *big.Int
+}
+
+// 区块存储接口，Blockchain 通过它读写区块，而不关心底层是文件还是内存
+type BlockStore interface {
+	// 在链尾追加一个区块
+	Append(b *Block) error
+	// 根据区块号查询区块，不存在时返回 ErrBlockNotFound
+	GetByNumber(number uint64) (*Block, error)
+	// 根据区块哈希查询区块，不存在时返回 ErrBlockNotFound
+	GetByHash(hash [32]byte) (*Block, error)
+	// 从创世块开始按顺序遍历区块，fn 返回 false 时停止遍历
+	Iterate(fn func(b *Block) bool) error
+	// 返回最后一个区块，空链时返回 ErrBlockNotFound
+	Head() (*Block, error)
+	// 根据交易哈希查询交易位置，不存在时返回 ErrTransactionNotFound
+	GetTxLocation(hash [32]byte) (TxLocation, error)
+	// 按从新到旧的顺序返回与地址相关（发送或接收）的交易，
+	// before 不为 nil 时只返回位于 before 之前的交易，limit <= 0 表示不限数量
+	AddressTransactions(address string, before *TxLocation, limit int) ([]AddressTx, error)
+	// 删除区块号 number 及之后的区块，再依次追加 blocks，用于链重组。
+	// 替换是原子的：出错时存储保持原样，进程中途退出后重新打开看到的也是替换前或替换后的链
+	ReplaceFrom(number uint64, blocks []*Block) error
+	Close() error
+}
+
+// 根据存储类型打开区块存储
+// kind 为 "file" 或 "db" 时区块保存在 datadir 目录下，为 "memory" 时只保存在内存中
+// sync 决定写入区块后何时刷盘，对内存存储无效
+func OpenStore(kind string, datadir string, sync SyncPolicy) (BlockStore, error) {
+	switch kind {
+	case STORE_FILE:
+		return NewFileStore(datadir, sync)
+	case STORE_DB:
+		return NewDBStore(datadir, sync)
+	case STORE_MEMORY:
+		return NewMemoryStore(), nil
+	default:
+		return nil, fmt.Errorf("unknown store type %q", kind)
+	}
+}
+
+// 内存存储，进程退出后区块丢失，适合测试和临时节点
+type MemoryStore struct {
+	mux    sync.RWMutex
+	blocks []*Block
+	byHash map[[32]byte]*Block
+	txs    map[[32]byte]TxLocation
+	// 每个地址的交易按链上顺序排列
+	addresses map[string][]AddressTx
+}
+
+func NewMemoryStore() *MemoryStore {
+	ms := new(MemoryStore)
+	ms.reset()
+	return ms
+}
+
+func (ms *MemoryStore) reset() {
+	ms.blocks = make([]*Block, 0)
+	ms.byHash = make(map[[32]byte]*Block)
+	ms.txs = make(map[[32]byte]TxLocation)
+	ms.addresses = make(map[string][]AddressTx)
+}
+
+func (ms *MemoryStore) Append(b *Block) error {
+	ms.mux.Lock()
+	defer ms.mux.Unlock()
+	return ms.append(b)
+}
+
+func (ms *MemoryStore) append(b *Block) error {
+	number := uint64(len(ms.blocks))
+	if err := checkNumber(b, number); err != nil {
+		return err
+	}
+	ms.blocks = append(ms.blocks, b)
+	ms.byHash[b.hash] = b
+	for i, t := range b.transactions {
+		loc := TxLocation{Number: number, Index: i}
+		ms.txs[t.hash] = loc
+		for _, addr := range t.addresses() {
+			balance := new(big.Int)
+			if list := ms.addresses[addr]; len(list) > 0 {
+				balance.Set(list[len(list)-1].Balance)
+			}
+			balance.Add(balance, t.balanceDelta(addr))
+			ms.addresses[addr] = append(ms.addresses[addr], AddressTx{Location: loc, Hash: t.hash, Balance: balance})
+		}
+	}
+	return nil
+}
+
+func (ms *MemoryStore) GetByNumber(number uint64) (*Block, error) {
+	ms.mux.RLock()
+	defer ms.mux.RUnlock()
+	if number >= uint64(len(ms.blocks)) {
+		return nil, ErrBlockNotFound
+	}
+	return ms.blocks[number], nil
+}
+
+func (ms *MemoryStore) GetByHash(hash [32]byte) (*Block, error) {
+	ms.mux.RLock()
+	defer ms.mux.RUnlock()
+	b, ok := ms.byHash[hash]
+	if !ok {
+		return nil, ErrBlockNotFound
+	}
+	return b, nil
+}
+
+func (ms *MemoryStore) Iterate(fn func(b *Block) bool) error {
+	ms.mux.RLock()
+	blocks := ms.blocks
+	ms.mux.RUnlock()
+	for _, b := range blocks {
+		if !fn(b) {
+			break
+		}
+	}
+	return nil
+}
+
+func (ms *MemoryStore) Head() (*Block, error) {
+	ms.mux.RLock()
+	defer ms.mux.RUnlock()
+	if len(ms.blocks) == 0 {
+		return nil, ErrBlockNotFound
+	}
+	return ms.blocks[len(ms.blocks)-1], nil
+}
+
+func (ms *MemoryStore) GetTxLocation(hash [32]byte) (TxLocation, error) {
+	ms.mux.RLock()
+	defer ms.mux.RUnlock()
+	loc, ok := ms.txs[hash]
+	if !ok {
+		return TxLocation{}, ErrTransactionNotFound
+	}
+	return loc, nil
+}
+
+func (ms *MemoryStore) AddressTransactions(address string, before *TxLocation, limit int) ([]AddressTx, error) {
+	ms.mux.RLock()
+	defer ms.mux.RUnlock()
+	list := ms.addresses[address]
+	end := len(list)
+	if before != nil {
+		end = sort.Search(len(list), func(i int) bool {
+			return !list[i].Location.Less(*before)
+		})
+	}
+	txs := make([]AddressTx, 0)
+	for i := end - 1; i >= 0 && (limit <= 0 || len(txs) < limit); i-- {
+		txs = append(txs, list[i])
+	}
+	return txs, nil
+}
+
+func (ms *MemoryStore) ReplaceFrom(number uint64, blocks []*Block) error {
+	ms.mux.Lock()
+	defer ms.mux.Unlock()
+	next, err := ms.replaced(number, blocks)
+	if err != nil {
+		return err
+	}
+	ms.adopt(next)
+	return nil
+}
+
+// 在新的内存存储里构造替换后的链，调用方需持有锁，构造失败不影响当前存储
+func (ms *MemoryStore) replaced(number uint64, blocks []*Block) (*MemoryStore, error) {
+	if number > uint64(len(ms.blocks)) {
+		return nil, fmt.Errorf("无法从区块 %d 开始替换，当前只有 %d 个区块", number, len(ms.blocks))
+	}
+	next := NewMemoryStore()
+	for _, b := range ms.blocks[:number] {
+		if err := next.append(b); err != nil {
+			return nil, err
+		}
+	}
+	for _, b := range blocks {
+		if err := next.append(b); err != nil {
+			return nil, err
+		}
+	}
+	return next, nil
+}
+
+func (ms *MemoryStore) adopt(next *MemoryStore) {
+	ms.blocks = next.blocks
+	ms.byHash = next.byHash
+	ms.txs = next.txs
+	ms.addresses = next.addresses
+}
+
+func (ms *MemoryStore) Close() error {
+	return nil
+}
+
+// 区块号必须紧跟在当前链尾之后
+func checkNumber(b *Block, expect uint64) error {
+	if b.number == nil || !b.number.IsUint64() || b.number.Uint64() != expect {
+		return fmt.Errorf("区块号不连续：期望 %d，实际 %v", expect, b.number)
+	}
+	return nil
+}
+
+// 文件存储，区块以带校验和的记录追加到 datadir/blocks.log
+// 打开时把已有区块全部读入内存，查询直接走内存
+type FileStore struct {
+	*MemoryStore
+	log  *BlockLog
+	path string
+	sync SyncPolicy
+}
+
+func NewFileStore(datadir string, sync SyncPolicy) (*FileStore, error) {
+	if err := os.MkdirAll(datadir, 0755); err != nil {
+		return nil, err
+	}
+	fs := &FileStore{
+		MemoryStore: NewMemoryStore(),
+		path:        filepath.Join(datadir, BLOCK_LOG_NAME),
+		sync:        sync,
+	}
+	if err := fs.migrateLegacy(filepath.Join(datadir, LEGACY_BLOCK_FILE_NAME)); err != nil {
+		return nil, err
+	}
+
+	l, recovery, err := OpenBlockLog(fs.path, sync, func(payload []byte) error {
+		b, err := decodeBlock(payload)
+		if err != nil {
+			return err
+		}
+		return fs.MemoryStore.Append(b)
+	})
+	if err != nil {
+		return nil, err
+	}
+	if recovery.TruncatedBytes > 0 {
+		color.Yellow("区块日志 %s 已恢复：%s", fs.path, recovery)
+	} else {
+		log.Printf("区块日志 %s：%s", fs.path, recovery)
+	}
+	fs.log = l
+	return fs, nil
+}
+
+// 旧版本把区块以 JSON 行保存在 blockchain.txt 中，
+// 数据目录里还没有区块日志时把其中完整的区块导入日志，旧文件保留不动。
+// 旧版本的区块哈希和交易不满足现在的校验规则（哈希算法不同、交易没有签名），
+// 整条链校验不通过时不导入，节点从新的创世纪块开始
+func (fs *FileStore) migrateLegacy(legacyPath string) error {
+	if _, err := os.Stat(fs.path); err == nil {
+		return nil
+	}
+	blocks, err := readLegacyBlocks(legacyPath)
+	if err != nil {
+		return err
+	}
+	if blocks == nil {
+		return nil
+	}
+	if err := VerifyChain(NewPoWEngine(1), blocks); err != nil {
+		color.Red("%s 中的区块不合法，不导入：%v", legacyPath, err)
+		return nil
+	}
+	payloads := make([][]byte, 0, len(blocks))
+	for _, b := range blocks {
+		m, err := b.MarshalJSON()
+		if err != nil {
+			return err
+		}
+		payloads = append(payloads, m)
+	}
+	if err := writeBlockLog(fs.path, payloads); err != nil {
+		return err
+	}
+	color.Yellow("已从 %s 导入 %d 个区块到 %s", legacyPath, len(blocks), fs.path)
+	return nil
+}
+
+// 检查区块号、写入日志和追加到内存在同一个写锁内完成，并发追加时不会写入两个相同区块号的区块
+func (fs *FileStore) Append(b *Block) error {
+	fs.mux.Lock()
+	defer fs.mux.Unlock()
+	if err := checkNumber(b, uint64(len(fs.blocks))); err != nil {
+		return err
+	}
+	m, err := b.MarshalJSON()
+	if err != nil {
+		return err
+	}
+	if err := fs.log.Append(m); err != nil {
+		return fmt.Errorf("无法写入区块日志：%w", err)
+	}
+	return fs.append(b)
+}
+
+// 新链先写入临时文件再重命名，替换过程中进程退出也不会留下半个文件。
+// 重组通常只涉及链尾的几个区块，但为了原子性仍整体重写日志
+func (fs *FileStore) ReplaceFrom(number uint64, blocks []*Block) error {
+	fs.mux.Lock()
+	defer fs.mux.Unlock()
+	next, err := fs.replaced(number, blocks)
+	if err != nil {
+		return err
+	}
+	payloads := make([][]byte, 0, len(next.blocks))
+	for _, b := range next.blocks {
+		m, err := b.MarshalJSON()
+		if err != nil {
+			return err
+		}
+		payloads = append(payloads, m)
+	}
+	if err := writeBlockLog(fs.path, payloads); err != nil {
+		return err
+	}
+	if err := fs.log.Close(); err != nil {
+		return err
+	}
+	l, _, err := OpenBlockLog(fs.path, fs.sync, func([]byte) error { return nil })
+	if err != nil {
+		return err
+	}
+	fs.log = l
+	fs.adopt(next)
+	return nil
+}
+
+func (fs *FileStore) Close() error {
+	return fs.log.Close()
+}
+
+// 读取旧版 JSON 行文件，文件不存在时返回 nil。
+// 旧格式没有校验和，遇到无法解析的行就认为是写了一半的尾部，丢弃它和之后的内容
+func readLegacyBlocks(path string) ([]*Block, error) {
+	file, err := os.Open(path)
+	if errors.Is(err, os.ErrNotExist) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+	blocks := make([]*Block, 0)
+
+	dec := json.NewDecoder(file)
+
+	for dec.More() {
+		var block *Block
+		if err := dec.Decode(&block); err != nil {
+			color.Yellow("%s 第 %d 个区块无法解析，丢弃之后的内容：%v", path, len(blocks), err)
+			break
+		}
+		blocks = append(blocks, block)
+	}
+
+	return blocks, nil
+}
@@ -0,0 +1,351 @@
+package block
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"math/big"
+	"os"
+	"path/filepath"
+	"sync"
+	"testing"
+)
+
+// 经过 JSON 编码复制区块，修改副本不影响存储中的区块
+func cloneBlock(t *testing.T, b *Block) *Block {
+	t.Helper()
+	m, err := b.MarshalJSON()
+	if err != nil {
+		t.Fatal(err)
+	}
+	c, err := decodeBlock(m)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return c
+}
+
+// 矿工连续出块时每个区块的挖矿奖励交易金额和接收方都相同，交易索引仍要指向各自的区块
+func TestCoinbaseTxIndexPerBlock(t *testing.T) {
+	stores := map[string]func(t *testing.T) BlockStore{
+		STORE_MEMORY: func(t *testing.T) BlockStore { return NewMemoryStore() },
+		STORE_DB: func(t *testing.T) BlockStore {
+			s, err := NewDBStore(t.TempDir(), SYNC_NEVER)
+			if err != nil {
+				t.Fatal(err)
+			}
+			t.Cleanup(func() { s.Close() })
+			return s
+		},
+	}
+	for name, open := range stores {
+		t.Run(name, func(t *testing.T) {
+			store := open(t)
+			bc, err := NewBlockchainWithStore("miner", 5000, store)
+			if err != nil {
+				t.Fatal(err)
+			}
+			for i := 0; i < 3; i++ {
+				if !bc.Mining() {
+					t.Fatalf("第 %d 个区块挖矿失败", i+1)
+				}
+			}
+			seen := make(map[[32]byte]bool)
+			for n := uint64(1); n <= 3; n++ {
+				b, err := store.GetByNumber(n)
+				if err != nil {
+					t.Fatal(err)
+				}
+				coinbase := b.transactions[len(b.transactions)-1]
+				if !coinbase.IsCoinbase() || coinbase.nonce != n {
+					t.Fatalf("区块 %d 的挖矿奖励交易序号 %d", n, coinbase.nonce)
+				}
+				if seen[coinbase.hash] {
+					t.Fatalf("区块 %d 的挖矿奖励交易哈希与之前的区块相同", n)
+				}
+				seen[coinbase.hash] = true
+				loc, err := store.GetTxLocation(coinbase.hash)
+				if err != nil {
+					t.Fatal(err)
+				}
+				if loc.Number != n {
+					t.Errorf("区块 %d 的挖矿奖励交易索引指向区块 %d", n, loc.Number)
+				}
+			}
+		})
+	}
+}
+
+func TestVerifyBodyCoinbaseNonce(t *testing.T) {
+	tests := []struct {
+		name string
+		txs  []*Transaction
+		err  error
+	}{
+		{"序号为区块号", []*Transaction{NewCoinbaseTransaction(5, "miner", big.NewInt(1))}, nil},
+		{"序号不是区块号", []*Transaction{NewCoinbaseTransaction(4, "miner", big.NewInt(1))}, ErrCoinbase},
+		{"重复的交易", []*Transaction{
+			NewCoinbaseTransaction(5, "miner", big.NewInt(1)),
+			NewCoinbaseTransaction(5, "miner", big.NewInt(1)),
+		}, ErrTxHash},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			b := NewBlock(big.NewInt(5), big.NewInt(0), [32]byte{}, tt.txs)
+			err := VerifyBody(b.Header(), b.transactions)
+			if tt.err == nil && err != nil {
+				t.Fatal(err)
+			}
+			if tt.err != nil && !errors.Is(err, tt.err) {
+				t.Fatalf("期望 %v，得到 %v", tt.err, err)
+			}
+		})
+	}
+}
+
+// 旧版 JSON 行文件中的链校验通过时导入区块日志，哈希与内容不符时不导入
+func TestMigrateLegacy(t *testing.T) {
+	_, store := minedTestChain(t, 3)
+	legacy := func(t *testing.T, mutate func(blocks []*Block)) string {
+		blocks := make([]*Block, 0)
+		for n := uint64(0); n <= 3; n++ {
+			b, err := store.GetByNumber(n)
+			if err != nil {
+				t.Fatal(err)
+			}
+			blocks = append(blocks, cloneBlock(t, b))
+		}
+		mutate(blocks)
+		var buf bytes.Buffer
+		for _, b := range blocks {
+			m, err := b.MarshalJSON()
+			if err != nil {
+				t.Fatal(err)
+			}
+			buf.Write(m)
+			buf.WriteByte('\n')
+		}
+		dir := t.TempDir()
+		if err := os.WriteFile(filepath.Join(dir, LEGACY_BLOCK_FILE_NAME), buf.Bytes(), 0644); err != nil {
+			t.Fatal(err)
+		}
+		return dir
+	}
+
+	tests := []struct {
+		name   string
+		mutate func(blocks []*Block)
+		blocks int
+	}{
+		{"合法的链", func([]*Block) {}, 4},
+		{"哈希与内容不符", func(blocks []*Block) { blocks[2].timestamp++ }, 0},
+		{"交易被修改", func(blocks []*Block) {
+			blocks[2].transactions[0].value = big.NewInt(1)
+		}, 0},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			fs, err := NewFileStore(legacy(t, tt.mutate), SYNC_NEVER)
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer fs.Close()
+			got := 0
+			fs.Iterate(func(*Block) bool {
+				got++
+				return true
+			})
+			if got != tt.blocks {
+				t.Fatalf("导入 %d 个区块，期望 %d 个", got, tt.blocks)
+			}
+		})
+	}
+}
+
+// 启动时校验存储中的区块，不在不合法的链上继续出块
+func TestReplayRejectsInvalidBlock(t *testing.T) {
+	bc, store := minedTestChain(t, 3)
+	head, err := store.GetByNumber(3)
+	if err != nil {
+		t.Fatal(err)
+	}
+	tampered := cloneBlock(t, head)
+	tampered.transactions[0].value = new(big.Int).Add(tampered.transactions[0].value, big.NewInt(1))
+	if err := store.ReplaceFrom(3, []*Block{tampered}); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := NewBlockchainWithStore(bc.blockchainAddress, 5001, store); !errors.Is(err, ErrTxHash) {
+		t.Fatalf("期望 ErrTxHash，得到 %v", err)
+	}
+}
+
+// 区块 from 到 to（含）组成的链，每个区块只有一笔给 miner 的挖矿奖励交易，miner 不同的链中区块和交易的哈希都不同
+func storeTestBlocks(from, to uint64, prev [32]byte, miner string) []*Block {
+	blocks := make([]*Block, 0)
+	for n := from; n <= to; n++ {
+		b := NewBlock(new(big.Int).SetUint64(n), big.NewInt(0), prev, []*Transaction{
+			NewCoinbaseTransaction(n, miner, big.NewInt(int64(MINING_REWARD))),
+		})
+		blocks = append(blocks, b)
+		prev = b.hash
+	}
+	return blocks
+}
+
+// 直接测试存储的 GetByNumber 和 ReplaceFrom：替换分叉点之后的区块和索引，出错时存储保持原样，文件存储重新打开后看到替换后的链
+func TestStoreReplaceFrom(t *testing.T) {
+	for _, kind := range []string{STORE_MEMORY, STORE_FILE} {
+		t.Run(kind, func(t *testing.T) {
+			dir := t.TempDir()
+			store, err := OpenStore(kind, dir, SYNC_NEVER)
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer func() { store.Close() }()
+
+			old := storeTestBlocks(0, 4, [32]byte{}, "old")
+			for _, b := range old {
+				if err := store.Append(b); err != nil {
+					t.Fatal(err)
+				}
+			}
+			if err := store.Append(old[2]); err == nil {
+				t.Fatal("区块号不连续的区块不应追加成功")
+			}
+			branch := storeTestBlocks(2, 5, old[1].hash, "new")
+			want := append(append([]*Block(nil), old[:2]...), branch...)
+
+			check := func(chain []*Block) {
+				t.Helper()
+				for n, b := range chain {
+					got, err := store.GetByNumber(uint64(n))
+					if err != nil || got.hash != b.hash {
+						t.Fatalf("区块 %d 与期望的链不同：%v", n, err)
+					}
+					loc, err := store.GetTxLocation(b.transactions[0].hash)
+					if err != nil || loc.Number != uint64(n) {
+						t.Fatalf("区块 %d 的交易索引 %v，%v", n, loc, err)
+					}
+				}
+				if _, err := store.GetByNumber(uint64(len(chain))); !errors.Is(err, ErrBlockNotFound) {
+					t.Fatalf("链尾之后的区块返回 %v", err)
+				}
+				if head, err := store.Head(); err != nil || head.hash != chain[len(chain)-1].hash {
+					t.Fatalf("链尾不是区块 %d：%v", len(chain)-1, err)
+				}
+			}
+			check(old)
+
+			// 分叉点超出链尾、新区块号不连续时都不替换
+			if err := store.ReplaceFrom(6, branch); err == nil {
+				t.Fatal("分叉点超出链尾时应该返回错误")
+			}
+			if err := store.ReplaceFrom(3, branch); err == nil {
+				t.Fatal("新区块号与分叉点不连续时应该返回错误")
+			}
+			check(old)
+
+			if err := store.ReplaceFrom(2, branch); err != nil {
+				t.Fatal(err)
+			}
+			check(want)
+			for _, b := range old[2:] {
+				if _, err := store.GetByHash(b.hash); !errors.Is(err, ErrBlockNotFound) {
+					t.Fatalf("被替换的区块 %v 仍能按哈希查到", b.number)
+				}
+				if _, err := store.GetTxLocation(b.transactions[0].hash); !errors.Is(err, ErrTransactionNotFound) {
+					t.Fatalf("被替换的区块 %v 中的交易仍能查到", b.number)
+				}
+			}
+			if history, _ := store.AddressTransactions("old", nil, 0); len(history) != 2 {
+				t.Fatalf("old 还有 %d 条交易记录，期望 2 条", len(history))
+			}
+
+			// 分叉点等于区块数时相当于追加
+			more := storeTestBlocks(6, 6, want[5].hash, "new")
+			if err := store.ReplaceFrom(6, more); err != nil {
+				t.Fatal(err)
+			}
+			want = append(want, more...)
+			check(want)
+			next := storeTestBlocks(7, 7, want[6].hash, "new")[0]
+			if err := store.Append(next); err != nil {
+				t.Fatalf("替换后追加区块：%v", err)
+			}
+			want = append(want, next)
+
+			if kind == STORE_MEMORY {
+				return
+			}
+			if err := store.Close(); err != nil {
+				t.Fatal(err)
+			}
+			if store, err = OpenStore(kind, dir, SYNC_NEVER); err != nil {
+				t.Fatal(err)
+			}
+			check(want)
+		})
+	}
+}
+
+// 并发追加同一个区块号时只有一个成功，日志中也只写入一次，重新打开后链不变
+func TestFileStoreConcurrentAppend(t *testing.T) {
+	dir := t.TempDir()
+	store, err := NewFileStore(dir, SYNC_NEVER)
+	if err != nil {
+		t.Fatal(err)
+	}
+	genesis := storeTestBlocks(0, 0, [32]byte{}, "genesis")[0]
+	if err := store.Append(genesis); err != nil {
+		t.Fatal(err)
+	}
+	const writers = 32
+	candidates := make([]*Block, 0, writers)
+	for i := 0; i < writers; i++ {
+		candidates = append(candidates, storeTestBlocks(1, 1, genesis.hash, fmt.Sprintf("miner%d", i))[0])
+	}
+	var wg sync.WaitGroup
+	var mux sync.Mutex
+	appended := make([]*Block, 0)
+	for _, b := range candidates {
+		wg.Add(1)
+		go func(b *Block) {
+			defer wg.Done()
+			if store.Append(b) == nil {
+				mux.Lock()
+				appended = append(appended, b)
+				mux.Unlock()
+			}
+		}(b)
+	}
+	wg.Wait()
+	if len(appended) != 1 {
+		t.Fatalf("%d 个区块 1 追加成功，期望 1 个", len(appended))
+	}
+	if err := store.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	records := 0
+	l, _, err := OpenBlockLog(filepath.Join(dir, BLOCK_LOG_NAME), SYNC_NEVER, func([]byte) error {
+		records++
+		return nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	l.Close()
+	if records != 2 {
+		t.Fatalf("区块日志中有 %d 条记录，期望 2 条", records)
+	}
+
+	reopened, err := NewFileStore(dir, SYNC_NEVER)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer reopened.Close()
+	head, err := reopened.Head()
+	if err != nil || head.hash != appended[0].hash || len(reopened.blocks) != 2 {
+		t.Fatalf("重新打开后有 %d 个区块，%v", len(reopened.blocks), err)
+	}
+}
@@ -0,0 +1,322 @@
+package block
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"log"
+	"math/big"
+	"net/http"
+	"strings"
+	"sync"
+
+	"github.com/fatih/color"
+)
+
+// 同步时并行下载区块体的连接数
+const SYNC_BODY_WORKERS = 4
+
+// 从邻居中选出累计工作量最大的合法链并切换过去，工作量相同时保留本地链。
+// 先通过 /status 比较邻居报告的创世纪块和累计工作量，只向创世纪块相同且更重的邻居下载区块头。
+// 下载区块头时发送本地链的区块定位器（见 Locator），邻居只返回共同祖先之后的区块头，
+// 只校验这一段并加上本地共同祖先处的累计工作量比较；工作量确实更大时，
+// 再并行下载分叉点之后的区块体，完整校验交易和余额后切换
+func (bc *Blockchain) ResolveConflicts() bool {
+	var heaviest []*BlockHeader
+	var source string
+	var start uint64
+	maxWork := bc.TotalWork()
+	genesis := bc.GenesisHash()
+	locator := bc.Locator()
+
+	for _, n := range bc.neighbors {
+		status, err := fetchStatus(n)
+		if err != nil {
+			color.Red("                 错误 ：ResolveConflicts 查询 %s 状态 %v", n, err)
+			continue
+		}
+		if status.ChainID != CHAIN_ID {
+			color.Red("邻居 %s 的链 ID %d 与本地 %d 不同，不同步", n, status.ChainID, CHAIN_ID)
+			continue
+		}
+		if status.GenesisHash != genesis {
+			color.Red("邻居 %s 的创世纪块 %x 与本地 %x 不同，不同步", n, status.GenesisHash, genesis)
+			continue
+		}
+		if status.TotalWork == nil || status.TotalWork.Cmp(maxWork) <= 0 {
+			continue
+		}
+
+		from, headers, err := fetchHeaders(n, locator, status.Height)
+		if err != nil {
+			color.Red("                 错误 ：ResolveConflicts 下载 %s 的区块头 %v", n, err)
+			continue
+		}
+		if len(headers) == 0 {
+			continue
+		}
+		work, err := bc.verifyHeaderBranch(from, headers)
+		if err != nil {
+			color.Red("邻居 %s 的区块头链不合法：%v", n, err)
+			continue
+		}
+		color.Cyan("   ResolveConflicts   %s headers:%d-%d work:%s", n, from, from+uint64(len(headers))-1, work)
+		if work.Cmp(maxWork) > 0 {
+			maxWork = work
+			heaviest = headers
+			source = n
+			start = from
+		}
+	}
+
+	if heaviest == nil {
+		log.Printf("Resovle conflicts not replaced")
+		return false
+	}
+	if err := bc.syncBranch(source, start, heaviest); err != nil {
+		color.Red("从 %s 同步区块失败 %v", source, err)
+		return false
+	}
+	log.Printf("Resovle confilicts replaced")
+	return true
+}
+
+// 本地链的区块定位器：从链尾往前，最近的 LOCATOR_DENSE 个区块逐个列出，之后间隔每次翻倍，最后是创世纪块。
+// 邻居在其中找到第一个在它链上的区块，就是两条链共同祖先的近似位置，只读 O(log n) 个区块
+func (bc *Blockchain) Locator() [][32]byte {
+	locator := make([][32]byte, 0, LOCATOR_DENSE+16)
+	head := bc.LastBlock().number.Uint64()
+	step := uint64(1)
+	for n := head; len(locator) < MAX_LOCATOR_HASHES; {
+		b, err := bc.store.GetByNumber(n)
+		if err != nil {
+			break
+		}
+		locator = append(locator, b.hash)
+		if n == 0 {
+			break
+		}
+		if len(locator) >= LOCATOR_DENSE {
+			step *= 2
+		}
+		if n < step {
+			n = 0
+		} else {
+			n -= step
+		}
+	}
+	return locator
+}
+
+// 校验从区块号 from 开始、接在本地区块 from-1 之后的区块头，返回这条链到最后一个区块头的累计工作量。
+// 区块头之前的难度和时间戳历史从本地链读取
+func (bc *Blockchain) verifyHeaderBranch(from uint64, headers []*BlockHeader) (*big.Int, error) {
+	work := new(big.Int)
+	var parent *BlockHeader
+	if from > 0 {
+		b, err := bc.store.GetByNumber(from - 1)
+		if err != nil {
+			return nil, fmt.Errorf("区块头从 %d 开始，本地没有区块 %d：%w", from, from-1, err)
+		}
+		parent = b.Header()
+		if work, err = bc.TotalWorkAt(from - 1); err != nil {
+			return nil, err
+		}
+	}
+	local := headersOf(bc.store.GetByNumber)
+	ancestor := func(number uint64) (*BlockHeader, error) {
+		if number < from {
+			return local(number)
+		}
+		if number-from >= uint64(len(headers)) {
+			return nil, ErrBlockNotFound
+		}
+		return headers[number-from], nil
+	}
+	if err := VerifyHeaderBranch(bc.engine, parent, headers, ancestor); err != nil {
+		return nil, err
+	}
+	return work.Add(work, HeaderChainWork(headers)), nil
+}
+
+// 下载分叉点之后的区块体，校验后切换到 headers 描述的链，headers 从区块号 from 开始
+func (bc *Blockchain) syncBranch(neighbor string, from uint64, headers []*BlockHeader) error {
+	fork, err := bc.headerForkPoint(from, headers)
+	if err != nil {
+		return err
+	}
+	if fork >= from+uint64(len(headers)) {
+		// 邻居的链是本地链的前缀，没有需要下载的区块
+		return nil
+	}
+	// 不会切换的分支不必下载区块体
+	if err := bc.checkFinality(fork); err != nil {
+		return err
+	}
+	branch, err := fetchBodies(neighbor, headers[fork-from:])
+	if err != nil {
+		return err
+	}
+	if err := bc.verifyBranch(fork, branch); err != nil {
+		return err
+	}
+	color.Cyan("   ResolveConflicts   分叉点 %d，从 %s 下载了 %d 个区块体", fork, neighbor, len(branch))
+	return bc.ReorganizeFrom(fork, branch)
+}
+
+// 完整校验接在本地区块 fork-1 之后的新分支，余额在分叉点的状态上逐块执行得到
+func (bc *Blockchain) verifyBranch(fork uint64, branch []*Block) error {
+	var prev *Block
+	if fork > 0 {
+		var err error
+		if prev, err = bc.store.GetByNumber(fork - 1); err != nil {
+			return err
+		}
+	}
+	ancestor := func(number uint64) (*Block, error) {
+		if number < fork {
+			return bc.store.GetByNumber(number)
+		}
+		if number-fork >= uint64(len(branch)) {
+			return nil, ErrBlockNotFound
+		}
+		return branch[number-fork], nil
+	}
+	// 在本地状态的副本上回滚到分叉点，再逐块执行新分支
+	state := bc.state.Copy()
+	if err := state.RevertTo(int64(fork) - 1); err != nil {
+		return err
+	}
+	for _, b := range branch {
+		if err := VerifyBlock(bc.engine, prev, b, ancestor); err != nil {
+			return err
+		}
+		if err := VerifyBalances(b, state); err != nil {
+			return err
+		}
+		if err := state.ApplyBlock(b); err != nil {
+			return err
+		}
+		prev = b
+	}
+	return nil
+}
+
+// 返回 headers 与本地链第一个不同区块的区块号，headers 从区块号 from 开始。
+// 定位器越往前越稀疏，共同祖先之后可能还有几个与本地相同的区块，只比较这一段。
+// 哈希相同但出块签名不同的区块不是同一个区块，也不能当成分叉替换本地区块，返回错误
+func (bc *Blockchain) headerForkPoint(from uint64, headers []*BlockHeader) (uint64, error) {
+	for i, h := range headers {
+		n := from + uint64(i)
+		local, err := bc.store.GetByNumber(n)
+		if err != nil || local.hash != h.hash {
+			return n, nil
+		}
+		if !bytes.Equal(local.seal, h.seal) {
+			return 0, headerError(h, ErrInvalidSeal, "出块签名与本地区块 %x 的不同", local.hash)
+		}
+	}
+	return from + uint64(len(headers)), nil
+}
+
+func fetchStatus(neighbor string) (*ChainStatus, error) {
+	status := new(ChainStatus)
+	if err := getJSON(fmt.Sprintf("http://%s/status", neighbor), status); err != nil {
+		return nil, err
+	}
+	return status, nil
+}
+
+// 分批下载邻居在共同祖先之后的区块头，最多下载到 height，返回第一个区块头的区块号和区块头。
+// 第一批请求带上区块定位器，由邻居决定从哪里开始；之后的批次按区块号接着下载。
+// 下载期间邻居的链可能继续增长，之后的区块留到下一轮同步
+func fetchHeaders(neighbor string, locator [][32]byte, height uint64) (uint64, []*BlockHeader, error) {
+	hashes := make([]string, 0, len(locator))
+	for _, h := range locator {
+		hashes = append(hashes, fmt.Sprintf("%x", h))
+	}
+	endpoint := fmt.Sprintf("http://%s/headers?locator=%s&count=%d", neighbor, strings.Join(hashes, ","), MAX_HEADERS_PER_REQUEST)
+	var headers []*BlockHeader
+	if err := getJSON(endpoint, &headers); err != nil {
+		return 0, nil, err
+	}
+	if len(headers) == 0 {
+		return 0, nil, nil
+	}
+	if len(headers) > MAX_HEADERS_PER_REQUEST || !fitsUint64(headers[0].number) {
+		return 0, nil, fmt.Errorf("邻居返回的区块头不合法")
+	}
+	from := headers[0].number.Uint64()
+	for next := from + uint64(len(headers)); next <= height; next = from + uint64(len(headers)) {
+		count := height - next + 1
+		if count > MAX_HEADERS_PER_REQUEST {
+			count = MAX_HEADERS_PER_REQUEST
+		}
+		var batch []*BlockHeader
+		endpoint := fmt.Sprintf("http://%s/headers?from=%d&count=%d", neighbor, next, count)
+		if err := getJSON(endpoint, &batch); err != nil {
+			return 0, nil, err
+		}
+		if len(batch) == 0 {
+			break
+		}
+		if uint64(len(batch)) > count {
+			return 0, nil, fmt.Errorf("请求 %d 个区块头，返回了 %d 个", count, len(batch))
+		}
+		headers = append(headers, batch...)
+	}
+	return from, headers, nil
+}
+
+// 用 SYNC_BODY_WORKERS 个连接并行下载 headers 对应的区块体，按 headers 的顺序返回组装好的区块
+func fetchBodies(neighbor string, headers []*BlockHeader) ([]*Block, error) {
+	blocks := make([]*Block, len(headers))
+	errs := make([]error, len(headers))
+	jobs := make(chan int)
+	var wg sync.WaitGroup
+	for w := 0; w < SYNC_BODY_WORKERS && w < len(headers); w++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for i := range jobs {
+				blocks[i], errs[i] = fetchBody(neighbor, headers[i])
+			}
+		}()
+	}
+	for i := range headers {
+		jobs <- i
+	}
+	close(jobs)
+	wg.Wait()
+
+	for i, err := range errs {
+		if err != nil {
+			return nil, fmt.Errorf("下载区块 %v 的区块体失败：%w", headers[i].number, err)
+		}
+	}
+	return blocks, nil
+}
+
+func fetchBody(neighbor string, h *BlockHeader) (*Block, error) {
+	body := new(BlockBody)
+	if err := getJSON(fmt.Sprintf("http://%s/blocks/%x/body", neighbor, h.hash), body); err != nil {
+		return nil, err
+	}
+	return NewBlockFromHeader(h, body.Transactions)
+}
+
+func getJSON(endpoint string, v interface{}) error {
+	req, err := newPeerRequest(http.MethodGet, endpoint, nil)
+	if err != nil {
+		return err
+	}
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("状态码 %d", resp.StatusCode)
+	}
+	return json.NewDecoder(resp.Body).Decode(v)
+}
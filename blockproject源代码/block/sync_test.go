@@ -0,0 +1,187 @@
+package block
+
+import (
+	"encoding/hex"
+	"encoding/json"
+	"io"
+	"math/big"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+)
+
+// 邻居返回的区块体中交易哈希长度不对或不是十六进制时，下载返回错误而不是让节点崩溃
+func TestFetchBodiesMalformedHash(t *testing.T) {
+	tx := NewTransaction(MINING_ACCOUNT_ADDRESS, "miner", big.NewInt(5000))
+	m, err := tx.MarshalJSON()
+	if err != nil {
+		t.Fatal(err)
+	}
+	var fields map[string]interface{}
+	if err := json.Unmarshal(m, &fields); err != nil {
+		t.Fatal(err)
+	}
+	b := NewBlock(big.NewInt(1), big.NewInt(0), [32]byte{}, []*Transaction{tx})
+	b.hash = b.Hash()
+
+	for _, hash := range []string{"abcd", "zz", strings.Repeat("ab", 33)} {
+		t.Run(hash, func(t *testing.T) {
+			fields["hash"] = hash
+			bad, _ := json.Marshal(fields)
+			srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+				io.WriteString(w, `{"transactions":[`+string(bad)+`]}`)
+			}))
+			defer srv.Close()
+
+			neighbor := strings.TrimPrefix(srv.URL, "http://")
+			if _, err := fetchBodies(neighbor, []*BlockHeader{b.Header()}); err == nil {
+				t.Fatalf("交易哈希 %q 应该导致下载失败", hash)
+			}
+		})
+	}
+}
+
+func TestUnmarshalMalformedBlockHash(t *testing.T) {
+	b := NewBlock(big.NewInt(1), big.NewInt(0), [32]byte{}, nil)
+	m, err := b.MarshalJSON()
+	if err != nil {
+		t.Fatal(err)
+	}
+	var fields map[string]interface{}
+	if err := json.Unmarshal(m, &fields); err != nil {
+		t.Fatal(err)
+	}
+	for _, key := range []string{"hash", "previous_hash"} {
+		saved := fields[key]
+		fields[key] = "0102"
+		bad, _ := json.Marshal(fields)
+		if err := new(Block).UnmarshalJSON(bad); err == nil {
+			t.Errorf("%s 长度不对时应该返回错误", key)
+		}
+		fields[key] = saved
+	}
+}
+
+// 用 peer 的链响应同步用到的 /status、/headers 和 /blocks/{hash}/body，记录返回过的区块头的区块号
+type testPeer struct {
+	peer   *Blockchain
+	mux    sync.Mutex
+	served []uint64
+	froms  []string
+}
+
+func (tp *testPeer) ServeHTTP(w http.ResponseWriter, req *http.Request) {
+	query := req.URL.Query()
+	var v interface{}
+	var err error
+	switch {
+	case req.URL.Path == "/status":
+		v = tp.peer.Status()
+	case req.URL.Path == "/headers":
+		count, _ := strconv.Atoi(query.Get("count"))
+		var headers []*BlockHeader
+		if l := query.Get("locator"); l != "" {
+			locator := make([][32]byte, 0)
+			for _, p := range strings.Split(l, ",") {
+				var hash [32]byte
+				hex.Decode(hash[:], []byte(p))
+				locator = append(locator, hash)
+			}
+			headers, err = tp.peer.HeadersAfter(locator, count)
+		} else {
+			from, _ := strconv.ParseUint(query.Get("from"), 10, 64)
+			headers, err = tp.peer.Headers(from, count)
+		}
+		tp.mux.Lock()
+		tp.froms = append(tp.froms, query.Get("from"))
+		for _, h := range headers {
+			tp.served = append(tp.served, h.number.Uint64())
+		}
+		tp.mux.Unlock()
+		v = headers
+	case strings.HasPrefix(req.URL.Path, "/blocks/"):
+		var hash [32]byte
+		hex.Decode(hash[:], []byte(strings.Split(strings.TrimPrefix(req.URL.Path, "/blocks/"), "/")[0]))
+		v, err = tp.peer.BlockBody(hash)
+	default:
+		w.WriteHeader(http.StatusNotFound)
+		return
+	}
+	if err != nil {
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+	m, _ := json.Marshal(v)
+	w.Write(m)
+}
+
+func mineBlocks(t *testing.T, bc *Blockchain, n int) {
+	t.Helper()
+	for i := 0; i < n; i++ {
+		if !bc.Mining() {
+			t.Fatalf("第 %d 个区块挖矿失败", i+1)
+		}
+	}
+}
+
+// 同步只下载和校验共同祖先之后的区块头，不再从创世纪块开始
+func TestResolveConflictsFromLocator(t *testing.T) {
+	tests := []struct {
+		name  string
+		local int
+		peer  int
+	}{
+		{"邻居在本地链尾之后继续出块", 0, 3},
+		{"两条链在共同祖先之后分叉", 2, 4},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			local, store := minedTestChain(t, 12)
+			common := local.LastBlock().number.Uint64()
+
+			peer := forkPeer(t, store)
+			mineBlocks(t, peer, tt.peer)
+			mineBlocks(t, local, tt.local)
+
+			tp := &testPeer{peer: peer}
+			srv := httptest.NewServer(tp)
+			defer srv.Close()
+			local.neighbors = []string{strings.TrimPrefix(srv.URL, "http://")}
+
+			if !local.ResolveConflicts() {
+				t.Fatal("没有切换到邻居更重的链")
+			}
+			if local.LastBlock().hash != peer.LastBlock().hash {
+				t.Fatal("同步后链尾与邻居不同")
+			}
+			if local.TotalWork().Cmp(peer.TotalWork()) != 0 {
+				t.Fatalf("同步后累计工作量 %v，邻居为 %v", local.TotalWork(), peer.TotalWork())
+			}
+			if len(tp.served) != tt.peer || tp.served[0] != common+1 {
+				t.Fatalf("邻居返回了区块头 %v，期望从 %d 开始的 %d 个", tp.served, common+1, tt.peer)
+			}
+			if len(tp.froms) != 1 || tp.froms[0] != "" {
+				t.Fatalf("区块头请求的 from 参数 %q，期望只用定位器请求一次", tp.froms)
+			}
+		})
+	}
+}
+
+// 定位器从链尾开始，最近的区块逐个列出，之后间隔翻倍，最后是创世纪块
+func TestLocator(t *testing.T) {
+	bc, store := minedTestChain(t, 14)
+	locator := bc.Locator()
+	want := []uint64{14, 13, 12, 11, 10, 9, 8, 7, 6, 5, 3, 0}
+	if len(locator) != len(want) {
+		t.Fatalf("定位器有 %d 个哈希，期望 %d 个", len(locator), len(want))
+	}
+	for i, n := range want {
+		b, _ := store.GetByNumber(n)
+		if locator[i] != b.hash {
+			t.Errorf("定位器第 %d 个哈希不是区块 %d", i, n)
+		}
+	}
+}
@@ -0,0 +1,172 @@
+package block
+
+import (
+	"crypto/sha256"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"math/big"
+	"sync"
+
+	"github.com/fatih/color"
+)
+
+// 最多保留的区块模板数，超出后丢弃最早的模板
+const MAX_BLOCK_TEMPLATES = 32
+
+var (
+	ErrUnknownTemplate = errors.New("unknown block template")
+	ErrStaleTemplate   = errors.New("block template is stale")
+	// 只有工作量证明可以交给外部矿工
+	ErrTemplateUnsupported = errors.New("block templates require proof of work")
+)
+
+// 发给外部矿工的区块模板。
+// 矿工只需改写 Header 末尾 8 字节的 nonce（大端），找到 SHA-256 小于 Target 的值后连同 ID 提交
+type BlockTemplate struct {
+	// 模板 ID，即 nonce 为 0 时区块头的哈希
+	ID           [32]byte
+	Number       uint64
+	PreviousHash [32]byte
+	Timestamp    int64
+	Difficulty   *big.Int
+	Target       *big.Int
+	Transactions []*Transaction
+	Header       []byte
+}
+
+func (bt *BlockTemplate) MarshalJSON() ([]byte, error) {
+	return json.Marshal(struct {
+		ID           string         `json:"id"`
+		Number       uint64         `json:"number"`
+		PreviousHash string         `json:"previous_hash"`
+		Timestamp    int64          `json:"timestamp"`
+		Difficulty   *big.Int       `json:"difficulty"`
+		Target       string         `json:"target"`
+		MerkleRoot   string         `json:"merkle_root"`
+		Transactions []*Transaction `json:"transactions"`
+		Header       string         `json:"header"`
+		NonceOffset  int            `json:"nonce_offset"`
+	}{
+		ID:           fmt.Sprintf("%x", bt.ID),
+		Number:       bt.Number,
+		PreviousHash: fmt.Sprintf("%x", bt.PreviousHash),
+		Timestamp:    bt.Timestamp,
+		Difficulty:   bt.Difficulty,
+		Target:       fmt.Sprintf("%064x", bt.Target),
+		MerkleRoot:   fmt.Sprintf("%x", MerkleRoot(bt.Transactions)),
+		Transactions: bt.Transactions,
+		Header:       fmt.Sprintf("%x", bt.Header),
+		NonceOffset:  headerNonceOffset,
+	})
+}
+
+// 已发出、尚未过期的模板
+type templateCache struct {
+	mux    sync.Mutex
+	blocks map[[32]byte]*Block
+	order  [][32]byte
+}
+
+func newTemplateCache() *templateCache {
+	return &templateCache{blocks: make(map[[32]byte]*Block)}
+}
+
+func (tc *templateCache) put(id [32]byte, b *Block) {
+	tc.mux.Lock()
+	defer tc.mux.Unlock()
+	if _, ok := tc.blocks[id]; ok {
+		return
+	}
+	tc.blocks[id] = b
+	tc.order = append(tc.order, id)
+	if len(tc.order) > MAX_BLOCK_TEMPLATES {
+		delete(tc.blocks, tc.order[0])
+		tc.order = tc.order[1:]
+	}
+}
+
+func (tc *templateCache) get(id [32]byte) (*Block, bool) {
+	tc.mux.Lock()
+	defer tc.mux.Unlock()
+	b, ok := tc.blocks[id]
+	return b, ok
+}
+
+// 以当前链尾为父区块生成区块模板，挖矿奖励支付给 payout。
+// 交易池为空时模板只包含挖矿奖励交易
+func (bc *Blockchain) NewBlockTemplate(payout string) (*BlockTemplate, error) {
+	if payout == "" {
+		return nil, errors.New("缺少收款地址")
+	}
+	if _, ok := bc.engine.(*PoWEngine); !ok {
+		return nil, ErrTemplateUnsupported
+	}
+	bc.mux.Lock()
+	defer bc.mux.Unlock()
+
+	lastBlock := bc.LastBlock()
+	number := new(big.Int).Add(lastBlock.number, big.NewInt(1))
+	txs := bc.selectTransactions()
+	if reward := minerReward(number.Uint64(), txs); reward.Sign() > 0 {
+		txs = append(txs, NewCoinbaseTransaction(number.Uint64(), payout, reward))
+	}
+	b := NewBlock(number, big.NewInt(0), lastBlock.hash, txs)
+	if err := bc.prepare(b); err != nil {
+		return nil, err
+	}
+	difficulty := b.difficulty
+
+	header := b.EncodeHeader()
+	id := sha256.Sum256(header)
+	bc.templates.put(id, b)
+	return &BlockTemplate{
+		ID:           id,
+		Number:       number.Uint64(),
+		PreviousHash: lastBlock.hash,
+		Timestamp:    b.timestamp,
+		Difficulty:   new(big.Int).Set(difficulty),
+		Target:       proofTarget(difficulty),
+		Transactions: txs,
+		Header:       header,
+	}, nil
+}
+
+// 提交外部矿工为模板 id 找到的 nonce。
+// 校验通过后区块写入本地链并通知邻居；模板的父区块已不是链尾时返回 ErrStaleTemplate
+func (bc *Blockchain) SubmitBlock(id [32]byte, nonce uint64) (*Block, error) {
+	tmpl, ok := bc.templates.get(id)
+	if !ok {
+		return nil, ErrUnknownTemplate
+	}
+	// 同一个模板可能被多个矿工同时提交，在副本上填入 nonce
+	b := *tmpl
+	b.nonce = new(big.Int).SetUint64(nonce)
+	b.hash = b.Hash()
+	if !validProof(&b, b.difficulty) {
+		return nil, ErrInvalidProof
+	}
+
+	bc.mux.Lock()
+	lastBlock := bc.LastBlock()
+	if lastBlock.hash != b.previousHash {
+		bc.mux.Unlock()
+		return nil, ErrStaleTemplate
+	}
+	if err := VerifyBlock(bc.engine, lastBlock, &b, bc.store.GetByNumber); err != nil {
+		bc.mux.Unlock()
+		return nil, err
+	}
+	if err := VerifyBalances(&b, bc.state); err != nil {
+		bc.mux.Unlock()
+		return nil, err
+	}
+	bc.appendBlock(&b)
+	bc.mux.Unlock()
+
+	log.Printf("action=submitblock, number=%v, hash=%x", b.number, b.hash)
+	bc.announceBlock()
+	color.Magenta("外部矿工打包成功")
+	return &b, nil
+}
@@ -0,0 +1,117 @@
+package block
+
+import (
+	"crypto/sha256"
+	"encoding/binary"
+	"errors"
+	"math/big"
+	"testing"
+)
+
+// 像外部矿工一样改写模板区块头中的 nonce，返回第一个满足（valid 为 false 时不满足）目标值的 nonce
+func solveTemplate(tmpl *BlockTemplate, valid bool) uint64 {
+	header := append([]byte(nil), tmpl.Header...)
+	for nonce := uint64(0); ; nonce++ {
+		binary.BigEndian.PutUint64(header[headerNonceOffset:], nonce)
+		hash := sha256.Sum256(header)
+		if (bytesToBigInt(hash).Cmp(tmpl.Target) < 0) == valid {
+			return nonce
+		}
+	}
+}
+
+func TestNewBlockTemplate(t *testing.T) {
+	miner := newTestAccount(t)
+	bc := mineTestChainBy(t, NewMemoryStore(), miner, 2)
+	if !miner.send(t, bc, "recipient", 10, 3, 1) {
+		t.Fatal("转账没有进入交易池")
+	}
+	pending := bc.TransactionPool()[0]
+
+	if _, err := bc.NewBlockTemplate(""); err == nil {
+		t.Fatal("缺少收款地址时应该返回错误")
+	}
+	tmpl, err := bc.NewBlockTemplate("payout")
+	if err != nil {
+		t.Fatal(err)
+	}
+	head := bc.LastBlock()
+	if tmpl.Number != 3 || tmpl.PreviousHash != head.hash {
+		t.Fatalf("模板的区块号 %d、父区块 %x，期望接在区块 %v 之后", tmpl.Number, tmpl.PreviousHash, head.number)
+	}
+	difficulty, err := bc.NextDifficulty()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if tmpl.Difficulty.Cmp(difficulty) != 0 || tmpl.Target.Cmp(proofTarget(difficulty)) != 0 {
+		t.Fatalf("模板的难度 %v、目标值 %x 与下一个区块的难度 %v 不符", tmpl.Difficulty, tmpl.Target, difficulty)
+	}
+	if tmpl.ID != sha256.Sum256(tmpl.Header) {
+		t.Fatal("模板 ID 不是区块头的哈希")
+	}
+	if len(tmpl.Transactions) != 2 || tmpl.Transactions[0].hash != pending.hash {
+		t.Fatalf("模板有 %d 笔交易，期望交易池中的转账和挖矿奖励", len(tmpl.Transactions))
+	}
+	coinbase := tmpl.Transactions[1]
+	reward := new(big.Int).Add(BlockReward(3), big.NewInt(3))
+	if !coinbase.IsCoinbase() || coinbase.receiveAddress != "payout" || coinbase.value.Cmp(reward) != 0 {
+		t.Fatalf("挖矿奖励交易 %+v，期望给 payout %v", coinbase, reward)
+	}
+
+	poa, err := NewBlockchainWithEngine("signer", 5001, NewMemoryStore(), nil, testPoAEngine(t))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := poa.NewBlockTemplate("payout"); !errors.Is(err, ErrTemplateUnsupported) {
+		t.Fatalf("权威证明的链生成模板：%v", err)
+	}
+}
+
+func TestSubmitBlock(t *testing.T) {
+	miner := newTestAccount(t)
+	bc := mineTestChainBy(t, NewMemoryStore(), miner, 2)
+	if !miner.send(t, bc, "recipient", 10, 3, 1) {
+		t.Fatal("转账没有进入交易池")
+	}
+	tmpl, err := bc.NewBlockTemplate("payout")
+	if err != nil {
+		t.Fatal(err)
+	}
+	// 同一父区块上的另一个模板，tmpl 上链后过期
+	stale, err := bc.NewBlockTemplate("other")
+	if err != nil {
+		t.Fatal(err)
+	}
+	head := bc.LastBlock()
+
+	if _, err := bc.SubmitBlock([32]byte{1}, 0); !errors.Is(err, ErrUnknownTemplate) {
+		t.Fatalf("提交不存在的模板：%v", err)
+	}
+	if _, err := bc.SubmitBlock(tmpl.ID, solveTemplate(tmpl, false)); !errors.Is(err, ErrInvalidProof) {
+		t.Fatalf("提交不满足目标值的 nonce：%v", err)
+	}
+	if bc.LastBlock().hash != head.hash {
+		t.Fatal("无效的提交改变了链尾")
+	}
+
+	b, err := bc.SubmitBlock(tmpl.ID, solveTemplate(tmpl, true))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if bc.LastBlock().hash != b.hash || b.number.Uint64() != tmpl.Number {
+		t.Fatal("提交的区块没有成为链尾")
+	}
+	if got := bc.CalculateTotalAmount("payout"); got.Cmp(tmpl.Transactions[1].value) != 0 {
+		t.Fatalf("payout 的余额 %v，期望 %v", got, tmpl.Transactions[1].value)
+	}
+	if len(bc.TransactionPool()) != 0 {
+		t.Fatal("已上链的交易仍在交易池中")
+	}
+
+	if _, err := bc.SubmitBlock(stale.ID, solveTemplate(stale, true)); !errors.Is(err, ErrStaleTemplate) {
+		t.Fatalf("提交父区块已不是链尾的模板：%v", err)
+	}
+	if bc.LastBlock().hash != b.hash {
+		t.Fatal("过期模板的提交改变了链尾")
+	}
+}
@@ -0,0 +1,51 @@
+package block
+
+import (
+	"sort"
+	"time"
+)
+
+// 时间戳校验的窗口：向前看多少个区块求中位数，向后允许超前本地时钟多久
+const (
+	// 计算过去时间中位数时统计的区块数，新区块的时间戳必须晚于最近这些区块时间戳的中位数
+	MEDIAN_TIME_SPAN = 11
+	// 新区块的时间戳最多比本地时间超前多少
+	MAX_FUTURE_DRIFT = 2 * time.Minute
+)
+
+// 返回当前时间的时钟，出块和校验时间戳时使用
+type Clock func() time.Time
+
+var clock Clock = time.Now
+
+// 替换出块和校验使用的时钟，返回原来的时钟，测试时可以用固定的时钟检查时间戳规则。
+// c 为 nil 时恢复为系统时钟
+func SetClock(c Clock) Clock {
+	old := clock
+	if c == nil {
+		c = time.Now
+	}
+	clock = c
+	return old
+}
+
+// 过去时间中位数：prev 及之前共 MEDIAN_TIME_SPAN 个区块时间戳的中位数，不足时按已有的区块计算。
+// 与只要求晚于父区块相比，单个时间戳偏差较大的区块不会影响后续区块能否出块
+func MedianTimePast(prev *BlockHeader, ancestor HeaderGetter) (int64, error) {
+	timestamps := []int64{prev.timestamp}
+	number := bigToUint64(prev.number)
+	for i := uint64(1); i < MEDIAN_TIME_SPAN && i <= number; i++ {
+		h, err := ancestor(number - i)
+		if err != nil {
+			return 0, err
+		}
+		timestamps = append(timestamps, h.timestamp)
+	}
+	sort.Slice(timestamps, func(i, j int) bool { return timestamps[i] < timestamps[j] })
+	return timestamps[len(timestamps)/2], nil
+}
+
+// 本地时间加上 MAX_FUTURE_DRIFT，区块时间戳不能晚于这个时间
+func maxFutureTimestamp() int64 {
+	return clock().Add(MAX_FUTURE_DRIFT).UnixNano()
+}
@@ -0,0 +1,137 @@
+package block
+
+import (
+	"errors"
+	"math/big"
+	"testing"
+	"time"
+)
+
+// 只检查时间戳规则，共识引擎的校验全部通过
+type acceptEngine struct{}
+
+func (acceptEngine) Prepare(*BlockHeader, *Block, HeaderGetter) error      { return nil }
+func (acceptEngine) Seal(*Block, <-chan struct{}) error                    { return nil }
+func (acceptEngine) Verify(*BlockHeader, *BlockHeader, HeaderGetter) error { return nil }
+
+// 按顺序连接的区块头，第 i 个的时间戳为 timestamps[i]
+func timestampChain(timestamps []int64) []*BlockHeader {
+	headers := make([]*BlockHeader, 0, len(timestamps))
+	var prev [32]byte
+	for i, ts := range timestamps {
+		h := &BlockHeader{
+			number:       big.NewInt(int64(i)),
+			timestamp:    ts,
+			previousHash: prev,
+			difficulty:   big.NewInt(int64(MINING_DIFFICULT)),
+			nonce:        big.NewInt(0),
+		}
+		h.hash = h.Hash()
+		prev = h.hash
+		headers = append(headers, h)
+	}
+	return headers
+}
+
+func headerGetter(headers []*BlockHeader) HeaderGetter {
+	return func(number uint64) (*BlockHeader, error) {
+		if number >= uint64(len(headers)) {
+			return nil, ErrBlockNotFound
+		}
+		return headers[number], nil
+	}
+}
+
+func childHeader(prev *BlockHeader, timestamp int64) *BlockHeader {
+	h := &BlockHeader{
+		number:       new(big.Int).Add(prev.number, big.NewInt(1)),
+		timestamp:    timestamp,
+		previousHash: prev.hash,
+		difficulty:   big.NewInt(int64(MINING_DIFFICULT)),
+		nonce:        big.NewInt(0),
+	}
+	h.hash = h.Hash()
+	return h
+}
+
+func TestMedianTimePast(t *testing.T) {
+	long := make([]int64, 0, MEDIAN_TIME_SPAN+5)
+	for i := int64(0); i < MEDIAN_TIME_SPAN+5; i++ {
+		long = append(long, 100+i*10)
+	}
+	tests := []struct {
+		name       string
+		timestamps []int64
+		want       int64
+	}{
+		{"只有创世纪块", []int64{100}, 100},
+		{"两个区块取较晚的", []int64{100, 200}, 200},
+		{"三个区块", []int64{100, 300, 200}, 200},
+		{"乱序的时间戳", []int64{500, 100, 400, 200, 300}, 300},
+		// 超过 MEDIAN_TIME_SPAN 时只统计最近的区块：最后 11 个是 150..250，中位数 200
+		{"只统计最近的区块", long, 200},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			headers := timestampChain(tt.timestamps)
+			got, err := MedianTimePast(headers[len(headers)-1], headerGetter(headers))
+			if err != nil {
+				t.Fatal(err)
+			}
+			if got != tt.want {
+				t.Errorf("MedianTimePast = %d，期望 %d", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestVerifyHeaderTimestamp(t *testing.T) {
+	now := time.Unix(1700000000, 0)
+	old := SetClock(func() time.Time { return now })
+	defer SetClock(old)
+
+	base := now.Add(-time.Hour).UnixNano()
+	second := int64(time.Second)
+	drift := now.Add(MAX_FUTURE_DRIFT).UnixNano()
+
+	// 父区块时间戳比中位数晚很多，只要求晚于中位数，而不是晚于父区块
+	full := make([]int64, 0, MEDIAN_TIME_SPAN)
+	for i := int64(0); i < MEDIAN_TIME_SPAN-1; i++ {
+		full = append(full, base+i*second)
+	}
+	full = append(full, base+1000*second)
+	fullMTP := base + (MEDIAN_TIME_SPAN/2)*second
+
+	tests := []struct {
+		name       string
+		timestamps []int64
+		timestamp  int64
+		wantErr    bool
+	}{
+		{"短链等于中位数", []int64{base, base + 2*second}, base + 2*second, true},
+		{"短链晚于中位数", []int64{base, base + 2*second}, base + 2*second + 1, false},
+		{"只有创世纪块", []int64{base}, base + 1, false},
+		{"等于中位数", full, fullMTP, true},
+		{"晚于中位数 1 纳秒", full, fullMTP + 1, false},
+		{"早于父区块但晚于中位数", full, fullMTP + second, false},
+		{"刚好达到允许的超前", []int64{base}, drift, false},
+		{"超前超过允许值", []int64{base}, drift + 1, true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			headers := timestampChain(tt.timestamps)
+			prev := headers[len(headers)-1]
+			h := childHeader(prev, tt.timestamp)
+			err := VerifyHeader(acceptEngine{}, prev, h, headerGetter(headers))
+			if tt.wantErr {
+				if !errors.Is(err, ErrTimestamp) {
+					t.Fatalf("期望 ErrTimestamp，得到 %v", err)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+		})
+	}
+}
@@ -0,0 +1,296 @@
+package block
+
+import (
+	"errors"
+	"fmt"
+	"math/big"
+)
+
+// 区块校验规则，校验失败时返回的 ValidationError 包装其中之一，可以用 errors.Is 判断违反了哪条规则
+var (
+	ErrTxCount             = errors.New("transaction count mismatch")
+	ErrTooManyTxs          = errors.New("too many transactions")
+	ErrBlockSize           = errors.New("block too large")
+	ErrFieldRange          = errors.New("field out of range")
+	ErrTxHash              = errors.New("transaction hash mismatch")
+	ErrChainID             = errors.New("chain id mismatch")
+	ErrTxValue             = errors.New("invalid transaction value")
+	ErrTxSignature         = errors.New("invalid transaction signature")
+	ErrSenderAddress       = errors.New("sender address does not match public key")
+	ErrNonce               = errors.New("invalid nonce")
+	ErrCoinbase            = errors.New("invalid coinbase")
+	ErrMerkleRoot          = errors.New("merkle root mismatch")
+	ErrInsufficientBalance = errors.New("insufficient balance")
+	ErrBlockHash           = errors.New("block hash mismatch")
+	ErrBlockNumber         = errors.New("invalid block number")
+	ErrPreviousHash        = errors.New("previous hash mismatch")
+	ErrTimestamp           = errors.New("invalid timestamp")
+	ErrDifficulty          = errors.New("unexpected difficulty")
+	ErrInvalidProof        = errors.New("proof of work is invalid")
+	ErrInvalidSeal         = errors.New("invalid seal")
+)
+
+// 区块校验失败的原因
+type ValidationError struct {
+	// 出错的区块号
+	Number uint64
+	// 出错交易在区块中的下标，区块本身的错误为 -1
+	Index int
+	// 违反的规则
+	Err error
+	// 具体说明
+	Detail string
+}
+
+func (e *ValidationError) Error() string {
+	if e.Index < 0 {
+		return fmt.Sprintf("区块 %d：%v：%s", e.Number, e.Err, e.Detail)
+	}
+	return fmt.Sprintf("区块 %d 第 %d 笔交易：%v：%s", e.Number, e.Index, e.Err, e.Detail)
+}
+
+func (e *ValidationError) Unwrap() error {
+	return e.Err
+}
+
+func blockError(b *Block, err error, format string, args ...interface{}) *ValidationError {
+	return headerError(b.Header(), err, format, args...)
+}
+
+func headerError(h *BlockHeader, err error, format string, args ...interface{}) *ValidationError {
+	return &ValidationError{Number: bigToUint64(h.number), Index: -1, Err: err, Detail: fmt.Sprintf(format, args...)}
+}
+
+func txError(h *BlockHeader, index int, err error) *ValidationError {
+	ve := new(ValidationError)
+	if errors.As(err, &ve) {
+		ve.Number = bigToUint64(h.number)
+		ve.Index = index
+		return ve
+	}
+	return &ValidationError{Number: bigToUint64(h.number), Index: index, Err: err, Detail: err.Error()}
+}
+
+// 账户余额的只读视图，StateDB 和 AccountState 都实现了它
+type BalanceReader interface {
+	Balance(address string) *big.Int
+	// 下一个区块中可以花费的余额，不含尚未成熟的挖矿奖励
+	Spendable(address string) *big.Int
+	// 地址下一笔交易应使用的序号
+	Nonce(address string) uint64
+}
+
+// 不依赖链上状态的交易校验：哈希与内容一致、属于本链、金额和交易费合法、
+// 普通交易的签名有效，且发送地址由签名公钥得到
+func verifyTransaction(t *Transaction) error {
+	if t.hash != t.Hash() {
+		return &ValidationError{Err: ErrTxHash, Detail: "哈希与内容不符"}
+	}
+	if t.chainID != CHAIN_ID {
+		return &ValidationError{Err: ErrChainID, Detail: fmt.Sprintf("交易的链 ID %d 不是本链的 %d", t.chainID, CHAIN_ID)}
+	}
+	if t.value == nil || t.value.Sign() < 0 {
+		return &ValidationError{Err: ErrTxValue, Detail: fmt.Sprintf("金额 %v 不能为负", t.value)}
+	}
+	if t.fee == nil || t.fee.Sign() < 0 {
+		return &ValidationError{Err: ErrTxValue, Detail: fmt.Sprintf("交易费 %v 不能为负", t.fee)}
+	}
+	if t.IsCoinbase() {
+		if t.fee.Sign() != 0 {
+			return &ValidationError{Err: ErrCoinbase, Detail: "挖矿奖励交易不能带交易费"}
+		}
+		return nil
+	}
+	if t.value.Sign() == 0 {
+		return &ValidationError{Err: ErrTxValue, Detail: "转账金额必须大于 0"}
+	}
+	if !t.verifySignature() {
+		return &ValidationError{Err: ErrTxSignature, Detail: fmt.Sprintf("发送方 %s 的签名无效或缺失", t.senderAddress)}
+	}
+	if addr := AddressFromPublicKey(t.senderPublicKey); addr != t.senderAddress {
+		return &ValidationError{Err: ErrSenderAddress, Detail: fmt.Sprintf("公钥对应的地址是 %s，不是发送方 %s", addr, t.senderAddress)}
+	}
+	return nil
+}
+
+// 校验区块 b 能否接在 prev 之后，prev 为 nil 时按创世纪块校验。
+// 区块的编码长度不能超过 MAX_BLOCK_SIZE，
+// 区块头由 VerifyHeader 检查，交易由 VerifyBody 检查，余额由 VerifyBalances 检查。
+// ancestor 用于读取 prev 之前的区块，以计算 b 应使用的难度
+func VerifyBlock(engine ConsensusEngine, prev *Block, b *Block, ancestor BlockGetter) error {
+	if int(b.txSize) != len(b.transactions) {
+		return blockError(b, ErrTxCount, "txSize %d 与交易数量 %d 不符", b.txSize, len(b.transactions))
+	}
+	if size := b.Size(); size > MAX_BLOCK_SIZE {
+		return blockError(b, ErrBlockSize, "区块长度 %d 字节超过上限 %d", size, MAX_BLOCK_SIZE)
+	}
+	h := b.Header()
+	if err := VerifyBody(h, b.transactions); err != nil {
+		return err
+	}
+	var parent *BlockHeader
+	if prev != nil {
+		parent = prev.Header()
+	}
+	return VerifyHeader(engine, parent, h, headersOf(ancestor))
+}
+
+// 校验区块头 h 能否接在 prev 之后，prev 为 nil 时按创世纪块校验。
+// 检查字段范围、哈希，与父区块的区块号、哈希关系，时间戳（晚于过去时间中位数且不超前本地时间
+// MAX_FUTURE_DRIFT 以上，见 MedianTimePast），难度和工作量证明（或出块签名）
+// 由共识引擎 engine 检查。不需要区块体，同步时可以先校验整条区块头链再下载交易。
+// ancestor 用于读取 prev 之前的区块头，以计算 h 应使用的难度和过去时间中位数
+func VerifyHeader(engine ConsensusEngine, prev *BlockHeader, h *BlockHeader, ancestor HeaderGetter) error {
+	if !fitsUint64(h.number) || !fitsUint64(h.difficulty) || !fitsUint64(h.nonce) {
+		return headerError(h, ErrFieldRange, "区块号、难度或 nonce 超出 64 位")
+	}
+	if h.hash != h.Hash() {
+		return headerError(h, ErrBlockHash, "哈希与内容不符")
+	}
+	if prev == nil {
+		if h.number.Sign() != 0 {
+			return headerError(h, ErrBlockNumber, "创世纪块的区块号必须为 0")
+		}
+		return nil
+	}
+	if new(big.Int).Sub(h.number, prev.number).Cmp(big.NewInt(1)) != 0 {
+		return headerError(h, ErrBlockNumber, "区块号不连续，上一个区块是 %v", prev.number)
+	}
+	if h.previousHash != prev.hash {
+		return headerError(h, ErrPreviousHash, "previous_hash 与上一个区块的哈希不符")
+	}
+	mtp, err := MedianTimePast(prev, ancestor)
+	if err != nil {
+		return headerError(h, ErrTimestamp, "无法计算过去时间中位数：%v", err)
+	}
+	if h.timestamp <= mtp {
+		return headerError(h, ErrTimestamp, "时间戳 %d 不晚于最近区块时间戳的中位数 %d", h.timestamp, mtp)
+	}
+	if limit := maxFutureTimestamp(); h.timestamp > limit {
+		return headerError(h, ErrTimestamp, "时间戳 %d 比本地时间超前超过 %v", h.timestamp, MAX_FUTURE_DRIFT)
+	}
+	return engine.Verify(prev, h, ancestor)
+}
+
+// 校验区块体与区块头 h 是否匹配：交易数量上限，每笔交易的哈希、金额和签名，挖矿奖励交易的序号和总额，以及 Merkle 根。
+// 挖矿奖励交易合计不能超过区块奖励加上区块中交易的交易费
+func VerifyBody(h *BlockHeader, txs []*Transaction) error {
+	if len(txs) > MAX_BLOCK_TXS {
+		return headerError(h, ErrTooManyTxs, "交易数量 %d 超过上限 %d", len(txs), MAX_BLOCK_TXS)
+	}
+	reward := new(big.Int)
+	seen := make(map[[32]byte]bool, len(txs))
+	for i, t := range txs {
+		if err := verifyTransaction(t); err != nil {
+			return txError(h, i, err)
+		}
+		// 交易哈希是交易索引的键，同一区块中不能出现两次
+		if seen[t.hash] {
+			return txError(h, i, &ValidationError{Err: ErrTxHash, Detail: "区块中已有相同哈希的交易"})
+		}
+		seen[t.hash] = true
+		if t.IsCoinbase() {
+			if t.nonce != bigToUint64(h.number) {
+				return txError(h, i, &ValidationError{Err: ErrCoinbase, Detail: fmt.Sprintf("挖矿奖励交易的交易序号 %d 不是区块号", t.nonce)})
+			}
+			reward.Add(reward, t.value)
+		}
+	}
+	// 创世纪块的预分配由链配置决定，节点通过比较创世纪块哈希确认一致，不受奖励上限限制
+	if limit := minerReward(bigToUint64(h.number), txs); h.number.Sign() != 0 && reward.Cmp(limit) > 0 {
+		return headerError(h, ErrCoinbase, "挖矿奖励合计 %v 超过 %v", reward, limit)
+	}
+	if h.merkleRoot != MerkleRoot(txs) {
+		return headerError(h, ErrMerkleRoot, "Merkle 根与交易不符")
+	}
+	return nil
+}
+
+// 在 balances（父区块之后的状态）上按顺序执行区块中的交易，
+// 每笔普通交易的序号必须等于发送方下一笔交易的序号，执行前发送方可以花费的余额都不能小于转账金额加交易费。
+// 尚未成熟的挖矿奖励不能花费，本区块的挖矿奖励同样要等 COINBASE_MATURITY 个区块。balances 不会被修改
+func VerifyBalances(b *Block, balances BalanceReader) error {
+	running := make(map[string]*big.Int)
+	get := func(addr string) *big.Int {
+		v, ok := running[addr]
+		if !ok {
+			v = balances.Spendable(addr)
+			running[addr] = v
+		}
+		return v
+	}
+	nonces := make(map[string]uint64)
+	for i, t := range b.transactions {
+		if t.IsCoinbase() {
+			if COINBASE_MATURITY == 0 {
+				get(t.receiveAddress).Add(get(t.receiveAddress), t.value)
+			}
+			continue
+		}
+		expected, ok := nonces[t.senderAddress]
+		if !ok {
+			expected = balances.Nonce(t.senderAddress)
+		}
+		if t.nonce != expected {
+			return &ValidationError{Number: bigToUint64(b.number), Index: i, Err: ErrNonce,
+				Detail: fmt.Sprintf("发送方 %s 的交易序号 %d 不是期望的 %d", t.senderAddress, t.nonce, expected)}
+		}
+		nonces[t.senderAddress] = expected + 1
+		if balance := get(t.senderAddress); balance.Cmp(t.cost()) < 0 {
+			return &ValidationError{Number: bigToUint64(b.number), Index: i, Err: ErrInsufficientBalance,
+				Detail: fmt.Sprintf("发送方 %s 可以花费的余额 %v 不足 %v", t.senderAddress, balance, t.cost())}
+		}
+		get(t.senderAddress).Sub(get(t.senderAddress), t.cost())
+		get(t.receiveAddress).Add(get(t.receiveAddress), t.value)
+	}
+	return nil
+}
+
+// 从创世纪块开始完整校验一条链，难度按这条链自身的历史计算，余额在临时状态上逐块执行得到
+func VerifyChain(engine ConsensusEngine, chain []*Block) error {
+	ancestor := func(number uint64) (*Block, error) {
+		if number >= uint64(len(chain)) {
+			return nil, ErrBlockNotFound
+		}
+		return chain[number], nil
+	}
+	state := NewStateDB()
+	var prev *Block
+	for _, b := range chain {
+		if err := VerifyBlock(engine, prev, b, ancestor); err != nil {
+			return err
+		}
+		if err := VerifyBalances(b, state); err != nil {
+			return err
+		}
+		if err := state.ApplyBlock(b); err != nil {
+			return err
+		}
+		prev = b
+	}
+	return nil
+}
+
+// 从创世纪块开始校验一条区块头链，难度按这条链自身的历史计算
+func VerifyHeaders(engine ConsensusEngine, headers []*BlockHeader) error {
+	ancestor := func(number uint64) (*BlockHeader, error) {
+		if number >= uint64(len(headers)) {
+			return nil, ErrBlockNotFound
+		}
+		return headers[number], nil
+	}
+	return VerifyHeaderBranch(engine, nil, headers, ancestor)
+}
+
+// 校验接在 parent 之后的一段区块头，parent 为 nil 时 headers 从创世纪块开始。
+// ancestor 用于读取 parent 及之前的区块头，也要能读到 headers 中已经校验过的区块头
+func VerifyHeaderBranch(engine ConsensusEngine, parent *BlockHeader, headers []*BlockHeader, ancestor HeaderGetter) error {
+	prev := parent
+	for _, h := range headers {
+		if err := VerifyHeader(engine, prev, h, ancestor); err != nil {
+			return err
+		}
+		prev = h
+	}
+	return nil
+}
@@ -0,0 +1,110 @@
+package block
+
+import (
+	"errors"
+	"math/big"
+	"testing"
+)
+
+// 对区块 2（一笔转账和挖矿奖励）做一处改动，校验返回对应的规则
+func TestVerifyBlockRules(t *testing.T) {
+	miner := newTestAccount(t)
+	store := NewMemoryStore()
+	bc := mineTestChainBy(t, store, miner, 2)
+	prev, _ := store.GetByNumber(1)
+	valid, _ := store.GetByNumber(2)
+	if err := VerifyBlock(bc.Engine(), prev, valid, store.GetByNumber); err != nil {
+		t.Fatalf("未改动的区块校验失败：%v", err)
+	}
+
+	// 改动后重新计算 Merkle 根和区块哈希，只留下要测试的那处错误
+	rehash := func(b *Block) {
+		b.txSize = uint16(len(b.transactions))
+		b.merkleRoot = MerkleRoot(b.transactions)
+		b.hash = b.Hash()
+	}
+	transfer := func(b *Block) int {
+		for i, tx := range b.transactions {
+			if !tx.IsCoinbase() {
+				return i
+			}
+		}
+		t.Fatal("区块中没有转账")
+		return -1
+	}
+	coinbase := func(b *Block) int {
+		for i, tx := range b.transactions {
+			if tx.IsCoinbase() {
+				return i
+			}
+		}
+		t.Fatal("区块中没有挖矿奖励交易")
+		return -1
+	}
+
+	tests := []struct {
+		name   string
+		mutate func(b *Block)
+		want   error
+	}{
+		{"previous_hash 不是上一个区块", func(b *Block) {
+			b.previousHash[0] ^= 0xff
+			b.hash = b.Hash()
+		}, ErrPreviousHash},
+		{"Merkle 根与交易不符", func(b *Block) {
+			b.merkleRoot[0] ^= 0xff
+			b.hash = b.Hash()
+		}, ErrMerkleRoot},
+		// 挖矿奖励交易的序号是区块号，一起改掉
+		{"区块号不连续", func(b *Block) {
+			b.number = big.NewInt(3)
+			cb := b.transactions[coinbase(b)]
+			cb.nonce = 3
+			cb.hash = cb.Hash()
+			rehash(b)
+		}, ErrBlockNumber},
+		{"挖矿奖励超过区块奖励加交易费", func(b *Block) {
+			cb := b.transactions[coinbase(b)]
+			cb.value = new(big.Int).Add(cb.value, big.NewInt(1))
+			cb.hash = cb.Hash()
+			rehash(b)
+		}, ErrCoinbase},
+		{"同一笔交易出现两次", func(b *Block) {
+			b.transactions = append(b.transactions, b.transactions[transfer(b)])
+			rehash(b)
+		}, ErrTxHash},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			b := cloneBlock(t, valid)
+			tt.mutate(b)
+			err := VerifyBlock(bc.Engine(), prev, b, store.GetByNumber)
+			if !errors.Is(err, tt.want) {
+				t.Fatalf("校验结果 %v，期望 %v", err, tt.want)
+			}
+		})
+	}
+
+	// 转账金额改为超过矿工在区块 1 之后的余额并重新签名，只有执行交易时才能发现
+	t.Run("转账超过发送方余额", func(t *testing.T) {
+		b := cloneBlock(t, valid)
+		i := transfer(b)
+		b.transactions[i] = miner.sign(t, "recipient", int64(MINING_REWARD), 1, 0)
+		rehash(b)
+		if err := VerifyBlock(bc.Engine(), prev, b, store.GetByNumber); err != nil && !errors.Is(err, ErrInvalidProof) {
+			t.Fatalf("区块体应该通过校验：%v", err)
+		}
+		state, err := bc.StateAt(1)
+		if err != nil {
+			t.Fatal(err)
+		}
+		err = VerifyBalances(b, state)
+		if !errors.Is(err, ErrInsufficientBalance) {
+			t.Fatalf("校验结果 %v，期望 %v", err, ErrInsufficientBalance)
+		}
+		var ve *ValidationError
+		if !errors.As(err, &ve) || ve.Number != 2 || ve.Index != i {
+			t.Fatalf("错误位置 %+v，期望区块 2 第 %d 笔交易", ve, i)
+		}
+	})
+}
@@ -0,0 +1,161 @@
+package block
+
+import (
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"math/big"
+	"sync"
+)
+
+// 区块的工作量，见 BlockHeader.Work
+func (b *Block) Work() *big.Int {
+	return b.Header().Work()
+}
+
+// 一组区块的累计工作量，分叉选择时比较的是累计工作量而不是区块数
+func ChainWork(chain []*Block) *big.Int {
+	total := new(big.Int)
+	for _, b := range chain {
+		total.Add(total, b.Work())
+	}
+	return total
+}
+
+// 一条区块头链的累计工作量，同步时据此决定是否下载区块体
+func HeaderChainWork(headers []*BlockHeader) *big.Int {
+	total := new(big.Int)
+	for _, h := range headers {
+		total.Add(total, h.Work())
+	}
+	return total
+}
+
+// 本地链每个高度的累计工作量，total[i] 是创世块到区块 i 的工作量之和
+type workIndex struct {
+	mux   sync.RWMutex
+	total []*big.Int
+}
+
+func newWorkIndex() *workIndex {
+	return &workIndex{total: make([]*big.Int, 0)}
+}
+
+func (wi *workIndex) push(b *Block) {
+	wi.mux.Lock()
+	defer wi.mux.Unlock()
+	total := b.Work()
+	if n := len(wi.total); n > 0 {
+		total.Add(total, wi.total[n-1])
+	}
+	wi.total = append(wi.total, total)
+}
+
+// 只保留高度 height 及之前的记录，height 为 -1 时清空
+func (wi *workIndex) truncate(height int64) {
+	wi.mux.Lock()
+	defer wi.mux.Unlock()
+	if height+1 < int64(len(wi.total)) {
+		wi.total = wi.total[:height+1]
+	}
+}
+
+// 高度 height 的累计工作量，超出范围时返回 nil
+func (wi *workIndex) at(height int64) *big.Int {
+	wi.mux.RLock()
+	defer wi.mux.RUnlock()
+	if height < 0 || height >= int64(len(wi.total)) {
+		return nil
+	}
+	return new(big.Int).Set(wi.total[height])
+}
+
+func (wi *workIndex) tip() *big.Int {
+	wi.mux.RLock()
+	defer wi.mux.RUnlock()
+	if len(wi.total) == 0 {
+		return new(big.Int)
+	}
+	return new(big.Int).Set(wi.total[len(wi.total)-1])
+}
+
+// 本地链的累计工作量
+func (bc *Blockchain) TotalWork() *big.Int {
+	return bc.work.tip()
+}
+
+// 创世块到区块 number 的累计工作量
+func (bc *Blockchain) TotalWorkAt(number uint64) (*big.Int, error) {
+	total := bc.work.at(int64(number))
+	if total == nil {
+		return nil, ErrBlockNotFound
+	}
+	return total, nil
+}
+
+// 节点链的概况，同步前先比较链 ID、创世纪块和累计工作量，只有属于同一条链且邻居的链更重时才下载区块
+type ChainStatus struct {
+	Height      uint64
+	HeadHash    [32]byte
+	GenesisHash [32]byte
+	ChainID     uint64
+	TotalWork   *big.Int
+}
+
+func (bc *Blockchain) Status() *ChainStatus {
+	head := bc.LastBlock()
+	return &ChainStatus{
+		Height:      head.number.Uint64(),
+		HeadHash:    head.hash,
+		GenesisHash: bc.GenesisHash(),
+		ChainID:     CHAIN_ID,
+		TotalWork:   bc.TotalWork(),
+	}
+}
+
+func (cs *ChainStatus) MarshalJSON() ([]byte, error) {
+	return json.Marshal(struct {
+		Height      uint64   `json:"height"`
+		HeadHash    string   `json:"head_hash"`
+		GenesisHash string   `json:"genesis_hash"`
+		ChainID     uint64   `json:"chain_id"`
+		TotalWork   *big.Int `json:"total_work"`
+	}{
+		Height:      cs.Height,
+		HeadHash:    fmt.Sprintf("%x", cs.HeadHash),
+		GenesisHash: fmt.Sprintf("%x", cs.GenesisHash),
+		ChainID:     cs.ChainID,
+		TotalWork:   cs.TotalWork,
+	})
+}
+
+func (cs *ChainStatus) UnmarshalJSON(data []byte) error {
+	var v struct {
+		Height      uint64   `json:"height"`
+		HeadHash    string   `json:"head_hash"`
+		GenesisHash string   `json:"genesis_hash"`
+		ChainID     uint64   `json:"chain_id"`
+		TotalWork   *big.Int `json:"total_work"`
+	}
+	if err := json.Unmarshal(data, &v); err != nil {
+		return err
+	}
+	for _, f := range []struct {
+		value string
+		dst   *[32]byte
+	}{
+		{v.HeadHash, &cs.HeadHash},
+		{v.GenesisHash, &cs.GenesisHash},
+	} {
+		h, err := hex.DecodeString(f.value)
+		if err != nil || (len(h) != 0 && len(h) != 32) {
+			return fmt.Errorf("非法的区块哈希 %q", f.value)
+		}
+		*f.dst = [32]byte{}
+		copy(f.dst[:], h)
+	}
+	cs.Height = v.Height
+	cs.ChainID = v.ChainID
+	cs.TotalWork = v.TotalWork
+	return nil
+}
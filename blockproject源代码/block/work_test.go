@@ -0,0 +1,83 @@
+package block
+
+import (
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+// 复制 store 中的链作为邻居的链，之后两条链各自出块即从链尾分叉
+func forkPeer(t *testing.T, store BlockStore) *Blockchain {
+	t.Helper()
+	peerStore := NewMemoryStore()
+	store.Iterate(func(b *Block) bool {
+		peerStore.Append(b)
+		return true
+	})
+	peer, err := NewBlockchainWithStore("peer", 5001, peerStore)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return peer
+}
+
+// 把 bc 的邻居设为 peer，返回同步后是否切换
+func resolveWith(t *testing.T, bc *Blockchain, peer *Blockchain) bool {
+	t.Helper()
+	srv := httptest.NewServer(&testPeer{peer: peer})
+	defer srv.Close()
+	bc.neighbors = []string{strings.TrimPrefix(srv.URL, "http://")}
+	return bc.ResolveConflicts()
+}
+
+// 分叉选择比较累计工作量：区块 10 调整难度，邻居按时出块难度放大 4 倍，
+// 本地区块 9 晚了一小时难度缩小 4 倍。邻居的链短但更重，双方都选择邻居的链
+func TestForkChoiceHeavierShorterChain(t *testing.T) {
+	local, store := minedTestChain(t, 8)
+	peer := forkPeer(t, store)
+	mineBlocks(t, peer, 2)
+
+	old := SetClock(func() time.Time { return time.Now().Add(time.Hour) })
+	t.Cleanup(func() { SetClock(old) })
+	mineBlocks(t, local, 4)
+
+	if local.LastBlock().number.Uint64() <= peer.LastBlock().number.Uint64() {
+		t.Fatal("本地链应该比邻居的链长")
+	}
+	if local.TotalWork().Cmp(peer.TotalWork()) >= 0 {
+		t.Fatalf("本地链的累计工作量 %v 应该小于邻居的 %v", local.TotalWork(), peer.TotalWork())
+	}
+	peerHead := peer.LastBlock().hash
+
+	if resolveWith(t, peer, local) {
+		t.Fatal("邻居切换到了更长但更轻的链")
+	}
+	if peer.LastBlock().hash != peerHead {
+		t.Fatal("邻居的链尾变化")
+	}
+	if !resolveWith(t, local, peer) {
+		t.Fatal("没有切换到更短但更重的链")
+	}
+	if local.LastBlock().hash != peerHead || local.TotalWork().Cmp(peer.TotalWork()) != 0 {
+		t.Fatal("切换后的链与邻居不同")
+	}
+}
+
+// 累计工作量相同时保留本地链
+func TestForkChoiceEqualWorkKeepsLocal(t *testing.T) {
+	local, store := minedTestChain(t, 2)
+	peer := forkPeer(t, store)
+	mineBlocks(t, peer, 1)
+	mineBlocks(t, local, 1)
+	if local.TotalWork().Cmp(peer.TotalWork()) != 0 {
+		t.Fatalf("两条链的累计工作量 %v 和 %v 应该相同", local.TotalWork(), peer.TotalWork())
+	}
+	head := local.LastBlock().hash
+	if resolveWith(t, local, peer) {
+		t.Fatal("累计工作量相同时切换了链")
+	}
+	if local.LastBlock().hash != head {
+		t.Fatal("本地链尾变化")
+	}
+}
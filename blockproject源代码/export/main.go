@@ -0,0 +1,45 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"jhblockchain/block"
+	"log"
+	"os"
+
+	"github.com/fatih/color"
+)
+
+func init() {
+	log.SetPrefix("Export: ")
+}
+
+// 把节点数据目录中的链导出为二进制文件
+func main() {
+	datadir := flag.String("datadir", ".", "Directory for Blockchain Data")
+	storeType := flag.String("store", block.STORE_FILE, "Block Store Type (file|db)")
+	out := flag.String("out", "chain.bin", "Output File")
+	flag.Parse()
+	fmt.Printf("datadir:%v store:%v out:%v\n", *datadir, *storeType, *out)
+
+	store, err := block.OpenStore(*storeType, *datadir, block.SYNC_ALWAYS)
+	if err != nil {
+		log.Fatalf("ERROR: 打开区块存储失败 %v", err)
+	}
+	defer store.Close()
+
+	file, err := os.Create(*out)
+	if err != nil {
+		log.Fatalf("ERROR: 创建文件失败 %v", err)
+	}
+	n, err := block.ExportChain(store, file)
+	if err == nil {
+		err = file.Sync()
+	}
+	file.Close()
+	if err != nil {
+		os.Remove(*out)
+		log.Fatalf("ERROR: 导出失败 %v", err)
+	}
+	color.Green("已导出 %d 个区块到 %s", n, *out)
+}
@@ -5,6 +5,7 @@ go 1.19
 require (
 	github.com/btcsuite/btcd/btcutil v1.1.3
 	github.com/fatih/color v1.13.0
+	go.etcd.io/bbolt v1.3.7
 )
 
 require (
@@ -0,0 +1,70 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"jhblockchain/block"
+	"log"
+	"os"
+
+	"github.com/fatih/color"
+)
+
+func init() {
+	log.SetPrefix("Import: ")
+}
+
+// 从二进制文件导入链，每个区块都经过校验后才写入数据目录
+func main() {
+	datadir := flag.String("datadir", ".", "Directory for Blockchain Data")
+	storeType := flag.String("store", block.STORE_FILE, "Block Store Type (file|db)")
+	in := flag.String("in", "chain.bin", "Input File")
+	consensus := flag.String("consensus", block.CONSENSUS_POW, "Consensus Engine (pow|poa)")
+	signers := flag.String("signers", "", "Comma Separated Public Keys of PoA Signers")
+	genesis := flag.String("genesis", "", "Chain Spec JSON File (empty = default genesis)")
+	flag.Parse()
+	fmt.Printf("datadir:%v store:%v in:%v consensus:%v genesis:%v\n", *datadir, *storeType, *in, *consensus, *genesis)
+
+	var spec *block.ChainSpec
+	if *genesis != "" {
+		var err error
+		if spec, err = block.LoadChainSpec(*genesis); err != nil {
+			log.Fatalf("ERROR: 读取链配置失败 %v", err)
+		}
+		spec.Apply()
+	}
+
+	engine, err := block.OpenEngine(*consensus, 0, *signers, nil)
+	if err != nil {
+		log.Fatalf("ERROR: 创建共识引擎失败 %v", err)
+	}
+
+	store, err := block.OpenStore(*storeType, *datadir, block.SYNC_ALWAYS)
+	if err != nil {
+		log.Fatalf("ERROR: 打开区块存储失败 %v", err)
+	}
+	defer store.Close()
+	// 先写入（或核对）链配置的创世纪块，没有指定链配置时使用默认链配置，与节点启动时的检查一致。
+	// 文件中的创世纪块不同时导入失败
+	if spec == nil {
+		spec = block.DefaultChainSpec()
+	}
+	if err := block.InitGenesis(store, spec); err != nil {
+		log.Fatalf("ERROR: %v", err)
+	}
+
+	file, err := os.Open(*in)
+	if err != nil {
+		log.Fatalf("ERROR: 打开文件失败 %v", err)
+	}
+	defer file.Close()
+
+	result, err := block.ImportChain(store, engine, file)
+	color.Cyan("文件中区块 %d 个，跳过已有 %d 个，导入 %d 个", result.Total, result.Skipped, result.Imported)
+	if err != nil {
+		color.Red("导入失败：%v", err)
+		store.Close()
+		os.Exit(1)
+	}
+	color.Green("导入完成")
+}
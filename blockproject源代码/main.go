@@ -48,13 +48,15 @@ func main() {
 		wallet_johnhai.PublicKey(),
 		wallet_johnhai.BlockchainAddress(),
 		wallet_zbj.BlockchainAddress(),
-		8)
+		8, 1, block.CHAIN_ID, blockchain.PendingNonce(wallet_johnhai.BlockchainAddress()))
 
 	//区块链 打包交易
 	isAdded := blockchain.AddTransaction(
 		wallet_johnhai.BlockchainAddress(),
 		wallet_zbj.BlockchainAddress(),
 		big.NewInt(8),
+		big.NewInt(1),
+		t.Nonce(),
 		wallet_johnhai.PublicKey(),
 		t.GenerateSignature())
 
@@ -65,13 +67,15 @@ func main() {
 		wallet_swk.PublicKey(),
 		wallet_swk.BlockchainAddress(),
 		wallet_zbj.BlockchainAddress(),
-		80)
+		80, 0, block.CHAIN_ID, blockchain.PendingNonce(wallet_swk.BlockchainAddress()))
 
 	//区块链 打包交易
 	isAdded = blockchain.AddTransaction(
 		wallet_swk.BlockchainAddress(),
 		wallet_zbj.BlockchainAddress(),
 		big.NewInt(80),
+		big.NewInt(0),
+		t2.Nonce(),
 		wallet_swk.PublicKey(),
 		t2.GenerateSignature())
 
@@ -3,25 +3,41 @@ package main
 import (
 	"encoding/hex"
 	"encoding/json"
+	"errors"
 	"io"
 	"jhblockchain/block"
 	"jhblockchain/utils"
 	"jhblockchain/wallet"
 	"log"
+	"math/big"
 	"net/http"
 	"strconv"
+	"strings"
 
 	"github.com/fatih/color"
 )
 
 var cache map[string]*block.Blockchain = make(map[string]*block.Blockchain)
 
+// 地址交易历史每页的默认条数和最大条数
+const (
+	ADDRESS_HISTORY_DEFAULT_LIMIT = 20
+	ADDRESS_HISTORY_MAX_LIMIT     = 100
+)
+
 type BlockchainServer struct {
-	port uint16
+	port  uint16
+	store block.BlockStore
+	// 矿工钱包，挖矿奖励支付到它的地址，权威证明时也用它的私钥签名区块
+	minersWallet *wallet.Wallet
+	engine       block.ConsensusEngine
+	// 链配置，为 nil 时使用默认的创世纪块
+	spec *block.ChainSpec
 }
 
-func NewBlockchainServer(port uint16) *BlockchainServer {
-	return &BlockchainServer{port}
+func NewBlockchainServer(port uint16, store block.BlockStore, minersWallet *wallet.Wallet,
+	engine block.ConsensusEngine, spec *block.ChainSpec) *BlockchainServer {
+	return &BlockchainServer{port, store, minersWallet, engine, spec}
 }
 
 func (bcs *BlockchainServer) Port() uint16 {
@@ -35,9 +51,13 @@ func (bcs *BlockchainServer) Port() uint16 {
 func (bcs *BlockchainServer) GetBlockchain() *block.Blockchain {
 	bc, ok := cache["blockchain"]
 	if !ok {
-		minersWallet := wallet.LoadWallet("4c5011a23e8fe8410899547a1c333ad46a65bc0615bf38aa252d89a17f097190")
+		minersWallet := bcs.minersWallet
 		// NewBlockchain与以前的方法不一样,增加了地址和端口2个参数,是为了区别不同的节点
-		bc = block.NewBlockchain(minersWallet.BlockchainAddress(), bcs.Port())
+		var err error
+		bc, err = block.NewBlockchainWithEngine(minersWallet.BlockchainAddress(), bcs.Port(), bcs.store, bcs.spec, bcs.engine)
+		if err != nil {
+			log.Fatalf("ERROR: 加载区块链失败 %v", err)
+		}
 		cache["blockchain"] = bc
 		color.Magenta("===矿工帐号信息====\n")
 		color.Magenta("矿工private_key\n %v\n", minersWallet.PrivateKeyStr())
@@ -63,6 +83,124 @@ func (bcs *BlockchainServer) GetChain(w http.ResponseWriter, req *http.Request)
 	}
 }
 
+// 返回链高度、最新区块哈希和累计工作量，邻居据此决定是否需要同步
+func (bcs *BlockchainServer) GetStatus(w http.ResponseWriter, req *http.Request) {
+	switch req.Method {
+	case http.MethodGet:
+		w.Header().Add("Content-Type", "application/json")
+		bc := bcs.GetBlockchain()
+		m, _ := bc.Status().MarshalJSON()
+		io.WriteString(w, string(m[:]))
+	default:
+		log.Printf("ERROR: Invalid HTTP Method")
+		w.WriteHeader(http.StatusBadRequest)
+	}
+}
+
+// 按区块号顺序返回区块头，from 为起始区块号，count 为数量，最多 block.MAX_HEADERS_PER_REQUEST 个。
+// 带 locator（逗号分隔的区块哈希，见 Blockchain.Locator）时忽略 from，从其中第一个在本地链上的区块之后开始。
+// 邻居同步时先下载区块头，校验通过后再下载缺少的区块体
+func (bcs *BlockchainServer) GetHeaders(w http.ResponseWriter, req *http.Request) {
+	switch req.Method {
+	case http.MethodGet:
+		w.Header().Add("Content-Type", "application/json")
+		query := req.URL.Query()
+		var err error
+		from := uint64(0)
+		if f := query.Get("from"); f != "" {
+			if from, err = strconv.ParseUint(f, 10, 64); err != nil {
+				w.WriteHeader(http.StatusBadRequest)
+				io.WriteString(w, string(utils.JsonStatus("from 不合法")))
+				return
+			}
+		}
+		count := block.MAX_HEADERS_PER_REQUEST
+		if c := query.Get("count"); c != "" {
+			if count, err = strconv.Atoi(c); err != nil || count <= 0 {
+				w.WriteHeader(http.StatusBadRequest)
+				io.WriteString(w, string(utils.JsonStatus("count 不合法")))
+				return
+			}
+		}
+
+		var headers []*block.BlockHeader
+		if l := query.Get("locator"); l != "" {
+			parts := strings.Split(l, ",")
+			if len(parts) > block.MAX_LOCATOR_HASHES {
+				w.WriteHeader(http.StatusBadRequest)
+				io.WriteString(w, string(utils.JsonStatus("locator 过长")))
+				return
+			}
+			locator := make([][32]byte, 0, len(parts))
+			for _, p := range parts {
+				hashBytes, err := hex.DecodeString(p)
+				if err != nil || len(hashBytes) != 32 {
+					w.WriteHeader(http.StatusBadRequest)
+					io.WriteString(w, string(utils.JsonStatus("locator 不合法")))
+					return
+				}
+				var hash [32]byte
+				copy(hash[:], hashBytes)
+				locator = append(locator, hash)
+			}
+			headers, err = bcs.GetBlockchain().HeadersAfter(locator, count)
+		} else {
+			headers, err = bcs.GetBlockchain().Headers(from, count)
+		}
+		if err != nil {
+			color.Red("读取区块头失败：%v", err)
+			w.WriteHeader(http.StatusInternalServerError)
+			io.WriteString(w, string(utils.JsonStatus("读取区块头失败")))
+			return
+		}
+		m, _ := json.Marshal(headers)
+		io.WriteString(w, string(m))
+	default:
+		log.Printf("ERROR: Invalid HTTP Method")
+		w.WriteHeader(http.StatusBadRequest)
+	}
+}
+
+// 返回区块体，路径为 /blocks/{hash}/body
+func (bcs *BlockchainServer) GetBlockBody(w http.ResponseWriter, req *http.Request) {
+	switch req.Method {
+	case http.MethodGet:
+		w.Header().Add("Content-Type", "application/json")
+		parts := strings.Split(strings.Trim(strings.TrimPrefix(req.URL.Path, "/blocks/"), "/"), "/")
+		if len(parts) != 2 || parts[1] != "body" {
+			w.WriteHeader(http.StatusNotFound)
+			io.WriteString(w, string(utils.JsonStatus("不支持的区块查询")))
+			return
+		}
+		hashBytes, err := hex.DecodeString(parts[0])
+		if err != nil || len(hashBytes) != 32 {
+			w.WriteHeader(http.StatusBadRequest)
+			io.WriteString(w, string(utils.JsonStatus("无法解码哈希字符串")))
+			return
+		}
+		var hash [32]byte
+		copy(hash[:], hashBytes)
+
+		body, err := bcs.GetBlockchain().BlockBody(hash)
+		if errors.Is(err, block.ErrBlockNotFound) {
+			w.WriteHeader(http.StatusNotFound)
+			io.WriteString(w, string(utils.JsonStatus("该区块不存在")))
+			return
+		}
+		if err != nil {
+			color.Red("读取区块体失败：%v", err)
+			w.WriteHeader(http.StatusInternalServerError)
+			io.WriteString(w, string(utils.JsonStatus("读取区块体失败")))
+			return
+		}
+		m, _ := json.Marshal(body)
+		io.WriteString(w, string(m))
+	default:
+		log.Printf("ERROR: Invalid HTTP Method")
+		w.WriteHeader(http.StatusBadRequest)
+	}
+}
+
 func (bcs *BlockchainServer) GetBlockByNumber(w http.ResponseWriter, req *http.Request) {
 	bc := cache["blockchain"]
 	switch req.Method {
@@ -70,14 +208,20 @@ func (bcs *BlockchainServer) GetBlockByNumber(w http.ResponseWriter, req *http.R
 		w.Header().Add("Content-Type", "application/json")
 		number := req.URL.Query().Get("number")
 		newNumber, _ := strconv.Atoi(number)
-		block, _ := bc.GetBlockByNumber(uint64(newNumber))
-		if block == nil {
-			color.Red("该区块不存在")
-
-			io.WriteString(w, string(utils.JsonStatus("该区块不存在")))
+		block, err := bc.GetBlockByNumber(uint64(newNumber))
+		if err != nil {
+			color.Red("查询区块失败：%v", err)
+			w.WriteHeader(lookupStatus(err))
+			io.WriteString(w, string(utils.JsonStatus(lookupMessage(err, "该区块不存在", "查询区块失败"))))
+			return
+		}
+		m, err := withConfirmation(bc, block)
+		if err != nil {
+			color.Red("查询区块确认数失败：%v", err)
+			w.WriteHeader(lookupStatus(err))
+			io.WriteString(w, string(utils.JsonStatus(lookupMessage(err, "该区块不存在", "查询区块确认数失败"))))
 			return
 		}
-		m, _ := block.MarshalJSON()
 		io.WriteString(w, string(m[:]))
 		color.Magenta("getBlockbyNumber")
 	default:
@@ -93,23 +237,31 @@ func (bcs *BlockchainServer) GetBlockByHash(w http.ResponseWriter, req *http.Req
 		w.Header().Add("Content-Type", "application/json")
 		hashString := req.URL.Query().Get("hash")
 		hashBytes, err := hex.DecodeString(hashString)
-		if err != nil {
-			color.Red("无法解码哈希字符串：", err)
+		if err != nil || len(hashBytes) != 32 {
+			color.Red("无法解码哈希字符串：%q", hashString)
+			w.WriteHeader(http.StatusBadRequest)
 			io.WriteString(w, string(utils.JsonStatus("无法解码哈希字符串")))
 			return
 		}
 
 		var hash [32]byte
-		copy(hash[:], hashBytes[:32])
+		copy(hash[:], hashBytes)
 
 		color.Green("哈希值：%x\n", hash)
-		block, _ := bc.GetBlockByHash(hash)
-		if block == nil {
-			color.Red("该区块不存在")
-			io.WriteString(w, string(utils.JsonStatus("该区块不存在")))
+		block, err := bc.GetBlockByHash(hash)
+		if err != nil {
+			color.Red("查询区块失败：%v", err)
+			w.WriteHeader(lookupStatus(err))
+			io.WriteString(w, string(utils.JsonStatus(lookupMessage(err, "该区块不存在", "查询区块失败"))))
+			return
+		}
+		m, err := withConfirmation(bc, block)
+		if err != nil {
+			color.Red("查询区块确认数失败：%v", err)
+			w.WriteHeader(lookupStatus(err))
+			io.WriteString(w, string(utils.JsonStatus(lookupMessage(err, "该区块不存在", "查询区块确认数失败"))))
 			return
 		}
-		m, _ := block.MarshalJSON()
 		io.WriteString(w, string(m[:]))
 		color.Magenta("getBlockbyHash")
 	default:
@@ -118,6 +270,58 @@ func (bcs *BlockchainServer) GetBlockByHash(w http.ResponseWriter, req *http.Req
 	}
 }
 
+// 区块的 JSON 加上确认数和是否最终确定
+func withConfirmation(bc *block.Blockchain, b *block.Block) ([]byte, error) {
+	m, err := b.MarshalJSON()
+	if err != nil {
+		return nil, err
+	}
+	c, err := bc.ConfirmationOf(b.Header().Number().Uint64())
+	if err != nil {
+		return nil, err
+	}
+	return c.AppendTo(m)
+}
+
+// 查询失败时的状态码：区块或交易不存在时为 404，读取存储失败等其它错误为 500
+func lookupStatus(err error) int {
+	if errors.Is(err, block.ErrBlockNotFound) || errors.Is(err, block.ErrTransactionNotFound) {
+		return http.StatusNotFound
+	}
+	return http.StatusInternalServerError
+}
+
+// 与 lookupStatus 对应的错误信息
+func lookupMessage(err error, notFound string, failed string) string {
+	if lookupStatus(err) == http.StatusNotFound {
+		return notFound
+	}
+	return failed
+}
+
+// 返回最新的最终确定区块，确认数达到 block.FINALITY_CONFIRMATIONS 的区块不再考虑被分叉替换
+func (bcs *BlockchainServer) GetFinalized(w http.ResponseWriter, req *http.Request) {
+	switch req.Method {
+	case http.MethodGet:
+		w.Header().Add("Content-Type", "application/json")
+		bc := bcs.GetBlockchain()
+		f, err := bc.Finalized()
+		if err == nil {
+			var m []byte
+			if m, err = f.MarshalJSON(); err == nil {
+				io.WriteString(w, string(m))
+				return
+			}
+		}
+		color.Red("读取最终确定区块失败：%v", err)
+		w.WriteHeader(lookupStatus(err))
+		io.WriteString(w, string(utils.JsonStatus(lookupMessage(err, "最终确定区块不存在", "读取最终确定区块失败"))))
+	default:
+		log.Println("ERROR: Invalid HTTP Method")
+		w.WriteHeader(http.StatusBadRequest)
+	}
+}
+
 func (bcs *BlockchainServer) GetTransactionByHash(w http.ResponseWriter, req *http.Request) {
 	bc := cache["blockchain"]
 	switch req.Method {
@@ -125,23 +329,38 @@ func (bcs *BlockchainServer) GetTransactionByHash(w http.ResponseWriter, req *ht
 		w.Header().Add("Content-Type", "application/json")
 		hashString := req.URL.Query().Get("hash")
 		hashBytes, err := hex.DecodeString(hashString)
-		if err != nil {
-			color.Red("无法解码哈希字符串：", err)
+		if err != nil || len(hashBytes) != 32 {
+			color.Red("无法解码哈希字符串：%q", hashString)
+			w.WriteHeader(http.StatusBadRequest)
 			io.WriteString(w, string(utils.JsonStatus("无法解码哈希字符串")))
 			return
 		}
 
 		var hash [32]byte
-		copy(hash[:], hashBytes[:32])
+		copy(hash[:], hashBytes)
 
 		color.Green("哈希值：%x\n", hash)
 		transaction := bc.GetTransactionByHash(hash)
 		if transaction == nil {
 			color.Red("该交易不存在")
+			w.WriteHeader(http.StatusNotFound)
 			io.WriteString(w, string(utils.JsonStatus("该交易不存在")))
 			return
 		}
-		m, _ := transaction.MarshalJSON()
+		m, err := transaction.MarshalJSON()
+		if err == nil {
+			// 交易所在区块的确认数，付款方据此判断交易是否可以视为最终确定
+			var c *block.Confirmation
+			if c, err = bc.TransactionConfirmation(hash); err == nil {
+				m, err = c.AppendTo(m)
+			}
+		}
+		if err != nil {
+			color.Red("查询交易确认数失败：%v", err)
+			w.WriteHeader(lookupStatus(err))
+			io.WriteString(w, string(utils.JsonStatus(lookupMessage(err, "该交易不存在", "查询交易确认数失败"))))
+			return
+		}
 		io.WriteString(w, string(m[:]))
 		color.Magenta("getTransactionByHash")
 	default:
@@ -174,6 +393,93 @@ func (bcs *BlockchainServer) GetTransactions(w http.ResponseWriter, req *http.Re
 	}
 }
 
+// GET /accounts/{addr}/nonce：返回地址已上链的交易数和钱包签名下一笔交易时应使用的序号
+func (bcs *BlockchainServer) AccountNonce(w http.ResponseWriter, req *http.Request) {
+	w.Header().Set("Access-Control-Allow-Origin", "*")
+	switch req.Method {
+	case http.MethodGet:
+		w.Header().Add("Content-Type", "application/json")
+		parts := strings.Split(strings.Trim(strings.TrimPrefix(req.URL.Path, "/accounts/"), "/"), "/")
+		if len(parts) != 2 || parts[0] == "" || parts[1] != "nonce" {
+			w.WriteHeader(http.StatusNotFound)
+			io.WriteString(w, string(utils.JsonStatus("不支持的账户查询")))
+			return
+		}
+		m, _ := json.Marshal(bcs.GetBlockchain().AccountNonce(parts[0]))
+		io.WriteString(w, string(m))
+	default:
+		log.Println("ERROR: Invalid HTTP Method")
+		w.WriteHeader(http.StatusBadRequest)
+	}
+}
+
+// GET /addresses/{addr}/transactions?cursor=&limit=
+// 按从新到旧的顺序返回地址的转入转出交易，next_cursor 不为空时用它请求下一页
+func (bcs *BlockchainServer) AddressTransactions(w http.ResponseWriter, req *http.Request) {
+	w.Header().Set("Access-Control-Allow-Origin", "*")
+	switch req.Method {
+	case http.MethodGet:
+		w.Header().Add("Content-Type", "application/json")
+		parts := strings.Split(strings.Trim(strings.TrimPrefix(req.URL.Path, "/addresses/"), "/"), "/")
+		if len(parts) != 2 || parts[0] == "" || parts[1] != "transactions" {
+			w.WriteHeader(http.StatusNotFound)
+			io.WriteString(w, string(utils.JsonStatus("不支持的地址查询")))
+			return
+		}
+		address := parts[0]
+
+		limit := ADDRESS_HISTORY_DEFAULT_LIMIT
+		if s := req.URL.Query().Get("limit"); s != "" {
+			n, err := strconv.Atoi(s)
+			if err != nil || n <= 0 {
+				w.WriteHeader(http.StatusBadRequest)
+				io.WriteString(w, string(utils.JsonStatus("limit 参数错误")))
+				return
+			}
+			if n > ADDRESS_HISTORY_MAX_LIMIT {
+				n = ADDRESS_HISTORY_MAX_LIMIT
+			}
+			limit = n
+		}
+		var before *block.TxLocation
+		if s := req.URL.Query().Get("cursor"); s != "" {
+			loc, err := block.ParseTxLocation(s)
+			if err != nil {
+				w.WriteHeader(http.StatusBadRequest)
+				io.WriteString(w, string(utils.JsonStatus("cursor 参数错误")))
+				return
+			}
+			before = &loc
+		}
+
+		history, err := bcs.GetBlockchain().AddressHistory(address, before, limit)
+		if err != nil {
+			color.Red("查询地址交易失败：%v", err)
+			w.WriteHeader(http.StatusInternalServerError)
+			io.WriteString(w, string(utils.JsonStatus("查询地址交易失败")))
+			return
+		}
+		nextCursor := ""
+		if len(history) == limit {
+			nextCursor = history[len(history)-1].Location.String()
+		}
+		m, _ := json.Marshal(struct {
+			Address      string                      `json:"address"`
+			Transactions []*block.AddressTransaction `json:"transactions"`
+			NextCursor   string                      `json:"next_cursor"`
+		}{
+			Address:      address,
+			Transactions: history,
+			NextCursor:   nextCursor,
+		})
+		io.WriteString(w, string(m))
+		color.Magenta("addressTransactions")
+	default:
+		log.Printf("ERROR: Invalid HTTP Method")
+		w.WriteHeader(http.StatusBadRequest)
+	}
+}
+
 func (bcs *BlockchainServer) Transactions(w http.ResponseWriter, req *http.Request) {
 	switch req.Method {
 	case http.MethodGet:
@@ -209,6 +515,7 @@ func (bcs *BlockchainServer) Transactions(w http.ResponseWriter, req *http.Reque
 			log.Println("发送人私钥SenderPrivateKey:", *t.SenderBlockchainAddress)
 			log.Println("接收人地址RecipientBlockchainAddress:", *t.RecipientBlockchainAddress)
 			log.Println("金额Value:", *t.Value)
+			log.Println("交易费Fee:", t.Fee)
 			log.Println("交易Signature:", *t.Signature)
 
 			if !t.Validate() {
@@ -216,13 +523,19 @@ func (bcs *BlockchainServer) Transactions(w http.ResponseWriter, req *http.Reque
 				io.WriteString(w, string(utils.JsonStatus("fail")))
 				return
 			}
+			if !t.MatchesChain() {
+				log.Printf("ERROR: 交易的链 ID %d 不是本链的 %d", *t.ChainID, block.CHAIN_ID)
+				w.WriteHeader(http.StatusBadRequest)
+				io.WriteString(w, string(utils.JsonStatus("chain id mismatch")))
+				return
+			}
 
 			publicKey := utils.PublicKeyFromString(*t.SenderPublicKey)
 			signature := utils.SignatureFromString(*t.Signature)
 			bc := bcs.GetBlockchain()
 
 			isCreated := bc.CreateTransaction(*t.SenderBlockchainAddress,
-				*t.RecipientBlockchainAddress, t.Value, publicKey, signature)
+				*t.RecipientBlockchainAddress, t.Value, t.Fee, *t.Nonce, publicKey, signature)
 
 			w.Header().Add("Content-Type", "application/json")
 			var m []byte
@@ -251,12 +564,18 @@ func (bcs *BlockchainServer) Transactions(w http.ResponseWriter, req *http.Reque
 			io.WriteString(w, string(utils.JsonStatus("fail")))
 			return
 		}
+		if !t.MatchesChain() {
+			log.Printf("ERROR: 交易的链 ID %d 不是本链的 %d", *t.ChainID, block.CHAIN_ID)
+			w.WriteHeader(http.StatusBadRequest)
+			io.WriteString(w, string(utils.JsonStatus("chain id mismatch")))
+			return
+		}
 		publicKey := utils.PublicKeyFromString(*t.SenderPublicKey)
 		signature := utils.SignatureFromString(*t.Signature)
 		bc := bcs.GetBlockchain()
 
 		isUpdated := bc.AddTransaction(*t.SenderBlockchainAddress,
-			*t.RecipientBlockchainAddress, t.Value, publicKey, signature)
+			*t.RecipientBlockchainAddress, t.Value, t.Fee, *t.Nonce, publicKey, signature)
 
 		w.Header().Add("Content-Type", "application/json")
 		var m []byte
@@ -278,6 +597,47 @@ func (bcs *BlockchainServer) Transactions(w http.ResponseWriter, req *http.Reque
 	}
 }
 
+// GET /transactions/{hash}/proof：返回交易到所在区块 Merkle 根的路径，
+// 只持有区块头的客户端可以用它验证交易已上链
+func (bcs *BlockchainServer) TransactionProof(w http.ResponseWriter, req *http.Request) {
+	switch req.Method {
+	case http.MethodGet:
+		w.Header().Add("Content-Type", "application/json")
+		parts := strings.Split(strings.Trim(strings.TrimPrefix(req.URL.Path, "/transactions/"), "/"), "/")
+		if len(parts) != 2 || parts[1] != "proof" {
+			w.WriteHeader(http.StatusNotFound)
+			io.WriteString(w, string(utils.JsonStatus("不支持的交易查询")))
+			return
+		}
+		hashBytes, err := hex.DecodeString(parts[0])
+		if err != nil || len(hashBytes) != 32 {
+			w.WriteHeader(http.StatusBadRequest)
+			io.WriteString(w, string(utils.JsonStatus("无法解码哈希字符串")))
+			return
+		}
+		var hash [32]byte
+		copy(hash[:], hashBytes)
+
+		proof, err := bcs.GetBlockchain().TransactionProof(hash)
+		if errors.Is(err, block.ErrTransactionNotFound) {
+			w.WriteHeader(http.StatusNotFound)
+			io.WriteString(w, string(utils.JsonStatus("该交易不存在")))
+			return
+		}
+		if err != nil {
+			color.Red("生成交易证明失败：%v", err)
+			w.WriteHeader(http.StatusInternalServerError)
+			io.WriteString(w, string(utils.JsonStatus("生成交易证明失败")))
+			return
+		}
+		m, _ := proof.MarshalJSON()
+		io.WriteString(w, string(m))
+	default:
+		log.Printf("ERROR: Invalid HTTP Method")
+		w.WriteHeader(http.StatusBadRequest)
+	}
+}
+
 func (bcs *BlockchainServer) Mine(w http.ResponseWriter, req *http.Request) {
 	switch req.Method {
 	case http.MethodGet:
@@ -299,6 +659,119 @@ func (bcs *BlockchainServer) Mine(w http.ResponseWriter, req *http.Request) {
 	}
 }
 
+// 返回挖矿线程数、是否正在挖矿和哈希速率
+func (bcs *BlockchainServer) MineStatus(w http.ResponseWriter, req *http.Request) {
+	switch req.Method {
+	case http.MethodGet:
+		bc := bcs.GetBlockchain()
+		m, _ := bc.MiningStats().MarshalJSON()
+		w.Header().Add("Content-Type", "application/json")
+		io.WriteString(w, string(m))
+	default:
+		log.Println("ERROR: Invalid HTTP Method")
+		w.WriteHeader(http.StatusBadRequest)
+	}
+}
+
+// 根据最近区块中交易的费率估算交易费，钱包据此填写交易费
+func (bcs *BlockchainServer) FeeEstimate(w http.ResponseWriter, req *http.Request) {
+	switch req.Method {
+	case http.MethodGet:
+		w.Header().Add("Content-Type", "application/json")
+		estimate, err := bcs.GetBlockchain().EstimateFees()
+		if err != nil {
+			color.Red("估算交易费失败：%v", err)
+			w.WriteHeader(http.StatusInternalServerError)
+			io.WriteString(w, string(utils.JsonStatus("估算交易费失败")))
+			return
+		}
+		m, _ := estimate.MarshalJSON()
+		io.WriteString(w, string(m))
+	default:
+		log.Println("ERROR: Invalid HTTP Method")
+		w.WriteHeader(http.StatusBadRequest)
+	}
+}
+
+// 外部矿工获取区块模板，address 为挖矿奖励的收款地址
+func (bcs *BlockchainServer) MineTemplate(w http.ResponseWriter, req *http.Request) {
+	switch req.Method {
+	case http.MethodGet:
+		w.Header().Add("Content-Type", "application/json")
+		address := req.URL.Query().Get("address")
+		if address == "" {
+			w.WriteHeader(http.StatusBadRequest)
+			io.WriteString(w, string(utils.JsonStatus("缺少 address 参数")))
+			return
+		}
+		tmpl, err := bcs.GetBlockchain().NewBlockTemplate(address)
+		if errors.Is(err, block.ErrTemplateUnsupported) {
+			w.WriteHeader(http.StatusNotImplemented)
+			io.WriteString(w, string(utils.JsonStatus("当前共识引擎不支持外部挖矿")))
+			return
+		}
+		if err != nil {
+			color.Red("生成区块模板失败：%v", err)
+			w.WriteHeader(http.StatusInternalServerError)
+			io.WriteString(w, string(utils.JsonStatus("生成区块模板失败")))
+			return
+		}
+		m, _ := tmpl.MarshalJSON()
+		io.WriteString(w, string(m))
+	default:
+		log.Println("ERROR: Invalid HTTP Method")
+		w.WriteHeader(http.StatusBadRequest)
+	}
+}
+
+// 外部矿工提交模板的 nonce
+type SubmitBlockRequest struct {
+	ID    *string `json:"id"`
+	Nonce *uint64 `json:"nonce"`
+}
+
+func (bcs *BlockchainServer) MineSubmit(w http.ResponseWriter, req *http.Request) {
+	switch req.Method {
+	case http.MethodPost:
+		w.Header().Add("Content-Type", "application/json")
+		var sr SubmitBlockRequest
+		if err := json.NewDecoder(req.Body).Decode(&sr); err != nil || sr.ID == nil || sr.Nonce == nil {
+			w.WriteHeader(http.StatusBadRequest)
+			io.WriteString(w, string(utils.JsonStatus("请求参数错误")))
+			return
+		}
+		idBytes, err := hex.DecodeString(*sr.ID)
+		if err != nil || len(idBytes) != 32 {
+			w.WriteHeader(http.StatusBadRequest)
+			io.WriteString(w, string(utils.JsonStatus("模板 ID 错误")))
+			return
+		}
+		var id [32]byte
+		copy(id[:], idBytes)
+
+		b, err := bcs.GetBlockchain().SubmitBlock(id, *sr.Nonce)
+		switch {
+		case err == nil:
+		case errors.Is(err, block.ErrUnknownTemplate):
+			w.WriteHeader(http.StatusNotFound)
+		case errors.Is(err, block.ErrStaleTemplate):
+			w.WriteHeader(http.StatusConflict)
+		default:
+			w.WriteHeader(http.StatusBadRequest)
+		}
+		if err != nil {
+			color.Red("提交区块失败：%v", err)
+			io.WriteString(w, string(utils.JsonStatus(err.Error())))
+			return
+		}
+		m, _ := b.MarshalJSON()
+		io.WriteString(w, string(m))
+	default:
+		log.Println("ERROR: Invalid HTTP Method")
+		w.WriteHeader(http.StatusBadRequest)
+	}
+}
+
 func (bcs *BlockchainServer) StartMine(w http.ResponseWriter, req *http.Request) {
 	switch req.Method {
 	case http.MethodGet:
@@ -332,9 +805,26 @@ func (bcs *BlockchainServer) Amount(w http.ResponseWriter, req *http.Request) {
 
 		color.Green("查询账户: %s 余额请求", blockchainAddress)
 
-		amount := bcs.GetBlockchain().CalculateTotalAmount(blockchainAddress)
+		bc := bcs.GetBlockchain()
+		amount := bc.CalculateTotalAmount(blockchainAddress)
+		immature := bc.CalculateImmatureAmount(blockchainAddress)
+		// 可选参数 height：查询指定区块高度时的余额
+		if height, ok := data["height"].(float64); ok {
+			amount, err = bc.CalculateTotalAmountAt(blockchainAddress, int64(height))
+			if err == nil {
+				immature, err = bc.CalculateImmatureAmountAt(blockchainAddress, int64(height))
+			}
+			if err != nil {
+				http.Error(w, err.Error(), http.StatusBadRequest)
+				return
+			}
+		}
 
-		ar := &block.AmountResponse{Amount: amount}
+		ar := &block.AmountResponse{
+			Amount:    amount,
+			Spendable: new(big.Int).Sub(amount, immature),
+			Immature:  immature,
+		}
 		m, _ := ar.MarshalJSON()
 
 		w.Header().Add("Content-Type", "application/json")
@@ -365,19 +855,44 @@ func (bcs *BlockchainServer) Consensus(w http.ResponseWriter, req *http.Request)
 	}
 }
 
+// 拒绝来自其他链的节点的请求，见 block.CheckChainID
+func checkChainID(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		if err := block.CheckChainID(req); err != nil {
+			color.Red("拒绝来自 %s 的请求 %s：%v", req.RemoteAddr, req.URL.Path, err)
+			w.Header().Add("Content-Type", "application/json")
+			w.WriteHeader(http.StatusForbidden)
+			io.WriteString(w, string(utils.JsonStatus("chain id mismatch")))
+			return
+		}
+		next.ServeHTTP(w, req)
+	})
+}
+
 func (bcs *BlockchainServer) Run() {
 	bcs.GetBlockchain().Run()
 
 	http.HandleFunc("/", bcs.GetChain)
+	http.HandleFunc("/status", bcs.GetStatus)
+	http.HandleFunc("/finalized", bcs.GetFinalized)
+	http.HandleFunc("/headers", bcs.GetHeaders)
+	http.HandleFunc("/blocks/", bcs.GetBlockBody)
 	http.HandleFunc("/getBlockByNumber", bcs.GetBlockByNumber)
 	http.HandleFunc("/getBlockByHash", bcs.GetBlockByHash)
 	http.HandleFunc("/getTransactionByHash", bcs.GetTransactionByHash)
 	http.HandleFunc("/getTransactions", bcs.GetTransactions)
+	http.HandleFunc("/addresses/", bcs.AddressTransactions)
+	http.HandleFunc("/accounts/", bcs.AccountNonce)
 	http.HandleFunc("/transactions", bcs.Transactions) //GET 方式和  POST方式
+	http.HandleFunc("/transactions/", bcs.TransactionProof)
 	http.HandleFunc("/mine", bcs.Mine)
 	http.HandleFunc("/mine/start", bcs.StartMine)
+	http.HandleFunc("/mine/status", bcs.MineStatus)
+	http.HandleFunc("/mine/template", bcs.MineTemplate)
+	http.HandleFunc("/mine/submit", bcs.MineSubmit)
 	http.HandleFunc("/amount", bcs.Amount)
+	http.HandleFunc("/fees/estimate", bcs.FeeEstimate)
 	http.HandleFunc("/consensus", bcs.Consensus)
-	log.Fatal(http.ListenAndServe(":"+strconv.Itoa(int(bcs.Port())), nil))
+	log.Fatal(http.ListenAndServe(":"+strconv.Itoa(int(bcs.Port())), checkChainID(http.DefaultServeMux)))
 
 }
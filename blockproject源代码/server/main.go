@@ -3,6 +3,8 @@ package main
 import (
 	"flag"
 	"fmt"
+	"jhblockchain/block"
+	"jhblockchain/wallet"
 	"log"
 
 	"github.com/fatih/color"
@@ -16,12 +18,52 @@ func init() {
 	log.SetPrefix("Blockchain: ")
 }
 
+// 未指定 --key 时使用的矿工私钥
+const DEFAULT_MINER_KEY = "4c5011a23e8fe8410899547a1c333ad46a65bc0615bf38aa252d89a17f097190"
+
 func main() {
 
 	port := flag.Uint("port", 5000, "TCP Port Number for Blockchain Server")
+	datadir := flag.String("datadir", ".", "Directory for Blockchain Data")
+	storeType := flag.String("store", block.STORE_FILE, "Block Store Type (file|memory|db)")
+	fsync := flag.String("fsync", "always", "Block Store Fsync Policy (always|interval|never)")
+	miners := flag.Int("miners", 0, "Number of Mining Goroutines (0 = number of CPUs)")
+	consensus := flag.String("consensus", block.CONSENSUS_POW, "Consensus Engine (pow|poa)")
+	signers := flag.String("signers", "", "Comma Separated Public Keys of PoA Signers")
+	key := flag.String("key", DEFAULT_MINER_KEY, "Private Key of the Miner Wallet")
+	genesis := flag.String("genesis", "", "Chain Spec JSON File (empty = default genesis)")
+	finality := flag.Uint64("finality", block.FINALITY_CONFIRMATIONS, "Confirmations Before a Block Is Final and Never Reorganized")
 	flag.Parse()
-	fmt.Printf("port::%v \n", *port)
-	app := NewBlockchainServer(uint16(*port))
+	block.FINALITY_CONFIRMATIONS = *finality
+	fmt.Printf("port::%v datadir:%v store:%v fsync:%v miners:%v consensus:%v genesis:%v\n", *port, *datadir, *storeType, *fsync, *miners, *consensus, *genesis)
+
+	var spec *block.ChainSpec
+	if *genesis != "" {
+		var err error
+		if spec, err = block.LoadChainSpec(*genesis); err != nil {
+			log.Fatalf("ERROR: 读取链配置失败 %v", err)
+		}
+		spec.Apply()
+		color.Cyan("创世纪块 %x", spec.Genesis().Hash())
+	}
+
+	syncPolicy, err := block.ParseSyncPolicy(*fsync)
+	if err != nil {
+		log.Fatalf("ERROR: %v", err)
+	}
+	store, err := block.OpenStore(*storeType, *datadir, syncPolicy)
+	if err != nil {
+		log.Fatalf("ERROR: 打开区块存储失败 %v", err)
+	}
+	defer store.Close()
+
+	minersWallet := wallet.LoadWallet(*key)
+	engine, err := block.OpenEngine(*consensus, *miners, *signers, minersWallet.PrivateKey())
+	if err != nil {
+		log.Fatalf("ERROR: 创建共识引擎失败 %v", err)
+	}
+
+	app := NewBlockchainServer(uint16(*port), store, minersWallet, engine, spec)
 	app.Run()
 
 }
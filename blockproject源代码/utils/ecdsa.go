@@ -13,8 +13,9 @@ type Signature struct {
 	S *big.Int
 }
 
+// R、S 各补齐到 64 个十六进制字符，SignatureFromString 按固定位置拆分
 func (s *Signature) String() string {
-	return fmt.Sprintf("%x%x", s.R, s.S)
+	return fmt.Sprintf("%064x%064x", s.R, s.S)
 }
 
 func String2BigIntTuple(s string) (big.Int, big.Int) {
@@ -14,7 +14,7 @@ import (
 // 用于检查给定的主机和端口是否可达。
 // 使用 net.DialTimeout 函数来建立 TCP 连接，并设置了连接的超时时间为 1 秒。
 func IsFoundHost(host string, port uint16) bool {
-	target := fmt.Sprintf("%s:%d", host, port)
+	target := net.JoinHostPort(host, strconv.Itoa(int(port)))
 
 	_, err := net.DialTimeout("tcp", target, 1*time.Second)
 	if err != nil {
@@ -4,13 +4,11 @@ import (
 	"crypto/ecdsa"
 	"crypto/elliptic"
 	"crypto/rand"
-	"crypto/sha256"
 	"encoding/json"
 	"fmt"
+	"jhblockchain/block"
 	"jhblockchain/utils"
 	"math/big"
-
-	"github.com/btcsuite/btcd/btcutil/base58"
 )
 
 type Wallet struct {
@@ -25,13 +23,7 @@ func NewWallet() *Wallet {
 	privateKey, _ := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
 	w.privateKey = privateKey
 	w.publicKey = &w.privateKey.PublicKey
-
-	h := sha256.New()
-	h.Write(w.publicKey.X.Bytes())
-	h.Write(w.publicKey.Y.Bytes())
-	digest := h.Sum(nil)
-	address := base58.Encode(digest)
-	w.blockchainAddress = address
+	w.blockchainAddress = block.AddressFromPublicKey(w.publicKey)
 
 	return w
 }
@@ -60,16 +52,8 @@ func LoadWallet(privkey string) *Wallet {
 	thepriKey.PublicKey = publicKey
 	theWallet.privateKey = thepriKey
 	theWallet.publicKey = &publicKey
-	//计算address
-	h := sha256.New()
-	h.Write(publicKey.X.Bytes())
-	h.Write(publicKey.Y.Bytes())
-
-	digest := h.Sum(nil)
-	// fmt.Printf("digest: %x\n", digest)
-	address := base58.Encode(digest)
-
-	theWallet.blockchainAddress = address
+	//计算address，与节点校验交易时使用同一种方法
+	theWallet.blockchainAddress = block.AddressFromPublicKey(&publicKey)
 
 	return theWallet
 }
@@ -101,7 +85,7 @@ func (w *Wallet) PublicKey() *ecdsa.PublicKey {
 }
 
 func (w *Wallet) PublicKeyStr() string {
-	return fmt.Sprintf("%x%x", w.publicKey.X.Bytes(), w.publicKey.Y.Bytes())
+	return fmt.Sprintf("%064x%064x", w.publicKey.X, w.publicKey.Y)
 }
 
 func (w *Wallet) BlockchainAddress() string {
@@ -134,6 +118,9 @@ type Transaction struct {
 	senderBlockchainAddress    string
 	recipientBlockchainAddress string
 	value                      uint64
+	fee                        uint64
+	chainID                    uint64
+	nonce                      uint64
 	hash                       [32]byte
 }
 
@@ -142,22 +129,30 @@ func (t *Transaction) MarshalJSON() ([]byte, error) {
 		Sender    string `json:"sender_blockchain_address"`
 		Recipient string `json:"recipient_blockchain_address"`
 		Value     uint64 `json:"value"`
+		Fee       uint64 `json:"fee"`
+		ChainID   uint64 `json:"chain_id"`
+		Nonce     uint64 `json:"nonce"`
 		Hash      string `json:"hash"`
 	}{
 		Sender:    t.senderBlockchainAddress,
 		Recipient: t.recipientBlockchainAddress,
 		Value:     t.value,
+		Fee:       t.fee,
+		ChainID:   t.chainID,
+		Nonce:     t.nonce,
 		Hash:      fmt.Sprintf("%x", t.hash),
 	})
 }
 
+// 与节点使用同一种规范编码计算交易哈希，签名才能被节点验证。
+// 链 ID 和交易序号参与哈希，签名只在链 ID 相同的链上有效，并且只能上链一次
 func (t *Transaction) Hash() [32]byte {
-	m, _ := json.Marshal(t)
-	return sha256.Sum256([]byte(m))
+	return block.NewChainTransaction(t.chainID, t.nonce, t.senderBlockchainAddress, t.recipientBlockchainAddress,
+		new(big.Int).SetUint64(t.value), new(big.Int).SetUint64(t.fee)).Hash()
 }
 
 func NewTransaction(privateKey *ecdsa.PrivateKey, publicKey *ecdsa.PublicKey,
-	sender string, recipient string, value uint64) *Transaction {
+	sender string, recipient string, value uint64, fee uint64, chainID uint64, nonce uint64) *Transaction {
 	// return &Transaction{privateKey, publicKey, sender, recipient, value}
 	t := new(Transaction)
 	t.senderPrivateKey = privateKey
@@ -165,10 +160,17 @@ func NewTransaction(privateKey *ecdsa.PrivateKey, publicKey *ecdsa.PublicKey,
 	t.senderBlockchainAddress = sender
 	t.recipientBlockchainAddress = recipient
 	t.value = value
+	t.fee = fee
+	t.chainID = chainID
+	t.nonce = nonce
 	t.hash = t.Hash()
 	return t
 }
 
+func (t *Transaction) Nonce() uint64 {
+	return t.nonce
+}
+
 func (t *Transaction) GenerateSignature() *utils.Signature {
 	// m, _ := json.Marshal(t)
 	// h := sha256.Sum256([]byte(m))
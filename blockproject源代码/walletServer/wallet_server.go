@@ -12,6 +12,7 @@ import (
 	"log"
 	"math/big"
 	"net/http"
+	"net/url"
 	"path"
 	"strconv"
 	"strings"
@@ -38,6 +39,37 @@ func (ws *WalletServer) Gateway() string {
 	return ws.gateway
 }
 
+// 查询节点所在链的链 ID，交易按这个链 ID 签名
+func (ws *WalletServer) ChainID() (uint64, error) {
+	resp, err := http.Get(ws.Gateway() + "/status")
+	if err != nil {
+		return 0, err
+	}
+	defer resp.Body.Close()
+	var status block.ChainStatus
+	if err := json.NewDecoder(resp.Body).Decode(&status); err != nil {
+		return 0, err
+	}
+	return status.ChainID, nil
+}
+
+// 从网关节点查询地址下一笔交易应使用的序号
+func (ws *WalletServer) Nonce(address string) (uint64, error) {
+	resp, err := http.Get(ws.Gateway() + "/accounts/" + url.PathEscape(address) + "/nonce")
+	if err != nil {
+		return 0, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return 0, fmt.Errorf("网关返回 %s", resp.Status)
+	}
+	var nonce block.AccountNonce
+	if err := json.NewDecoder(resp.Body).Decode(&nonce); err != nil {
+		return 0, err
+	}
+	return nonce.PendingNonce, nil
+}
+
 func (ws *WalletServer) Index(w http.ResponseWriter, req *http.Request) {
 	switch req.Method {
 	case http.MethodGet:
@@ -90,6 +122,7 @@ type TransactionRequest struct {
 	RecipientBlockchainAddress *string `json:"recipient_blockchain_address"`
 	SenderPublicKey            *string `json:"sender_public_key"`
 	Value                      *string `json:"value"`
+	Fee                        *string `json:"fee"`
 }
 
 func (tr *TransactionRequest) Validate() bool {
@@ -122,6 +155,9 @@ func (ws *WalletServer) CreateTransaction(
 		log.Println("发送人地址SenderBlockchainAddress ==", *t.SenderBlockchainAddress)
 		log.Println("接收人地址RecipientBlockchainAddress ==", *t.RecipientBlockchainAddress)
 		log.Println("金额Value ==", *t.Value)
+		if t.Fee != nil {
+			log.Println("交易费Fee ==", *t.Fee)
+		}
 		log.Printf("\n\n\n")
 
 		publicKey := utils.PublicKeyFromString(*t.SenderPublicKey)
@@ -132,6 +168,14 @@ func (ws *WalletServer) CreateTransaction(
 			io.WriteString(w, string(utils.JsonStatus("fail")))
 			return
 		}
+		var fee uint64
+		if t.Fee != nil && len(*t.Fee) > 0 {
+			if fee, err = strconv.ParseUint(*t.Fee, 10, 64); err != nil {
+				log.Println("ERROR: parse fee error")
+				io.WriteString(w, string(utils.JsonStatus("fail")))
+				return
+			}
+		}
 
 		if !t.Validate() {
 			log.Println("ERROR: missing field(s)")
@@ -141,9 +185,23 @@ func (ws *WalletServer) CreateTransaction(
 
 		w.Header().Add("Content-Type", "application/json")
 
+		chainID, err := ws.ChainID()
+		if err != nil {
+			log.Printf("ERROR: 查询链 ID 失败 %v", err)
+			io.WriteString(w, string(utils.JsonStatus("fail")))
+			return
+		}
+
+		nonce, err := ws.Nonce(*t.SenderBlockchainAddress)
+		if err != nil {
+			log.Printf("ERROR: 查询交易序号失败 %v", err)
+			io.WriteString(w, string(utils.JsonStatus("fail")))
+			return
+		}
+
 		// 交易签名
 		transaction := wallet.NewTransaction(privateKey, publicKey,
-			*t.SenderBlockchainAddress, *t.RecipientBlockchainAddress, value)
+			*t.SenderBlockchainAddress, *t.RecipientBlockchainAddress, value, fee, chainID, nonce)
 		signature := transaction.GenerateSignature()
 		signatureStr := signature.String()
 		color.Red("signature:%s", signature)
@@ -153,6 +211,9 @@ func (ws *WalletServer) CreateTransaction(
 			RecipientBlockchainAddress: t.RecipientBlockchainAddress,
 			SenderPublicKey:            t.SenderPublicKey,
 			Value:                      big.NewInt(int64(value)),
+			Fee:                        new(big.Int).SetUint64(fee),
+			ChainID:                    &chainID,
+			Nonce:                      &nonce,
 			Signature:                  &signatureStr,
 		}
 		m, _ := json.Marshal(bt)
@@ -221,11 +282,15 @@ func (ws *WalletServer) WalletAmount(w http.ResponseWriter, req *http.Request) {
 			}
 
 			resp_message := struct {
-				Message string   `json:"message"`
-				Amount  *big.Int `json:"amount"`
+				Message   string   `json:"message"`
+				Amount    *big.Int `json:"amount"`
+				Spendable *big.Int `json:"spendable"`
+				Immature  *big.Int `json:"immature"`
 			}{
-				Message: "success",
-				Amount:  bar.Amount,
+				Message:   "success",
+				Amount:    bar.Amount,
+				Spendable: bar.Spendable,
+				Immature:  bar.Immature,
 			}
 			m, _ := json.Marshal(resp_message)
 			io.WriteString(w, string(m[:]))